@@ -1,9 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	sdk "github.com/ai-goblins/goblin-sdk"
 )
@@ -13,138 +31,4365 @@ import (
 // goblinArgs holds the blueprint-declared configuration for this goblin.
 // All fields are optional and fall back to sensible defaults.
 type goblinArgs struct {
-	// Name is the recipient's name, used to personalise the greeting.
+	// Name is the recipient's name, used to personalise the greeting. An
+	// empty, whitespace-only or null name falls back to the default.
 	// Default: "friend"
 	Name string `json:"name"`
 
-	// EarliestHour is the earliest hour (UTC, 0–23) the salutation may be sent.
+	// MaxNameLength caps the length of each name, in characters.
+	// Default: 100
+	MaxNameLength int `json:"max_name_length"`
+
+	// Names is set instead of Name when the name argument is a list. All
+	// recipients share one schedule and are greeted together in
+	// data.messages.
+	Names []string `json:"-"`
+
+	// RecipientPool is a list of {name, weight} to draw the day's single
+	// recipient from under selection "one_weighted". Weights are positive
+	// integers; a name with weight 3 is three times as likely as one with 1.
+	// Default: []
+	RecipientPool []poolEntry `json:"recipient_pool"`
+
+	// Selection is how the day's recipients are chosen: "all" greets name as
+	// given; "one_weighted" draws one from recipient_pool on the first run
+	// of each day and keeps that choice, in state, for the rest of the day.
+	// Default: "all"
+	Selection string `json:"selection"`
+
+	// BatchSize caps how many of a name list are greeted per run. Once the
+	// day's send is due, each run greets the next batch not yet greeted
+	// today, until everyone has been; the day counts as sent after the last
+	// batch. 0 greets everyone at once. Not with confirm_delivery.
+	// Default: 0
+	BatchSize int `json:"batch_size"`
+
+	// Timezone is the IANA zone name (e.g. "America/New_York") in which the
+	// window, the calendar day, and the time of day are evaluated. A fixed
+	// offset such as "+05:30" or "UTC-8" is accepted when the name isn't
+	// known, for runtimes without the tz database.
+	// Default: "UTC"
+	Timezone string `json:"timezone"`
+
+	// EarliestHour is the earliest local hour (0–23) the salutation may be sent.
 	// Default: 8
 	EarliestHour int `json:"earliest_hour"`
 
-	// LatestHour is the latest hour (UTC, 0–23, exclusive) the salutation may be sent.
-	// Must be greater than EarliestHour.
+	// EarliestMinute is the minute within EarliestHour the window opens.
+	// Default: 0
+	EarliestMinute int `json:"earliest_minute"`
+
+	// LatestHour is the latest local hour (0–24, exclusive) the salutation may be sent.
+	// 24 means the window runs up to midnight. The window must end strictly
+	// after it opens.
 	// Default: 20
 	LatestHour int `json:"latest_hour"`
+
+	// LatestMinute, when set, makes the window run up to and including
+	// LatestHour:LatestMinute instead of ending just before LatestHour.
+	// Default: unset (the window closes at LatestHour:00, so the last minute
+	// that can be picked is :59 of the previous hour)
+	LatestMinute *int `json:"latest_minute"`
+
+	// WindowPreset names a common window ("business_hours", "daytime",
+	// "evening", or "anytime" for the whole day, 00:00–23:59) to use instead
+	// of spelling out the hours. An explicit
+	// earliest_hour or latest_hour overrides that bound of the preset.
+	// Default: unset
+	WindowPreset string `json:"window_preset"`
+
+	// FixedTime, when set, is the local time (HH:MM) sent at every day, in
+	// place of a random pick. The window bounds, blackout ranges and
+	// distribution don't apply to it.
+	// Default: unset
+	FixedTime string `json:"fixed_time"`
+
+	// JitterMinutes spreads a fixed_time send uniformly over this many
+	// minutes either side of it, so "around 9am" needn't be a whole window.
+	// Needs fixed_time, and the band must stay within the day.
+	// Default: 0
+	JitterMinutes int `json:"jitter_minutes"`
+
+	// MinuteGranularity snaps picked send times to minutes of the day that
+	// are a multiple of it — 5 gives 09:05, 09:10 — drawing only from those
+	// inside the window. It must divide 60 evenly, and doesn't apply to
+	// fixed_time.
+	// Default: 1
+	MinuteGranularity int `json:"minute_granularity"`
+
+	// Anchor ("sunrise" or "sunset") replaces the window with the
+	// anchor_window_minutes after that day's solar event at latitude and
+	// longitude. On a day the sun doesn't rise or set there, or when the
+	// event falls outside the local day, the fixed window is used instead,
+	// with a warning. Doesn't apply with fixed_time or sends_per_day 2.
+	// Default: unset
+	Anchor string `json:"anchor"`
+
+	// Latitude and Longitude locate the anchor, in degrees (north and east
+	// positive). Both are required with anchor.
+	// Default: unset
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+
+	// AnchorWindowMinutes is how long the anchored window stays open after
+	// the solar event.
+	// Default: 60
+	AnchorWindowMinutes int `json:"anchor_window_minutes"`
+
+	// SendToleranceMinutes sends up to this many minutes ahead of the
+	// scheduled time, so a coarse scheduler that wakes just short of it
+	// doesn't wait a whole extra cycle. Never earlier than the window opens.
+	// Default: 0
+	SendToleranceMinutes int `json:"send_tolerance_minutes"`
+
+	// MinGapHours holds a due send back until at least this many hours have
+	// passed since the previous one, guarding against two sends landing close
+	// together across a cadence boundary or a timezone change. 0 means no
+	// minimum.
+	// Default: 0
+	MinGapHours int `json:"min_gap_hours"`
+
+	// MaxDelayMinutes abandons today's send when the goblin first runs more
+	// than this many minutes after the scheduled time, so a late wake-up
+	// doesn't deliver a stale greeting. 0 means no limit.
+	// Default: 0
+	MaxDelayMinutes int `json:"max_delay_minutes"`
+
+	// ImmediateFirstRun sends on a brand-new goblin's very first run when it
+	// lands inside today's window, instead of picking a later time and
+	// waiting. Before the window it still schedules as usual. Doesn't apply
+	// with fixed_time.
+	// Default: false
+	ImmediateFirstRun bool `json:"immediate_first_run"`
+
+	// RepickTarget chooses the day a schedule is picked for when there is no
+	// usable one: "today" picks for today (skipping outright on a disallowed
+	// day), while "next_eligible" picks for the first day from today allowed
+	// by the days filter, so a gap that ends on a disallowed day still leaves
+	// the next send scheduled.
+	// Default: "today"
+	RepickTarget string `json:"repick_target"`
+
+	// StatePatch holds state fields to overwrite before each run, letting
+	// operators correct state from outside. Unknown keys are ignored; a null
+	// value clears the field. See MergeState.
+	// Default: none
+	StatePatch map[string]any `json:"state_patch"`
+
+	// Force sends on every run, bypassing the schedule, the already-sent
+	// check, the day filters and the window, for manual tests and one-off
+	// blasts. The send is recorded as usual, so once Force is removed the
+	// daily gate resumes.
+	// Default: false
+	Force bool `json:"force"`
+
+	// ConfirmDelivery holds each send open until the delivery step sets
+	// delivery_confirmed in state: until then every run re-emits the same
+	// send, and only once it is confirmed is the day recorded as sent.
+	// Default: false
+	ConfirmDelivery bool `json:"confirm_delivery"`
+
+	// MaxRetries is how many times an unconfirmed send is re-emitted before
+	// the goblin gives up on the day. Only used with ConfirmDelivery.
+	// Default: 3
+	MaxRetries int `json:"max_retries"`
+
+	// ResendOnNameChange sends again on a day already sent when the name
+	// differs from the one that send used, so a corrected name gets a
+	// corrected greeting.
+	// Default: false
+	ResendOnNameChange bool `json:"resend_on_name_change"`
+
+	// CatchUp makes the first send after days without one report them in
+	// data.missed_days, so the greeting can acknowledge the gap. Only days
+	// the days filter allows and skip_dates doesn't exclude count.
+	// Default: false
+	CatchUp bool `json:"catch_up"`
+
+	// Digest adds data.digest to each send: the past week, one entry per day
+	// a run saw, with the time_of_day its greeting would have had and
+	// whether a daily goblin would have sent then. Meant for cadence
+	// weekly, so the weekly greeting can mention the days in between.
+	// Default: false
+	Digest bool `json:"digest"`
+
+	// ClockOffsetMinutes shifts the time the binary runs at by this many
+	// minutes, up to a year either way, so a staging deployment can
+	// fast-forward (or rewind) without code changes. Only main applies it,
+	// to the now it hands run; state is read and written as usual.
+	// Default: 0
+	ClockOffsetMinutes int `json:"clock_offset_minutes"`
+
+	// SuppressIntermediate marks the runs that only wait on a send still to
+	// come — picking the day's time, or waiting for it or for enough events
+	// — with data.silent, so logs and metrics can filter them out. The
+	// decision and the state written are unchanged.
+	// Default: false
+	SuppressIntermediate bool `json:"suppress_intermediate"`
+
+	// DryRun computes the decision as usual but returns the incoming state
+	// unchanged, so a configuration can be tried out without advancing
+	// anything. data.dry_run and data.scheduled_for report what would happen.
+	// Default: false
+	DryRun bool `json:"dry_run"`
+
+	// PreviewDays, when above 0, adds data.preview: the send time this
+	// configuration would pick on each of the next PreviewDays days, worked
+	// out by the same decision logic as run. Nothing in the returned state
+	// reflects it.
+	// Default: 0
+	PreviewDays int `json:"preview_days"`
+
+	// Seed, when set, makes scheduling reproducible: the send time is drawn
+	// from a random source seeded by Seed and the date, so the same
+	// configuration picks the same time on a given day. Must be an integer,
+	// given as a JSON number or string.
+	// Default: unset (times are drawn from the injected random source)
+	Seed json.Number `json:"seed"`
+
+	// Days lists the weekdays the salutation may be sent on, e.g.
+	// ["mon","tue","wed","thu","fri"]. Full names and any letter case are
+	// accepted; parseArgs normalises them to three-letter lowercase names.
+	// Default: all seven days
+	Days []string `json:"days"`
+
+	// BusinessDaysOnly limits sends to Monday–Friday, narrowing days when
+	// that is set too, with skip_dates as the holidays. parseArgs resolves
+	// it into days.
+	// Default: false
+	BusinessDaysOnly bool `json:"business_days_only"`
+
+	// MonthlyNthWeekday limits sending to one weekday of each month, e.g.
+	// {"weekday": "mon", "n": 1} for the first Monday; n of -1 means the last.
+	// In a month without that occurrence (a fifth Friday, say) nothing is
+	// sent. It narrows Days rather than replacing it.
+	// Default: unset
+	MonthlyNthWeekday *nthWeekday `json:"monthly_nth_weekday"`
+
+	// Once sends a single salutation ever — a welcome, say. After it, state
+	// records completed and every later run skips, whatever the arguments.
+	// Default: false
+	Once bool `json:"once"`
+
+	// MonthlyCap is the most sends allowed in a calendar month of the
+	// configured timezone; once reached, every run skips with reason
+	// "monthly_cap_reached" until the month changes, even with Force. 0
+	// means no cap. Sends are only counted while a cap is set.
+	// Default: 0
+	MonthlyCap int `json:"monthly_cap"`
+
+	// ExpiresOn is the local date (YYYY-MM-DD) a temporary campaign ends: from
+	// that day on every run skips with reason "expired" and nothing is
+	// scheduled, even with Force.
+	// Default: unset (never expires)
+	ExpiresOn string `json:"expires_on"`
+
+	// ResumeGreeting sends an "I'm back" greeting once a snooze or expiry
+	// lapses: the first run after it that falls inside the day's window
+	// sends right away, with data.occasion "resumed" unless the day is
+	// already an occasion, and the schedule carries on as usual after.
+	// Default: false
+	ResumeGreeting bool `json:"resume_greeting"`
+
+	// SkipDates lists local dates (YYYY-MM-DD), such as public holidays, on
+	// which nothing is sent or scheduled.
+	// Default: []
+	SkipDates []string `json:"skip_dates"`
+
+	// Distribution shapes how the send time is drawn from the window:
+	// "uniform" gives every minute the same chance; "early_weighted" favours
+	// the start of the window, falling off linearly towards the end.
+	// Default: "uniform"
+	Distribution string `json:"distribution"`
+
+	// BlackoutRanges lists quiet hours inside the window, such as a lunch
+	// break, during which the salutation is never scheduled. Each range runs
+	// from Start:00 up to (not including) End:00 and must lie within the
+	// window.
+	// Default: []
+	BlackoutRanges []blackoutRange `json:"blackout_ranges"`
+
+	// SendsPerDay is 1 for the usual single daily send, or 2 to send once in
+	// each of Slots every day, e.g. a good morning and a good night. Slots
+	// follow days and skip_dates but not the other cadence arguments.
+	// Default: 1
+	SendsPerDay int `json:"sends_per_day"`
+
+	// Slots names the windows of each send when SendsPerDay is 2, in the
+	// order they fall in the day. Each has whole-hour bounds, and they may
+	// not overlap.
+	// Default: morning 07–10 and evening 20–23
+	Slots []sendSlot `json:"slots"`
+
+	// Windows overrides the window on particular weekdays, keyed by weekday
+	// name: {"sat": {"earliest_hour": 10, "latest_hour": 12}}. A bound an
+	// override leaves out, and every weekday not listed, uses the top-level
+	// window. parseArgs normalises the keys to three-letter lowercase names.
+	// Default: {}
+	Windows map[string]windowOverride `json:"windows"`
+
+	// MinWindowMinutes rejects windows narrower than this many minutes, which
+	// would effectively pin the send to a fixed time. 0 disables the check.
+	// Default: 0
+	MinWindowMinutes int `json:"min_window_minutes"`
+
+	// MorningStart, AfternoonStart, EveningStart and NightStart are the local
+	// hours (0–23, strictly increasing) at which each time_of_day label begins.
+	// Hours from NightStart round to MorningStart are "night"; NightStart may
+	// be 24 to have no night at all.
+	// Defaults: 0, 12, 17, 24
+	MorningStart   int `json:"morning_start"`
+	AfternoonStart int `json:"afternoon_start"`
+	EveningStart   int `json:"evening_start"`
+	NightStart     int `json:"night_start"`
+
+	// LockToken identifies this worker. When set, a run only proceeds if the
+	// state is unlocked, already locked with the same token, or the lock is
+	// older than LockTTLMinutes; otherwise it skips with reason "locked".
+	// Default: "" (no locking)
+	LockToken string `json:"lock_token"`
+
+	// LockTTLMinutes is how long another worker's lock is honoured.
+	// Default: 15
+	LockTTLMinutes int `json:"lock_ttl_minutes"`
+
+	// Messages is a list of greeting templates rotated through one per send.
+	// {name} and {time_of_day} are substituted and the result is emitted as
+	// data.message. When empty, no message is rendered.
+	// Default: []
+	Messages []string `json:"messages"`
+
+	// Template is a Go text/template rendered into data.message on every
+	// send, in place of messages and birthday_message. It sees the fields of
+	// templateContext ({{.Name}}, {{.TimeOfDay}}, {{.Date}}, ...); only the
+	// standard template functions are available, and naming any other is a
+	// parse error.
+	// Default: unset (plain fields, as without it)
+	Template string `json:"template"`
+
+	// Language is the language code used for localised output such as
+	// data.weekday_name. Unknown languages fall back to English.
+	// Default: "en"
+	Language string `json:"language"`
+
+	// Locale selects the language of the time_of_day label and the other
+	// localised output, overriding Language (e.g. "es" labels the morning
+	// "mañana"). Unknown locales fall back to English.
+	// Default: unset (Language is used)
+	Locale string `json:"locale"`
+
+	// IncludeMood adds a light-hearted data.mood derived from the time of day
+	// and the streak, for messages that want a little personality.
+	// Default: false
+	IncludeMood bool `json:"include_mood"`
+
+	// IncludeConfig adds data.config, the arguments as resolved, to a send.
+	// --validate prints the same without running.
+	// Default: false
+	IncludeConfig bool `json:"include_config"`
+
+	// OnEmptyMessage decides what happens when the greeting renders to an
+	// empty string: "send" delivers it anyway, "skip" gives up on today with
+	// skip_reason "empty_message".
+	// Default: "send"
+	OnEmptyMessage string `json:"on_empty_message"`
+
+	// Format is the older, single-format form of Formats: format "markdown"
+	// stands for formats ["markdown"], and also emits the greeting as plain
+	// text in data.message and with light markdown in data.markdown.
+	// Deprecated: use Formats.
+	// Default: "plain"
+	Format string `json:"format"`
+
+	// Formats lists the renderings of the greeting a send carries in
+	// data.rendered, keyed by format: "plain" text, "markdown" with the
+	// name in bold, and "html" with the name in <strong> and everything
+	// escaped.
+	// Default: ["plain"]
+	Formats []string `json:"formats"`
+
+	// Channel hints which delivery channel the send should go out on
+	// ("email", "push" or "sms"), passed through as data.channel for the
+	// delivery layer to route on.
+	// Default: unset
+	Channel string `json:"channel"`
+
+	// Postprocess names PostProcessors applied in order to the data of a
+	// send, for environment-specific touches without forking the goblin.
+	// Default: []
+	Postprocess []string `json:"postprocess"`
+
+	// DSTAmbiguous selects which occurrence of a repeated wall-clock time to
+	// send on when a DST "fall back" transition makes the scheduled time occur
+	// twice: "first" or "second".
+	// Default: "first"
+	DSTAmbiguous string `json:"dst_ambiguous"`
+
+	// Cadence is how often the salutation goes out: "daily", or "weekly" to
+	// send at most once per ISO week (Monday to Sunday), on Weekday only.
+	// Default: "daily"
+	Cadence string `json:"cadence"`
+
+	// Weekday is the day a weekly cadence sends on. Accepts the same
+	// spellings as Days; parseArgs normalises it to a three-letter name.
+	// Ignored for the daily cadence.
+	// Default: "mon"
+	Weekday string `json:"weekday"`
+
+	// ShiftToNextAllowed moves a weekly send whose weekday days excludes to
+	// the first day after it that days allows, instead of never sending.
+	// Default: false
+	ShiftToNextAllowed bool `json:"shift_to_next_allowed"`
+
+	// IntervalDays is the minimum number of calendar days between sends, for
+	// cadences like "every 3 days". Counted in dates, not hours, so a late
+	// send one evening and an early one three dates later are 3 days apart.
+	// Default: 1 (every day)
+	IntervalDays int `json:"interval_days"`
+
+	// SendProbability is the chance (0.0–1.0) that a day gets a salutation at
+	// all. The roll is made once, when the day's schedule is picked; a losing
+	// roll makes it a silent day that skips until tomorrow.
+	// Default: 1.0 (every day)
+	SendProbability float64 `json:"send_probability"`
+
+	// TriggerCount gates the salutation on events: a send is only scheduled
+	// once this many events have accumulated in state.pending_events, and the
+	// counter resets when it goes out. 0 disables the gate.
+	// Default: 0
+	TriggerCount int `json:"trigger_count"`
+
+	// Events is the number of qualifying events that occurred since the
+	// previous run, added to state.pending_events on every run.
+	// Default: 0
+	Events int `json:"events"`
+
+	// TimeFormat is how scheduled_for is written into state and output:
+	// "compact" (2006-01-02T15:04, local wall-clock time) or "rfc3339" (an
+	// exact instant with its UTC offset). Either format is read back, so the
+	// setting can change while a send is pending.
+	// Default: "compact"
+	TimeFormat string `json:"time_format"`
+
+	// Precision is how finely send times are picked: "minute", or "second"
+	// to spread sends across each minute (scheduled_for then reads
+	// 2006-01-02T15:04:05). Either form is read back, so the setting can
+	// change while a send is pending.
+	// Default: "minute"
+	Precision string `json:"precision"`
+
+	// LabelSource is which time time_of_day, greeting, hour and mood describe:
+	// "scheduled", the chosen send time, so a send that runs a little late
+	// keeps the label it was picked for, or "actual", the moment it runs. A
+	// send with no schedule for today (a forced one, say) uses the moment.
+	// Default: "scheduled"
+	LabelSource string `json:"label_source"`
+
+	// Inclusive decides a run at exactly the scheduled instant: true sends
+	// (the time has been reached once now >= scheduled), false waits for the
+	// next run after it. send_tolerance_minutes, min_gap_hours and both
+	// sends of sends_per_day 2 follow the same rule.
+	// Default: true
+	Inclusive bool `json:"inclusive"`
+
+	// VariantCount, when positive, adds data.variant_index: a number from 0
+	// to VariantCount-1 that steps by one each calendar day, so downstream
+	// templates can rotate consistently without a messages list.
+	// Default: 0 (no variant_index)
+	VariantCount int `json:"variant_count"`
+
+	// HistoryLimit caps state.history, the record of past sends; the oldest
+	// entries drop off first. 0 keeps no history.
+	// Default: 30
+	HistoryLimit int `json:"history_limit"`
+
+	// CompactState saves the state as gzipped, base64-encoded JSON under a
+	// single "_c" key, for runners that bill by state size. Plain state is
+	// still read either way, so it can be switched on or off at any time.
+	// Default: false
+	CompactState bool `json:"compact_state"`
+
+	// Birthday is the recipient's birthday as MM-DD. On that day the greeting
+	// uses BirthdayMessage instead of the messages rotation and data.occasion
+	// is "birthday"; the window still decides when it goes out, narrowed by
+	// BirthdayWindow if set.
+	// Default: unset
+	Birthday string `json:"birthday"`
+
+	// BirthdayWindow overrides the window on the birthday, like an entry in
+	// Windows: {"earliest_hour": 7, "latest_hour": 9}. It wins over the
+	// weekday's window.
+	// Default: unset (the day's usual window)
+	BirthdayWindow *windowOverride `json:"birthday_window"`
+
+	// BirthdayMessage is the template used on the birthday, with the same
+	// placeholders as Messages.
+	// Default: "Happy birthday, {name}!"
+	BirthdayMessage string `json:"birthday_message"`
+
+	// LastActivityDate is the local date (YYYY-MM-DD) the recipient was last
+	// active, as the caller knows it. Once more than InactivityDays have
+	// passed since, a send uses ReengagementMessage and data.occasion is
+	// "reengagement". Only the birthday comes before it.
+	// Default: unset
+	LastActivityDate string `json:"last_activity_date"`
+
+	// InactivityDays is how many days of inactivity earn the re-engagement
+	// greeting; 0 turns it off.
+	// Default: 0
+	InactivityDays int `json:"inactivity_days"`
+
+	// ReengagementMessage is the template used for the re-engagement
+	// greeting, with the same placeholders as Messages.
+	// Default: "We miss you, {name}!"
+	ReengagementMessage string `json:"reengagement_message"`
+
+	// Recurrences are further occasions, each a rule — "yearly MM-DD",
+	// "monthly DD" or "weekly <weekday>" — with the occasion label it sets
+	// in data.occasion and the message used that day instead of the
+	// rotation. The birthday and re-engagement come first, then the
+	// earliest matching rule.
+	// A monthly day a month doesn't have isn't matched that month.
+	// Default: []
+	Recurrences []recurrence `json:"recurrences"`
+
+	// LeapDayFallback is when a 02-29 birthday or yearly recurrence is
+	// celebrated in years without a 29 February: "feb28" or "mar1".
+	// Default: "feb28"
+	LeapDayFallback string `json:"leap_day_fallback"`
+
+	// loc is Timezone resolved by parseArgs.
+	loc *time.Location
+
+	// seed is Seed resolved by parseArgs; nil when unset.
+	seed *int64
+
+	// tmpl is Template parsed by parseArgs; nil when unset.
+	tmpl *template.Template
+
+	// warnings lists configuration problems parseArgs noticed that aren't
+	// worth failing over. run reports them in data.warnings.
+	warnings []string
+}
+
+// blackoutRange is one entry of the blackout_ranges argument.
+type blackoutRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// sendSlot is one entry in slots.
+type sendSlot struct {
+	Name         string `json:"name"`
+	EarliestHour int    `json:"earliest_hour"`
+	LatestHour   int    `json:"latest_hour"`
+}
+
+// poolEntry is one entry in recipient_pool.
+type poolEntry struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// pickWeighted draws one name from pool, each with the chance its weight
+// gives it, using a single randIntn over the total weight.
+func pickWeighted(pool []poolEntry, randIntn func(int) int) string {
+	total := 0
+	for _, e := range pool {
+		total += e.Weight
+	}
+	r := randIntn(total)
+	for _, e := range pool {
+		if r < e.Weight {
+			return e.Name
+		}
+		r -= e.Weight
+	}
+	return pool[len(pool)-1].Name
+}
+
+// recurrence is one entry in recurrences. parseArgs resolves Rule into kind
+// and value: an MM-DD for yearly, a day of the month for monthly and a
+// weekday key for weekly.
+type recurrence struct {
+	Rule     string `json:"rule"`
+	Occasion string `json:"occasion"`
+	Message  string `json:"message"`
+
+	// Window, if set, overrides the window on the days the rule matches.
+	Window *windowOverride `json:"window,omitempty"`
+
+	kind, value string
+}
+
+// parseRecurrence resolves r's rule, or says why it can't.
+func parseRecurrence(r recurrence) (recurrence, error) {
+	fields := strings.Fields(strings.ToLower(r.Rule))
+	if len(fields) != 2 {
+		return recurrence{}, fmt.Errorf("rule %q is not \"yearly MM-DD\", \"monthly DD\" or \"weekly <weekday>\"", r.Rule)
+	}
+	r.kind, r.value = fields[0], fields[1]
+	switch r.kind {
+	case "yearly":
+		if err := parseMonthDay(r.value); err != nil {
+			return recurrence{}, fmt.Errorf("rule %q: %w", r.Rule, err)
+		}
+	case "monthly":
+		day, err := strconv.Atoi(r.value)
+		if err != nil || day < 1 || day > 31 {
+			return recurrence{}, fmt.Errorf("rule %q: %q is not a day of the month", r.Rule, r.value)
+		}
+		r.value = strconv.Itoa(day)
+	case "weekly":
+		name, ok := weekdayNames[r.value]
+		if !ok {
+			return recurrence{}, fmt.Errorf("rule %q: unrecognised weekday %q", r.Rule, r.value)
+		}
+		r.value = name
+	default:
+		return recurrence{}, fmt.Errorf("rule %q: unknown kind %q (known: yearly, monthly, weekly)", r.Rule, r.kind)
+	}
+	if strings.TrimSpace(r.Occasion) == "" {
+		return recurrence{}, fmt.Errorf("rule %q needs an occasion", r.Rule)
+	}
+	return r, nil
+}
+
+// matches reports whether date (YYYY-MM-DD) falls on r. A yearly 02-29
+// moves to leapDayFallback in years without one.
+func (r recurrence) matches(date, leapDayFallback string) bool {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return false
+	}
+	switch r.kind {
+	case "yearly":
+		return date[5:] == monthDayIn(r.value, day.Year(), leapDayFallback)
+	case "monthly":
+		return strconv.Itoa(day.Day()) == r.value
+	case "weekly":
+		return weekdayKey(day.Weekday()) == r.value
+	}
+	return false
+}
+
+// nthWeekday is the monthly_nth_weekday argument.
+type nthWeekday struct {
+	Weekday string `json:"weekday"`
+	N       int    `json:"n"`
+}
+
+// matches reports whether day is the nth such weekday of its month.
+func (m nthWeekday) matches(day time.Time) bool {
+	if weekdayKey(day.Weekday()) != m.Weekday {
+		return false
+	}
+	if m.N < 0 {
+		return day.AddDate(0, 0, 7).Month() != day.Month()
+	}
+	return (day.Day()-1)/7+1 == m.N
+}
+
+// windowOverride is one weekday's entry in windows.
+type windowOverride struct {
+	EarliestHour *int `json:"earliest_hour"`
+	LatestHour   *int `json:"latest_hour"`
+}
+
+// location returns the resolved timezone, falling back to UTC for args that
+// did not come through parseArgs.
+func (a goblinArgs) location() *time.Location {
+	if a.loc == nil {
+		return time.UTC
+	}
+	return a.loc
+}
+
+// defaultArgs returns the arguments used when the blueprint sets none. It is
+// the single source of defaults for both parseArgs and ArgsSchema.
+func defaultArgs() goblinArgs {
+	return goblinArgs{
+		Name:                "friend",
+		MaxNameLength:       100,
+		Timezone:            "UTC",
+		EarliestHour:        8,
+		LatestHour:          20,
+		MorningStart:        defaultBoundaries.MorningStart,
+		AfternoonStart:      defaultBoundaries.AfternoonStart,
+		EveningStart:        defaultBoundaries.EveningStart,
+		NightStart:          defaultBoundaries.NightStart,
+		LockTTLMinutes:      15,
+		RepickTarget:        "today",
+		Language:            "en",
+		OnEmptyMessage:      "send",
+		Format:              "plain",
+		Formats:             []string{"plain"},
+		DSTAmbiguous:        "first",
+		Cadence:             "daily",
+		Weekday:             "mon",
+		SendProbability:     1,
+		TimeFormat:          "compact",
+		IntervalDays:        1,
+		HistoryLimit:        30,
+		BirthdayMessage:     "Happy birthday, {name}!",
+		ReengagementMessage: "We miss you, {name}!",
+		LeapDayFallback:     "feb28",
+		Distribution:        "uniform",
+		Precision:           "minute",
+		MinuteGranularity:   1,
+		MaxRetries:          3,
+		SendsPerDay:         1,
+		AnchorWindowMinutes: 60,
+		Inclusive:           true,
+		LabelSource:         "scheduled",
+		Selection:           "all",
+		Slots: []sendSlot{
+			{Name: "morning", EarliestHour: 7, LatestHour: 10},
+			{Name: "evening", EarliestHour: 20, LatestHour: 23},
+		},
+	}
 }
 
 func parseArgs(raw map[string]any) (goblinArgs, error) {
-	a := goblinArgs{Name: "friend", EarliestHour: 8, LatestHour: 20}
+	a := defaultArgs()
 
+	raw, a.warnings = resolveAliases(raw)
+	raw, err := coerceNumbers(raw)
+	if err != nil {
+		return goblinArgs{}, err
+	}
+	if list, ok := raw["name"].([]any); ok {
+		if len(list) == 0 {
+			return goblinArgs{}, fmt.Errorf("name must list at least one recipient")
+		}
+		a.Names = make([]string, len(list))
+		for i, v := range list {
+			name, ok := v.(string)
+			if !ok {
+				return goblinArgs{}, fmt.Errorf("name: recipient %v is not a string", v)
+			}
+			a.Names[i] = name
+		}
+		delete(raw, "name")
+	}
 	data, err := json.Marshal(raw)
 	if err != nil {
 		return goblinArgs{}, fmt.Errorf("marshal args: %w", err)
 	}
 	if err := json.Unmarshal(data, &a); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return goblinArgs{}, fmt.Errorf("%s: a %s is not a %s", typeErr.Field, typeErr.Value, typeErr.Type)
+		}
 		return goblinArgs{}, fmt.Errorf("unmarshal args: %w", err)
 	}
 
-	if a.LatestHour <= a.EarliestHour {
-		return goblinArgs{}, fmt.Errorf(
-			"latest_hour (%d) must be greater than earliest_hour (%d)",
-			a.LatestHour, a.EarliestHour,
-		)
+	// An IANA name first; a runtime without the tz database can still use
+	// a fixed offset.
+	loc, err := time.LoadLocation(a.Timezone)
+	if err != nil {
+		fixed, ok := parseFixedOffset(a.Timezone)
+		if !ok {
+			return goblinArgs{}, fmt.Errorf("timezone %q is neither a known IANA name nor a fixed offset like +05:30 or UTC-8: %w", a.Timezone, err)
+		}
+		loc = fixed
+	}
+	a.loc = loc
+
+	if a.WindowPreset != "" {
+		preset, ok := windowPresets[a.WindowPreset]
+		if !ok {
+			return goblinArgs{}, fmt.Errorf("window_preset %q is not a known preset", a.WindowPreset)
+		}
+		if _, ok := raw["earliest_hour"]; !ok {
+			a.EarliestHour = preset[0]
+		}
+		if _, ok := raw["latest_hour"]; !ok {
+			a.LatestHour = preset[1]
+		}
+	}
+
+	for _, l := range argLimits {
+		if err := l.check(a); err != nil {
+			return goblinArgs{}, err
+		}
+	}
+	for _, e := range argEnums {
+		if err := e.check(a); err != nil {
+			return goblinArgs{}, err
+		}
+	}
+
+	if a.Name, err = cleanName(a.Name, a.MaxNameLength); err != nil {
+		return goblinArgs{}, err
+	}
+	for i := range a.Names {
+		if a.Names[i], err = cleanName(a.Names[i], a.MaxNameLength); err != nil {
+			return goblinArgs{}, err
+		}
+	}
+	for i, e := range a.RecipientPool {
+		if strings.TrimSpace(e.Name) == "" {
+			return goblinArgs{}, fmt.Errorf("recipient_pool: entry %d has no name", i)
+		}
+		if a.RecipientPool[i].Name, err = cleanName(e.Name, a.MaxNameLength); err != nil {
+			return goblinArgs{}, fmt.Errorf("recipient_pool: %w", err)
+		}
+		if e.Weight <= 0 {
+			return goblinArgs{}, fmt.Errorf("recipient_pool: %q has weight %d, want a positive weight", e.Name, e.Weight)
+		}
+	}
+	if a.Selection == "one_weighted" && len(a.RecipientPool) == 0 {
+		return goblinArgs{}, fmt.Errorf("selection one_weighted needs a recipient_pool")
+	}
+	if a.BatchSize > 0 && a.ConfirmDelivery {
+		// Confirming a batch clears the batch state, dropping the rest.
+		return goblinArgs{}, fmt.Errorf("batch_size cannot be combined with confirm_delivery")
+	}
+
+	if a.Template != "" {
+		tmpl, err := template.New("greeting").Option("missingkey=error").Parse(a.Template)
+		if err != nil {
+			return goblinArgs{}, fmt.Errorf("template: %w", err)
+		}
+		// A template can parse yet name a field the context lacks; trying
+		// it on a sample day reports that now rather than at send time.
+		sample := templateContext{Name: "Alice", TimeOfDay: "morning", Date: "2026-02-22", Weekday: "Sunday", Streak: 1, Occasion: "birthday"}
+		if err := tmpl.Execute(io.Discard, sample); err != nil {
+			return goblinArgs{}, fmt.Errorf("template: %w", err)
+		}
+		a.tmpl = tmpl
+	}
+	if a.Seed != "" {
+		seed, err := strconv.ParseInt(a.Seed.String(), 10, 64)
+		if err != nil {
+			return goblinArgs{}, fmt.Errorf("seed %q must be an integer", a.Seed)
+		}
+		a.seed = &seed
+	}
+	if a.Days != nil {
+		days, err := normaliseDays(a.Days)
+		if err != nil {
+			return goblinArgs{}, err
+		}
+		a.Days = days
+	}
+	if a.BusinessDaysOnly {
+		weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+		if a.Days == nil {
+			a.Days = weekdays
+		} else {
+			a.Days = slices.DeleteFunc(a.Days, func(d string) bool { return !slices.Contains(weekdays, d) })
+			if len(a.Days) == 0 {
+				return goblinArgs{}, fmt.Errorf("business_days_only leaves none of days")
+			}
+		}
+	}
+	if a.FixedTime != "" {
+		if _, err := time.Parse("15:04", a.FixedTime); err != nil || len(a.FixedTime) != len("15:04") {
+			return goblinArgs{}, fmt.Errorf("fixed_time %q is not an HH:MM time", a.FixedTime)
+		}
+	}
+	if a.JitterMinutes > 0 {
+		if a.FixedTime == "" {
+			return goblinArgs{}, fmt.Errorf("jitter_minutes needs fixed_time")
+		}
+		if m := a.fixedMinute(); m-a.JitterMinutes < 0 || m+a.JitterMinutes >= 24*60 {
+			return goblinArgs{}, fmt.Errorf("jitter_minutes %d around fixed_time %s crosses midnight", a.JitterMinutes, a.FixedTime)
+		}
+	}
+	if 60%a.MinuteGranularity != 0 {
+		return goblinArgs{}, fmt.Errorf("minute_granularity %d does not divide an hour evenly", a.MinuteGranularity)
+	}
+	if a.MinuteGranularity > 1 && a.Precision == "second" {
+		return goblinArgs{}, fmt.Errorf("minute_granularity needs precision \"minute\"")
+	}
+	for _, f := range a.Formats {
+		if _, ok := renderers[f]; !ok {
+			return goblinArgs{}, fmt.Errorf("formats: unknown %q (known: %s)", f, strings.Join(renderFormats(), ", "))
+		}
+	}
+	if _, ok := raw["format"]; ok {
+		if _, ok := raw["formats"]; ok {
+			a.warnings = append(a.warnings, "format is deprecated and ignored in data.rendered because formats is set")
+		} else {
+			a.warnings = append(a.warnings, "format is deprecated; use formats")
+			a.Formats = []string{a.Format}
+		}
+	}
+	for _, name := range a.Postprocess {
+		if _, ok := postProcessors[name]; !ok {
+			return goblinArgs{}, fmt.Errorf("postprocess: unknown %q (known: %s)", name, strings.Join(postProcessorNames(), ", "))
+		}
+	}
+	if a.Anchor != "" && (a.Latitude == nil || a.Longitude == nil) {
+		return goblinArgs{}, fmt.Errorf("anchor %q needs latitude and longitude", a.Anchor)
+	}
+	if m := a.MonthlyNthWeekday; m != nil {
+		name, ok := weekdayNames[strings.ToLower(strings.TrimSpace(m.Weekday))]
+		if !ok {
+			return goblinArgs{}, fmt.Errorf("monthly_nth_weekday: unrecognised weekday %q", m.Weekday)
+		}
+		if m.N != -1 && (m.N < 1 || m.N > 5) {
+			return goblinArgs{}, fmt.Errorf("monthly_nth_weekday: n must be 1–5, or -1 for the last, got %d", m.N)
+		}
+		a.MonthlyNthWeekday = &nthWeekday{Weekday: name, N: m.N}
+	}
+	if a.ExpiresOn != "" {
+		if _, err := time.Parse("2006-01-02", a.ExpiresOn); err != nil {
+			return goblinArgs{}, fmt.Errorf("expires_on %q is not a YYYY-MM-DD date", a.ExpiresOn)
+		}
+	}
+	if a.LastActivityDate != "" {
+		if _, err := time.Parse("2006-01-02", a.LastActivityDate); err != nil {
+			return goblinArgs{}, fmt.Errorf("last_activity_date %q is not a YYYY-MM-DD date", a.LastActivityDate)
+		}
+	}
+	for _, d := range a.SkipDates {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return goblinArgs{}, fmt.Errorf("skip_dates: %q is not a YYYY-MM-DD date", d)
+		}
+	}
+	if a.Birthday != "" {
+		if err := parseMonthDay(a.Birthday); err != nil {
+			return goblinArgs{}, fmt.Errorf("birthday: %w", err)
+		}
+	}
+	for i, r := range a.Recurrences {
+		if a.Recurrences[i], err = parseRecurrence(r); err != nil {
+			return goblinArgs{}, fmt.Errorf("recurrences: %w", err)
+		}
+	}
+	for _, r := range a.BlackoutRanges {
+		if r.End <= r.Start {
+			return goblinArgs{}, fmt.Errorf("blackout_ranges: %d–%d must end after it starts", r.Start, r.End)
+		}
+	}
+	if err := a.validateWindow(); err != nil {
+		return goblinArgs{}, err
+	}
+	// Blackouts must sit inside the top-level window. The windows that
+	// replace it on some days (weekday overrides, slots, occasions) are
+	// only checked for being left with some open time.
+	start, end := a.window()
+	for _, r := range a.BlackoutRanges {
+		if r.Start*60 < start || r.End*60 > end {
+			return goblinArgs{}, fmt.Errorf(
+				"blackout_ranges: %02d:00–%02d:00 is not inside the send window (%02d:%02d–%s)",
+				r.Start, r.End, a.EarliestHour, a.EarliestMinute, a.latestLabel(),
+			)
+		}
+	}
+	if a.Windows != nil {
+		windows := make(map[string]windowOverride, len(a.Windows))
+		// Spellings of the same day ("Mon", "monday") are taken in sorted
+		// order, the last one winning, rather than in the map's random order.
+		for _, day := range sortedKeys(a.Windows) {
+			w := a.Windows[day]
+			name, ok := weekdayNames[strings.ToLower(strings.TrimSpace(day))]
+			if !ok {
+				return goblinArgs{}, fmt.Errorf("windows: unrecognised weekday %q", day)
+			}
+			windows[name] = w
+		}
+		a.Windows = windows
+		for _, name := range sortedKeys(a.Windows) {
+			d := a.forWeekday(name)
+			for _, l := range argLimits {
+				if err := l.check(d); err != nil {
+					return goblinArgs{}, fmt.Errorf("windows: %s: %w", name, err)
+				}
+			}
+			if err := d.validateWindow(); err != nil {
+				return goblinArgs{}, fmt.Errorf("windows: %s: %w", name, err)
+			}
+		}
+	}
+	// An occasion's window is checked over the top-level window, whose
+	// bounds it replaces on the day.
+	type occasionWindow struct {
+		name string
+		w    *windowOverride
+	}
+	occasionWindows := []occasionWindow{{"birthday_window", a.BirthdayWindow}}
+	for _, r := range a.Recurrences {
+		occasionWindows = append(occasionWindows, occasionWindow{fmt.Sprintf("recurrences: %s: window", r.Rule), r.Window})
+	}
+	for _, o := range occasionWindows {
+		if o.w == nil {
+			continue
+		}
+		d := a.withOverride(*o.w)
+		for _, l := range argLimits {
+			if err := l.check(d); err != nil {
+				return goblinArgs{}, fmt.Errorf("%s: %w", o.name, err)
+			}
+		}
+		if err := d.validateWindow(); err != nil {
+			return goblinArgs{}, fmt.Errorf("%s: %w", o.name, err)
+		}
+	}
+	if a.SendsPerDay > 1 {
+		if len(a.Slots) != a.SendsPerDay {
+			return goblinArgs{}, fmt.Errorf("slots must list %d windows for sends_per_day %d, got %d", a.SendsPerDay, a.SendsPerDay, len(a.Slots))
+		}
+		for i, slot := range a.Slots {
+			if strings.TrimSpace(slot.Name) == "" {
+				return goblinArgs{}, fmt.Errorf("slots: window %d has no name", i+1)
+			}
+			d := a.forSlot(slot)
+			for _, l := range argLimits {
+				if err := l.check(d); err != nil {
+					return goblinArgs{}, fmt.Errorf("slots: %s: %w", slot.Name, err)
+				}
+			}
+			if err := d.validateWindow(); err != nil {
+				return goblinArgs{}, fmt.Errorf("slots: %s: %w", slot.Name, err)
+			}
+			if i > 0 && slot.EarliestHour < a.Slots[i-1].LatestHour {
+				return goblinArgs{}, fmt.Errorf("slots: %s must start after %s ends", slot.Name, a.Slots[i-1].Name)
+			}
+		}
+	}
+	if err := a.boundaries().validate(); err != nil {
+		return goblinArgs{}, err
+	}
+	weekday, ok := weekdayNames[strings.ToLower(strings.TrimSpace(a.Weekday))]
+	if !ok {
+		return goblinArgs{}, fmt.Errorf("weekday: unrecognised weekday %q", a.Weekday)
+	}
+	a.Weekday = weekday
+
+	if _, ok := weekdayNamesByLanguage[strings.ToLower(a.locale())]; !ok {
+		a.warnings = append(a.warnings, fmt.Sprintf("locale %q is not supported; using English", a.locale()))
+	}
+	if start, end := a.window(); a.openMinutes()*10 < end-start {
+		a.warnings = append(a.warnings, fmt.Sprintf(
+			"blackout_ranges leave only %d of the window's %d minutes open", a.openMinutes(), end-start,
+		))
 	}
 	return a, nil
 }
 
-// ── State ─────────────────────────────────────────────────────────────────────
+// parseFixedOffset reads a fixed UTC offset — "+05:30", "-0800", "UTC-8" or
+// "GMT+2" — as a zone named after it, e.g. "UTC+05:30". Offsets beyond
+// ±14:00 are rejected, as no zone on Earth uses them.
+func parseFixedOffset(s string) (*time.Location, bool) {
+	v := strings.TrimSpace(s)
+	if len(v) >= 3 && (strings.EqualFold(v[:3], "UTC") || strings.EqualFold(v[:3], "GMT")) {
+		v = v[3:]
+	}
+	if len(v) < 2 || (v[0] != '+' && v[0] != '-') {
+		return nil, false
+	}
+	sign, v := v[0], v[1:]
+	hh, mm := v, "0"
+	switch {
+	case strings.Contains(v, ":"):
+		hh, mm, _ = strings.Cut(v, ":")
+		if len(mm) != 2 {
+			return nil, false
+		}
+	case len(v) == 4:
+		hh, mm = v[:2], v[2:]
+	case len(v) > 2:
+		return nil, false
+	}
+	if hh == "" || len(hh) > 2 || strings.Trim(hh+mm, "0123456789") != "" {
+		return nil, false
+	}
+	h, _ := strconv.Atoi(hh)
+	m, _ := strconv.Atoi(mm)
+	if m >= 60 || h*60+m > 14*60 {
+		return nil, false
+	}
+	offset := (h*60 + m) * 60
+	if sign == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(fmt.Sprintf("UTC%c%02d:%02d", sign, h, m), offset), true
+}
 
-// goblinState tracks what the goblin has sent and when it plans to send next.
-type goblinState struct {
-	// LastSentDate is the UTC date (YYYY-MM-DD) of the most recent salutation.
-	// Empty on first run.
-	LastSentDate string `json:"last_sent_date,omitempty"`
+// cleanName trims surrounding whitespace from a recipient's name, falling
+// back to the default when nothing is left. Names with control characters
+// (newlines included) or more than max characters are rejected, since they
+// end up verbatim in the output payload.
+func cleanName(name string, max int) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return defaultArgs().Name, nil
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("name %q must not contain control characters or newlines", name)
+	}
+	if n := utf8.RuneCountInString(name); n > max {
+		return "", fmt.Errorf("name is %d characters long, more than max_name_length (%d)", n, max)
+	}
+	return name, nil
+}
 
-	// ScheduledFor is the UTC datetime (YYYY-MM-DDTHH:MM) the goblin has chosen
-	// to send today's salutation. Repicked at the start of each new day.
-	ScheduledFor string `json:"scheduled_for,omitempty"`
+// argLimit bounds a numeric argument to [min, max].
+type argLimit struct {
+	name     string
+	min, max float64
 }
 
-func parseState(raw map[string]any) (goblinState, error) {
-	var s goblinState
-	data, err := json.Marshal(raw)
-	if err != nil {
-		return goblinState{}, fmt.Errorf("marshal state: %w", err)
+// argLimits holds the numeric range of every bounded argument. parseArgs
+// enforces them and ArgsSchema publishes them, so the two can't drift.
+var argLimits = []argLimit{
+	{"max_name_length", 1, math.Inf(1)},
+	{"earliest_hour", 0, 23},
+	{"latest_hour", 0, 24},
+	{"earliest_minute", 0, 59},
+	{"latest_minute", 0, 59},
+	{"max_delay_minutes", 0, math.Inf(1)},
+	{"min_window_minutes", 0, math.Inf(1)},
+	{"lock_ttl_minutes", 1, math.Inf(1)},
+	{"interval_days", 1, math.Inf(1)},
+	{"send_probability", 0, 1},
+	{"trigger_count", 0, math.Inf(1)},
+	{"events", 0, math.Inf(1)},
+	{"variant_count", 0, math.Inf(1)},
+	{"history_limit", 0, math.Inf(1)},
+	{"max_retries", 0, math.Inf(1)},
+	{"preview_days", 0, 366},
+	{"send_tolerance_minutes", 0, math.Inf(1)},
+	{"sends_per_day", 1, 2},
+	{"min_gap_hours", 0, math.Inf(1)},
+	{"batch_size", 0, math.Inf(1)},
+	{"latitude", -90, 90},
+	{"longitude", -180, 180},
+	{"anchor_window_minutes", 1, 720},
+	{"inactivity_days", 0, math.Inf(1)},
+	{"monthly_cap", 0, math.Inf(1)},
+	{"clock_offset_minutes", -maxClockOffsetMinutes, maxClockOffsetMinutes},
+	{"jitter_minutes", 0, 720},
+	{"minute_granularity", 1, 60},
+}
+
+// maxClockOffsetMinutes bounds clock_offset_minutes to a year either way.
+const maxClockOffsetMinutes = 366 * 24 * 60
+
+func (l argLimit) check(a goblinArgs) error {
+	f := argField(a, l.name)
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return nil
+		}
+		f = f.Elem()
 	}
-	if err := json.Unmarshal(data, &s); err != nil {
-		return goblinState{}, fmt.Errorf("unmarshal state: %w", err)
+	var v float64
+	if f.CanInt() {
+		v = float64(f.Int())
+	} else {
+		v = f.Float()
+	}
+	switch {
+	case v >= l.min && v <= l.max:
+		return nil
+	case !math.IsInf(l.max, 1):
+		return fmt.Errorf("%s (%v) must be between %v and %v", l.name, v, l.min, l.max)
+	case l.min == 0:
+		return fmt.Errorf("%s (%v) must not be negative", l.name, v)
+	default:
+		return fmt.Errorf("%s (%v) must be at least %v", l.name, v, l.min)
 	}
-	return s, nil
 }
 
-func saveState(s goblinState) map[string]any {
-	data, _ := json.Marshal(s)
-	var m map[string]any
-	_ = json.Unmarshal(data, &m)
-	return m
+// argEnum restricts a string argument to a fixed set of values.
+type argEnum struct {
+	name   string
+	values []string
 }
 
-// ── Core logic ────────────────────────────────────────────────────────────────
+// argEnums holds the allowed values of every enumerated argument, enforced by
+// parseArgs and published by ArgsSchema. An argument that defaults to unset
+// may also be left unset.
+var argEnums = []argEnum{
+	{"repick_target", []string{"today", "next_eligible"}},
+	{"on_empty_message", []string{"send", "skip"}},
+	{"format", []string{"plain", "markdown"}},
+	{"dst_ambiguous", []string{"first", "second"}},
+	{"cadence", []string{"daily", "weekly"}},
+	{"time_format", []string{"compact", "rfc3339"}},
+	{"leap_day_fallback", []string{"feb28", "mar1"}},
+	{"distribution", []string{"uniform", "early_weighted"}},
+	{"precision", []string{"minute", "second"}},
+	{"anchor", []string{"sunrise", "sunset"}},
+	{"channel", []string{"email", "push", "sms"}},
+	{"label_source", []string{"scheduled", "actual"}},
+	{"selection", []string{"all", "one_weighted"}},
+}
 
-// run is the goblin's business logic.
-//
-// It is separated from main so it can be unit-tested without WASM or the SDK.
-// Dependencies on the current time and randomness are injected so tests are
-// fully deterministic.
-//
-// Behaviour:
-//  1. If the salutation has already been sent today → skip.
-//  2. If no send time has been chosen for today yet → pick one at random within
-//     the configured window, persist it, and skip (will send when the time comes).
-//  3. If the chosen send time has not yet arrived → skip.
-//  4. If the chosen send time has arrived → send the salutation and reset state.
-func run(input sdk.Input, now time.Time, randIntn func(int) int) (sdk.Output, error) {
-	args, err := parseArgs(input.Arguments)
-	if err != nil {
-		return sdk.Output{}, fmt.Errorf("parse arguments: %w", err)
+func (e argEnum) check(a goblinArgs) error {
+	v := argField(a, e.name).String()
+	if v == "" && argField(defaultArgs(), e.name).String() == "" {
+		return nil
+	}
+	for _, allowed := range e.values {
+		if v == allowed {
+			return nil
+		}
 	}
+	quoted := make([]string, len(e.values))
+	for i, allowed := range e.values {
+		quoted[i] = strconv.Quote(allowed)
+	}
+	return fmt.Errorf(
+		"%s must be %s or %s, got %q",
+		e.name, strings.Join(quoted[:len(quoted)-1], ", "), quoted[len(quoted)-1], v,
+	)
+}
 
-	state, err := parseState(input.State)
-	if err != nil {
-		return sdk.Output{}, fmt.Errorf("parse state: %w", err)
+// argField returns the field of a with the given JSON name.
+func argField(a goblinArgs, name string) reflect.Value {
+	v := reflect.ValueOf(a)
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == name {
+			return v.Field(i)
+		}
 	}
+	panic("goblinArgs has no argument " + name)
+}
 
-	today := now.UTC().Format("2006-01-02")
+// ArgsSchema returns a JSON Schema document describing every argument parseArgs
+// accepts: its type, default, and any range or set of allowed values. It is
+// built from goblinArgs, defaultArgs, argLimits and argEnums, the same sources
+// parseArgs uses.
+func ArgsSchema() []byte {
+	defaults := reflect.ValueOf(defaultArgs())
+	t := defaults.Type()
+	weekdays := sortedKeys(weekdayNames)
 
-	// Already sent today — nothing to do.
-	if state.LastSentDate == today {
-		return sdk.Output{State: saveState(state)}, nil
+	props := map[string]map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		prop := map[string]any{}
+		def := defaults.Field(i)
+		switch ft := t.Field(i).Type; {
+		case ft == reflect.TypeOf(json.Number("")):
+			prop["type"] = []string{"integer", "string"}
+		case ft.Kind() == reflect.Slice:
+			prop["type"] = "array"
+			prop["items"] = map[string]any{"type": "string"}
+		case ft.Kind() == reflect.Map:
+			prop["type"] = "object"
+		default:
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			prop["type"] = map[reflect.Kind]string{
+				reflect.String:  "string",
+				reflect.Int:     "integer",
+				reflect.Float64: "number",
+				reflect.Bool:    "boolean",
+			}[ft.Kind()]
+			if def.Kind() != reflect.Pointer {
+				prop["default"] = def.Interface()
+			}
+		}
+		props[name] = prop
 	}
 
-	// No send time chosen for today yet — pick one and wait.
-	if state.ScheduledFor == "" || len(state.ScheduledFor) < 10 || state.ScheduledFor[:10] != today {
-		hour := args.EarliestHour + randIntn(args.LatestHour-args.EarliestHour)
-		minute := randIntn(60)
-		state.ScheduledFor = fmt.Sprintf("%sT%02d:%02d", today, hour, minute)
-		return sdk.Output{State: saveState(state)}, nil
+	// Shapes that the field types alone don't capture.
+	props["name"] = map[string]any{
+		"default": defaultArgs().Name,
+		"anyOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "minItems": 1},
+		},
+	}
+	props["window_preset"]["enum"] = sortedKeys(windowPresets)
+	props["weekday"]["enum"] = weekdays
+	props["days"]["items"] = map[string]any{"type": "string", "enum": weekdays}
+	props["days"]["minItems"] = 1
+	props["formats"]["items"] = map[string]any{"type": "string", "enum": renderFormats()}
+	props["postprocess"]["items"] = map[string]any{"type": "string", "enum": postProcessorNames()}
+	props["skip_dates"]["items"] = map[string]any{"type": "string", "format": "date"}
+	hour := map[string]any{"type": "integer", "minimum": 0, "maximum": 24}
+	props["slots"]["items"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":          map[string]any{"type": "string"},
+			"earliest_hour": hour,
+			"latest_hour":   hour,
+		},
+		"required": []string{"name", "earliest_hour", "latest_hour"},
+	}
+	props["monthly_nth_weekday"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"weekday": map[string]any{"type": "string", "enum": weekdays},
+			"n":       map[string]any{"type": "integer", "enum": []int{-1, 1, 2, 3, 4, 5}},
+		},
+		"required": []string{"weekday", "n"},
+	}
+	props["windows"]["propertyNames"] = map[string]any{"enum": weekdays}
+	props["recipient_pool"]["items"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":   map[string]any{"type": "string"},
+			"weight": map[string]any{"type": "integer", "minimum": 1},
+		},
+		"required": []string{"name", "weight"},
+	}
+	window := map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"earliest_hour": hour, "latest_hour": hour},
+	}
+	props["windows"]["additionalProperties"] = window
+	props["birthday_window"] = window
+	props["recurrences"]["items"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"rule":     map[string]any{"type": "string"},
+			"occasion": map[string]any{"type": "string"},
+			"message":  map[string]any{"type": "string"},
+			"window":   window,
+		},
+		"required": []string{"rule", "occasion"},
+	}
+	props["blackout_ranges"]["items"] = map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"start": hour, "end": hour},
+		"required":   []string{"start", "end"},
+	}
+	for _, l := range argLimits {
+		props[l.name]["minimum"] = l.min
+		if !math.IsInf(l.max, 1) {
+			props[l.name]["maximum"] = l.max
+		}
 	}
+	for _, e := range argEnums {
+		props[e.name]["enum"] = e.values
+	}
+
+	schema, _ := json.MarshalIndent(map[string]any{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      "goblin-starter arguments",
+		"type":       "object",
+		"properties": props,
+	}, "", "  ")
+	return schema
+}
 
-	// Send time chosen but not yet reached — keep waiting.
-	scheduledAt, err := time.Parse("2006-01-02T15:04", state.ScheduledFor)
+// ValidateArgs checks a blueprint's arguments, given as a JSON object, the
+// way run would, without scheduling anything. It returns the resolved
+// configuration (as data.config reports it) as indented JSON, or the error
+// run would fail with.
+func ValidateArgs(data []byte) ([]byte, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("read arguments: %w", err)
+	}
+	args, err := parseArgs(raw)
 	if err != nil {
-		return sdk.Output{}, fmt.Errorf("parse scheduled_for %q: %w", state.ScheduledFor, err)
+		return nil, fmt.Errorf("parse arguments: %w", err)
 	}
-	if now.UTC().Before(scheduledAt) {
-		return sdk.Output{State: saveState(state)}, nil
+	return json.MarshalIndent(args.resolvedConfig(), "", "  ")
+}
+
+// numericArgs maps the JSON names of goblinArgs' integer and float fields
+// to their kind.
+var numericArgs = func() map[string]reflect.Kind {
+	names := map[string]reflect.Kind{}
+	t := reflect.TypeOf(goblinArgs{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		kind := f.Type.Kind()
+		if kind == reflect.Pointer {
+			kind = f.Type.Elem().Kind()
+		}
+		if tag := f.Tag.Get("json"); tag != "" && (kind == reflect.Int || kind == reflect.Float64) {
+			names[strings.Split(tag, ",")[0]] = kind
+		}
 	}
+	return names
+}()
 
-	// Time to send.
-	return sdk.Output{
-		Data: map[string]any{
-			"name":        args.Name,
-			"time_of_day": timeOfDay(now.UTC().Hour()),
-		},
-		State:         saveState(goblinState{LastSentDate: today}),
-		ContinueToLLM: true,
-	}, nil
+// argAliases maps the old names of renamed arguments to the current ones.
+// parseArgs still accepts the old names, with a deprecation warning.
+var argAliases = map[string]string{
+	"start_hour": "earliest_hour",
+	"end_hour":   "latest_hour",
+}
+
+// resolveAliases returns a copy of raw with every aliased key renamed to its
+// current name, and a warning for each. When both names are set the current
+// one wins and the alias is dropped.
+func resolveAliases(raw map[string]any) (map[string]any, []string) {
+	out := make(map[string]any, len(raw))
+	for k, v := range raw {
+		out[k] = v
+	}
+	var warnings []string
+	for _, name := range sortedKeys(argAliases) {
+		v, ok := out[name]
+		if !ok {
+			continue
+		}
+		current := argAliases[name]
+		delete(out, name)
+		if _, ok := out[current]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s is deprecated and ignored because %s is set", name, current))
+			continue
+		}
+		out[current] = v
+		warnings = append(warnings, fmt.Sprintf("%s is deprecated; use %s", name, current))
+	}
+	return out, warnings
+}
+
+// coerceNumbers returns a copy of raw in which numeric arguments supplied as
+// numeric strings (e.g. "9" or "0.5", as some blueprint tooling writes them)
+// are converted to numbers. Non-numeric strings are an error rather than
+// being silently replaced by the default.
+func coerceNumbers(raw map[string]any) (map[string]any, error) {
+	out := make(map[string]any, len(raw))
+	for k, v := range raw {
+		out[k] = v
+	}
+	for _, name := range sortedKeys(numericArgs) {
+		str, ok := out[name].(string)
+		if !ok {
+			continue
+		}
+		str = strings.TrimSpace(str)
+		if numericArgs[name] == reflect.Float64 {
+			f, err := strconv.ParseFloat(str, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("%s: %q is not a number", name, str)
+			}
+			out[name] = f
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an integer", name, str)
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+// resolvedConfig echoes the arguments as parseArgs resolved them, defaults
+// filled in and values normalised, plus the effective window and locale, so
+// operators can confirm how a blueprint was read.
+func (a goblinArgs) resolvedConfig() map[string]any {
+	data, _ := json.Marshal(a)
+	var config map[string]any
+	_ = json.Unmarshal(data, &config)
+	if a.Names != nil {
+		config["name"] = a.Names
+	}
+	if a.seed == nil {
+		// An unset seed would read as 0, itself a valid seed.
+		delete(config, "seed")
+	}
+	config["locale"] = a.locale()
+	config["window"] = map[string]any{
+		"start": fmt.Sprintf("%02d:%02d", a.EarliestHour, a.EarliestMinute),
+		"end":   a.latestLabel(),
+	}
+	return config
+}
+
+// locale returns the language code for localised output: Locale when set,
+// otherwise Language.
+func (a goblinArgs) locale() string {
+	if a.Locale != "" {
+		return a.Locale
+	}
+	return a.Language
+}
+
+// occasion names the special occasion falling on date (YYYY-MM-DD), or "" on
+// an ordinary day. A 02-29 birthday moves to leap_day_fallback in years
+// without one.
+func (a goblinArgs) occasion(date string) string {
+	name, _, _ := a.occasionOn(date)
+	return name
+}
+
+// occasionOn returns the occasion date falls on, the message for it and the
+// window it overrides the day's with, if any: the birthday first, then
+// re-engagement after inactivity_days, then the first matching recurrence.
+// All are empty on an ordinary day.
+func (a goblinArgs) occasionOn(date string) (name, message string, window *windowOverride) {
+	if len(date) != len("2006-01-02") {
+		return "", "", nil
+	}
+	if a.Birthday != "" {
+		if year, err := strconv.Atoi(date[:4]); err == nil && date[5:] == monthDayIn(a.Birthday, year, a.LeapDayFallback) {
+			return "birthday", a.BirthdayMessage, a.BirthdayWindow
+		}
+	}
+	if a.InactivityDays > 0 {
+		if idle, err := daysBetween(a.LastActivityDate, date); err == nil && idle > a.InactivityDays {
+			return "reengagement", a.ReengagementMessage, nil
+		}
+	}
+	for _, r := range a.Recurrences {
+		if r.matches(date, a.LeapDayFallback) {
+			if r.Message == "" {
+				return r.Occasion, defaultMessage, r.Window
+			}
+			return r.Occasion, r.Message, r.Window
+		}
+	}
+	return "", "", nil
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// parseMonthDay checks that s is an MM-DD date, for birthday and yearly
+// recurrences. It is parsed against a leap year so 02-29 is accepted.
+func parseMonthDay(s string) error {
+	if _, err := time.Parse("2006-01-02", "2000-"+s); err != nil || len(s) != len("01-02") {
+		return fmt.Errorf("%q is not an MM-DD date", s)
+	}
+	return nil
+}
+
+// monthDayIn returns the MM-DD a yearly date md falls on in year: md itself,
+// except that 02-29 moves to leapDayFallback ("feb28" or "mar1") in years
+// without one.
+func monthDayIn(md string, year int, leapDayFallback string) string {
+	if md == "02-29" && !isLeapYear(year) {
+		return map[string]string{"feb28": "02-28", "mar1": "03-01"}[leapDayFallback]
+	}
+	return md
+}
+
+// recipients returns everyone greeted by a send: Names when name was a
+// list, otherwise just Name.
+func (a goblinArgs) recipients() []string {
+	if a.Names != nil {
+		return a.Names
+	}
+	return []string{a.Name}
+}
+
+// recipientList is recipients as recorded in state.last_sent_name.
+func (a goblinArgs) recipientList() string {
+	return strings.Join(a.recipients(), ", ")
+}
+
+// validateWindow checks that the window opens before it closes, is at least
+// min_window_minutes wide, and has some time left over once the blackout
+// ranges are taken out. A blackout reaching past the window only covers the
+// part inside it.
+func (a goblinArgs) validateWindow() error {
+	if a.LatestHour == 24 && a.LatestMinute != nil {
+		return fmt.Errorf("latest_minute cannot be set when latest_hour is 24 (midnight)")
+	}
+	start, end := a.window()
+	if a.latestMoment() <= start {
+		return fmt.Errorf(
+			"window end (%s) must be after window start (%02d:%02d)",
+			a.latestLabel(), a.EarliestHour, a.EarliestMinute,
+		)
+	}
+	if end-start < a.MinWindowMinutes {
+		return fmt.Errorf(
+			"send window is %d minutes wide, narrower than min_window_minutes (%d)",
+			end-start, a.MinWindowMinutes,
+		)
+	}
+	if a.openMinutes() == 0 {
+		return fmt.Errorf("blackout_ranges cover the whole send window")
+	}
+	if a.MinuteGranularity > 1 && a.gridOpenMinutes() == 0 {
+		return fmt.Errorf("send window has no open minute that is a multiple of minute_granularity (%d)", a.MinuteGranularity)
+	}
+	return nil
+}
+
+// grid returns the first minute of the window that is a multiple of
+// minute_granularity, and how many such minutes the window holds.
+func (a goblinArgs) grid() (first, n int) {
+	start, end := a.window()
+	g := max(a.MinuteGranularity, 1)
+	first = (start + g - 1) / g * g
+	if first >= end {
+		return first, 0
+	}
+	return first, (end - first + g - 1) / g
+}
+
+// gridOpenMinutes counts the window's grid minutes outside the blackout
+// ranges.
+func (a goblinArgs) gridOpenMinutes() int {
+	first, n := a.grid()
+	open := 0
+	for i := 0; i < n; i++ {
+		if !a.blackedOut(first + i*max(a.MinuteGranularity, 1)) {
+			open++
+		}
+	}
+	return open
+}
+
+// forWeekday returns a with the window replaced by the windows override for
+// the named weekday, if there is one. An overridden bound is a whole hour.
+func (a goblinArgs) forWeekday(name string) goblinArgs {
+	w, ok := a.Windows[name]
+	if !ok {
+		return a
+	}
+	return a.withOverride(w)
+}
+
+// withOverride returns a with the bounds w sets replacing its own.
+func (a goblinArgs) withOverride(w windowOverride) goblinArgs {
+	if w.EarliestHour != nil {
+		a.EarliestHour, a.EarliestMinute = *w.EarliestHour, 0
+	}
+	if w.LatestHour != nil {
+		a.LatestHour, a.LatestMinute = *w.LatestHour, nil
+	}
+	return a
+}
+
+// anchoredTo returns a with the window replaced by the anchored one for
+// day's local date, when anchor is set. If the sun doesn't rise or set there
+// that day, the event lands outside the local day, or blackouts cover the
+// whole anchored window, a keeps its fixed window and gains a warning.
+func (a goblinArgs) anchoredTo(day time.Time) goblinArgs {
+	if a.Anchor == "" {
+		return a
+	}
+	local := day.In(a.location())
+	date := local.Format("2006-01-02")
+	event, ok := solarEvent(local, *a.Latitude, *a.Longitude, a.Anchor == "sunrise")
+	if ok {
+		event = event.In(a.location())
+		ok = event.Format("2006-01-02") == date
+	}
+	if !ok {
+		a.warnings = append(a.warnings, fmt.Sprintf("anchor: no %s on %s at %v, %v; using the fixed window", a.Anchor, date, *a.Latitude, *a.Longitude))
+		return a
+	}
+	start := event.Hour()*60 + event.Minute()
+	end := min(start+a.AnchorWindowMinutes, 24*60)
+	anchored := a
+	anchored.Windows = nil
+	anchored.EarliestHour, anchored.EarliestMinute = start/60, start%60
+	anchored.LatestHour, anchored.LatestMinute = end/60, nil
+	if end%60 != 0 {
+		latest := end%60 - 1 // latest_minute is inclusive
+		anchored.LatestMinute = &latest
+	}
+	if anchored.openMinutes() == 0 {
+		a.warnings = append(a.warnings, fmt.Sprintf("anchor: blackout_ranges cover the window after %s on %s; using the fixed window", a.Anchor, date))
+		return a
+	}
+	return anchored
+}
+
+// windowOn returns a with the window that applies on day's local date: the
+// anchored window when anchor is set, then any windows override for that
+// weekday, then the window of an occasion falling on it.
+func (a goblinArgs) windowOn(day time.Time) goblinArgs {
+	local := day.In(a.location())
+	a = a.anchoredTo(local).forWeekday(weekdayKey(local.Weekday()))
+	if _, _, w := a.occasionOn(local.Format("2006-01-02")); w != nil {
+		a = a.withOverride(*w)
+	}
+	return a
+}
+
+// EffectiveWindow returns the send window that applies on day's local date,
+// with presets, the anchor, per-weekday and occasion windows and blackouts at
+// either edge all resolved, as instants in args' timezone. earliest is the
+// first moment a send can be picked and latest is one past the last. A
+// fixed_time doesn't draw from the window, so it is not reflected here. It
+// returns an error if blackouts leave nothing of the window open.
+func EffectiveWindow(args goblinArgs, day time.Time) (earliest, latest time.Time, err error) {
+	w := args.windowOn(day)
+	start, end := w.window()
+	for start < end && w.blackedOut(start) {
+		start++
+	}
+	for end > start && w.blackedOut(end-1) {
+		end--
+	}
+	if start >= end {
+		return time.Time{}, time.Time{}, fmt.Errorf("no open minutes in the send window on %s", day.In(args.location()).Format("2006-01-02"))
+	}
+	y, m, d := day.In(args.location()).Date()
+	at := func(minute int) time.Time {
+		return time.Date(y, m, d, minute/60, minute%60, 0, 0, args.location())
+	}
+	return at(start), at(end), nil
+}
+
+// fixedMinute returns fixed_time as minutes after local midnight.
+func (a goblinArgs) fixedMinute() int {
+	t, _ := time.Parse("15:04", a.FixedTime)
+	return t.Hour()*60 + t.Minute()
+}
+
+// forSlot returns a with the window replaced by slot's.
+func (a goblinArgs) forSlot(slot sendSlot) goblinArgs {
+	a.EarliestHour, a.EarliestMinute = slot.EarliestHour, 0
+	a.LatestHour, a.LatestMinute = slot.LatestHour, nil
+	a.Windows = nil
+	a.FixedTime = ""
+	return a
+}
+
+// window returns the send window as minutes after local midnight: start is
+// the first minute that can be picked and end is one past the last.
+func (a goblinArgs) window() (start, end int) {
+	start = a.EarliestHour*60 + a.EarliestMinute
+	end = a.latestMoment()
+	if a.LatestMinute != nil {
+		end++ // an explicit latest_minute is inclusive
+	}
+	return start, end
+}
+
+// blackedOut reports whether minute (after local midnight) falls inside one
+// of the blackout ranges.
+func (a goblinArgs) blackedOut(minute int) bool {
+	for _, r := range a.BlackoutRanges {
+		if minute >= r.Start*60 && minute < r.End*60 {
+			return true
+		}
+	}
+	return false
+}
+
+// openMinutes counts the window's minutes that no blackout range covers.
+func (a goblinArgs) openMinutes() int {
+	start, end := a.window()
+	n := 0
+	for m := start; m < end; m++ {
+		if !a.blackedOut(m) {
+			n++
+		}
+	}
+	return n
+}
+
+// latestMoment is the window's closing bound in minutes after midnight:
+// inclusive when latest_minute is set, exclusive otherwise.
+func (a goblinArgs) latestMoment() int {
+	if a.LatestMinute != nil {
+		return a.LatestHour*60 + *a.LatestMinute
+	}
+	return a.LatestHour * 60
+}
+
+func (a goblinArgs) latestLabel() string {
+	if a.LatestMinute != nil {
+		return fmt.Sprintf("%02d:%02d", a.LatestHour, *a.LatestMinute)
+	}
+	return fmt.Sprintf("%02d:00", a.LatestHour)
+}
+
+// scheduleFingerprint hashes everything that decides when the salutation may
+// go out — the zone, the windows, the cadence and the day filters — so
+// downstream caches can tell when scheduling semantics change. Day lists are
+// sorted first, so listing the same days in another order doesn't change it.
+func (a goblinArgs) scheduleFingerprint() string {
+	start, end := a.window()
+	days := append([]string(nil), a.Days...)
+	sort.Strings(days)
+	skipDates := append([]string(nil), a.SkipDates...)
+	sort.Strings(skipDates)
+	weekday := ""
+	if a.Cadence == "weekly" {
+		weekday = a.Weekday
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s|%d-%d|%s|%s|%s|%s",
+		a.Timezone, start, end, a.Cadence, weekday,
+		strings.Join(days, ","), strings.Join(skipDates, ","))
+	for _, name := range sortedKeys(a.Windows) {
+		start, end := a.forWeekday(name).window()
+		fmt.Fprintf(h, "|%s:%d-%d", name, start, end)
+	}
+	if a.FixedTime != "" {
+		fmt.Fprintf(h, "|at %s", a.FixedTime)
+		if a.JitterMinutes > 0 {
+			fmt.Fprintf(h, "~%d", a.JitterMinutes)
+		}
+	} else if a.MinuteGranularity > 1 {
+		fmt.Fprintf(h, "|/%d", a.MinuteGranularity)
+	}
+	if a.Anchor != "" {
+		fmt.Fprintf(h, "|%s+%d@%v,%v", a.Anchor, a.AnchorWindowMinutes, *a.Latitude, *a.Longitude)
+	}
+	if m := a.MonthlyNthWeekday; m != nil {
+		fmt.Fprintf(h, "|%d %s", m.N, m.Weekday)
+	}
+	if a.SendsPerDay > 1 {
+		for _, slot := range a.Slots {
+			fmt.Fprintf(h, "|%s@%d-%d", slot.Name, slot.EarliestHour, slot.LatestHour)
+		}
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// skipped reports whether date (YYYY-MM-DD) is listed in skip_dates.
+func (a goblinArgs) skipped(date string) bool {
+	for _, d := range a.SkipDates {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// nextEligibleDay returns the first date (YYYY-MM-DD) on or after day that the
+// days filter allows and skip_dates doesn't exclude.
+func (a goblinArgs) nextEligibleDay(day time.Time) string {
+	// Every week has an allowed weekday, so this bound is only reached if
+	// skip_dates blanks out every allowed day for a year.
+	for i := 0; i < 366; i++ {
+		d := day.AddDate(0, 0, i)
+		if date := d.Format("2006-01-02"); a.dayAllowed(d) && !a.skipped(date) {
+			return date
+		}
+	}
+	return day.Format("2006-01-02")
+}
+
+// missedDays lists the dates (YYYY-MM-DD) strictly between the last send and
+// today that the days filter allows and skip_dates doesn't exclude — the
+// days that went without a salutation.
+func (a goblinArgs) missedDays(lastSent, today string) []string {
+	from, err := time.Parse("2006-01-02", lastSent)
+	if err != nil {
+		return nil
+	}
+	var missed []string
+	for d := from.AddDate(0, 0, 1); d.Format("2006-01-02") < today; d = d.AddDate(0, 0, 1) {
+		if date := d.Format("2006-01-02"); a.dayAllowed(d) && !a.skipped(date) {
+			missed = append(missed, date)
+		}
+	}
+	return missed
+}
+
+// windowPresets maps each window_preset to its earliest and latest hour.
+var windowPresets = map[string][2]int{
+	"business_hours": {9, 17},
+	"daytime":        {8, 20},
+	"evening":        {17, 22},
+	"anytime":        {0, 24},
+}
+
+// PostProcessor transforms the data of a send into the data output. It sees
+// only the data, never the state, and returns the map to use in its place.
+type PostProcessor func(data map[string]any) map[string]any
+
+// postProcessors holds the PostProcessors that postprocess can name.
+var postProcessors = map[string]PostProcessor{
+	// uppercase_name shouts the recipient's name, in messages too.
+	"uppercase_name": func(data map[string]any) map[string]any {
+		out := maps.Clone(data)
+		if name, ok := out["name"].(string); ok {
+			out["name"] = strings.ToUpper(name)
+		}
+		if messages, ok := out["messages"].([]map[string]any); ok {
+			upper := make([]map[string]any, len(messages))
+			for i, m := range messages {
+				upper[i] = maps.Clone(m)
+				if name, ok := m["name"].(string); ok {
+					upper[i]["name"] = strings.ToUpper(name)
+				}
+			}
+			out["messages"] = upper
+		}
+		return out
+	},
+}
+
+// postProcessorNames lists the names in postProcessors, sorted.
+func postProcessorNames() []string {
+	return sortedKeys(postProcessors)
+}
+
+// weekdayNames maps each accepted spelling of a weekday to its canonical
+// three-letter name.
+var weekdayNames = map[string]string{
+	"sun": "sun", "sunday": "sun",
+	"mon": "mon", "monday": "mon",
+	"tue": "tue", "tuesday": "tue",
+	"wed": "wed", "wednesday": "wed",
+	"thu": "thu", "thursday": "thu",
+	"fri": "fri", "friday": "fri",
+	"sat": "sat", "saturday": "sat",
+}
+
+func normaliseDays(raw []string) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("days must list at least one weekday")
+	}
+	days := make([]string, 0, len(raw))
+	for _, d := range raw {
+		name, ok := weekdayNames[strings.ToLower(strings.TrimSpace(d))]
+		if !ok {
+			return nil, fmt.Errorf("days: unrecognised weekday %q", d)
+		}
+		days = append(days, name)
+	}
+	return days, nil
+}
+
+// weekdayKey returns the canonical three-letter name of wd, as used by days,
+// weekday and windows.
+func weekdayKey(wd time.Weekday) string {
+	return strings.ToLower(wd.String()[:3])
+}
+
+// dayAllowed reports whether the salutation may be sent on day, judging by
+// its weekday and, with monthly_nth_weekday, its place in the month.
+func (a goblinArgs) dayAllowed(day time.Time) bool {
+	name := weekdayKey(day.Weekday())
+	if a.Cadence == "weekly" && name != a.Weekday && !a.shiftedWeekly(day) {
+		return false
+	}
+	if m := a.MonthlyNthWeekday; m != nil && !m.matches(day) {
+		return false
+	}
+	return a.inDays(name)
+}
+
+// inDays reports whether the days filter allows the named weekday.
+func (a goblinArgs) inDays(name string) bool {
+	return len(a.Days) == 0 || slices.Contains(a.Days, name)
+}
+
+// shiftedWeekly reports whether shift_to_next_allowed moves the weekly send
+// to day: the weekday is excluded by days, and no day between its most
+// recent occurrence and day is allowed.
+func (a goblinArgs) shiftedWeekly(day time.Time) bool {
+	if !a.ShiftToNextAllowed || a.inDays(a.Weekday) {
+		return false
+	}
+	for i := 1; i < 7; i++ {
+		name := weekdayKey(day.AddDate(0, 0, -i).Weekday())
+		if name == a.Weekday {
+			return true
+		}
+		if a.inDays(name) {
+			return false
+		}
+	}
+	return false
+}
+
+// ── State ─────────────────────────────────────────────────────────────────────
+
+// stateVersion is the current goblinState schema version. Bump it, and add
+// a step to migrateState, whenever the shape or format of a field changes.
+const stateVersion = 1
+
+// goblinState tracks what the goblin has sent and when it plans to send next.
+type goblinState struct {
+	// Version is the schema version the state was written with. State from
+	// before versioning has none and is treated as version 0.
+	Version int `json:"version,omitempty"`
+
+	// CreatedDate is the local date (YYYY-MM-DD) of the goblin's first run
+	// that saved state — or, for state from before it was kept, the first
+	// such run since. Once set it is never changed.
+	CreatedDate string `json:"created_date,omitempty"`
+
+	// LastSentDate is the local date (YYYY-MM-DD) of the most recent salutation.
+	// Empty on first run.
+	LastSentDate string `json:"last_sent_date,omitempty"`
+
+	// LastSentAt is the RFC 3339 instant of the most recent salutation.
+	LastSentAt string `json:"last_sent_at,omitempty"`
+
+	// ScheduledFor is the local datetime (YYYY-MM-DDTHH:MM) the goblin has chosen
+	// to send today's salutation, or the same moment as RFC 3339 under
+	// time_format "rfc3339". Repicked at the start of each new day.
+	ScheduledFor string `json:"scheduled_for,omitempty"`
+
+	// Lock records which worker last processed this state, and when. Only
+	// used when the lock_token argument is set.
+	Lock *stateLock `json:"lock,omitempty"`
+
+	// Streak counts consecutive calendar days on which the salutation was
+	// sent, including the most recent send.
+	Streak int `json:"streak,omitempty"`
+
+	// MessageIndex is the position in the messages argument of the template
+	// to use on the next send. Wraps round when the list is exhausted.
+	MessageIndex int `json:"message_index,omitempty"`
+
+	// SilentDate is the local date (YYYY-MM-DD) a send_probability roll
+	// chose to stay silent on.
+	SilentDate string `json:"silent_date,omitempty"`
+
+	// PendingEvents counts events accumulated towards trigger_count since
+	// the last send.
+	PendingEvents int `json:"pending_events,omitempty"`
+
+	// History records recent sends, oldest first, capped at history_limit.
+	History []historyEntry `json:"history,omitempty"`
+
+	// PendingSendAt is the RFC 3339 instant of a send still awaiting
+	// confirmation under confirm_delivery.
+	PendingSendAt string `json:"pending_send_at,omitempty"`
+
+	// DeliveryAttempts counts how many times the pending send has been
+	// emitted.
+	DeliveryAttempts int `json:"delivery_attempts,omitempty"`
+
+	// DeliveryConfirmed is set by the delivery step, not the goblin, once the
+	// pending send has been delivered.
+	DeliveryConfirmed bool `json:"delivery_confirmed,omitempty"`
+
+	// LastSentName is the recipient (or list of recipients, comma-separated)
+	// the most recent salutation was addressed to.
+	LastSentName string `json:"last_sent_name,omitempty"`
+
+	// SlotDate is the local date (YYYY-MM-DD) SentSlots and SlotSchedules
+	// refer to, under sends_per_day 2. Both start afresh on a new day.
+	SlotDate string `json:"slot_date,omitempty"`
+
+	// SentSlots names the slots that have fired on SlotDate.
+	SentSlots []string `json:"sent_slots,omitempty"`
+
+	// SlotSchedules holds each slot's chosen send time (YYYY-MM-DDTHH:MM) on
+	// SlotDate, keyed by slot name.
+	SlotSchedules map[string]string `json:"slot_schedules,omitempty"`
+
+	// Metrics counts every run's outcome since the state was created.
+	Metrics *runMetrics `json:"metrics,omitempty"`
+
+	// Completed is set once the single send of once has gone out. From then
+	// on every run skips as completed.
+	Completed bool `json:"completed,omitempty"`
+
+	// ResumePending is set, under resume_greeting, while a snooze or expiry
+	// holds sends back, and cleared by the next send — the resume greeting.
+	ResumePending bool `json:"resume_pending,omitempty"`
+
+	// Name is the recipient's name as established outside the arguments (by
+	// an onboarding step, say). It is used when the name argument is absent
+	// or blank, and sanitised the same way.
+	Name string `json:"name,omitempty"`
+
+	// BatchDate is the local date (YYYY-MM-DD) BatchSent refers to, under
+	// batch_size. Both are cleared once the day's last batch goes out.
+	BatchDate string `json:"batch_date,omitempty"`
+
+	// BatchSent lists the recipients already greeted on BatchDate.
+	BatchSent []string `json:"batch_sent,omitempty"`
+
+	// PoolDate is the local date (YYYY-MM-DD) PoolChoice was drawn for,
+	// under selection "one_weighted".
+	PoolDate string `json:"pool_date,omitempty"`
+
+	// PoolChoice is the recipient drawn from recipient_pool for PoolDate.
+	PoolChoice string `json:"pool_choice,omitempty"`
+
+	// CapMonth is the local month (YYYY-MM) MonthSends counts, under
+	// monthly_cap.
+	CapMonth string `json:"cap_month,omitempty"`
+
+	// MonthSends counts the sends made in CapMonth.
+	MonthSends int `json:"month_sends,omitempty"`
+
+	// Digest records each day a run has seen since the last send, under
+	// digest, for the next send's data.digest.
+	Digest []digestDay `json:"digest,omitempty"`
+
+	// SnoozeUntil pauses the goblin until this local date (YYYY-MM-DD),
+	// exclusive. Users set it in state; a malformed value is ignored.
+	SnoozeUntil string `json:"snooze_until,omitempty"`
+
+	// warnings notes fields parseState had to discard. run reports them in
+	// data.warnings; they are never saved.
+	warnings []string
+}
+
+// runMetrics are the cumulative counters in state.metrics, echoed in
+// data.metrics on every run.
+type runMetrics struct {
+	Sends int `json:"sends"`
+	Skips int `json:"skips"` // every run that didn't send
+	// Missed counts the skips that gave up on a day (status "missed").
+	Missed int `json:"missed"`
+}
+
+// record returns m with a run of the given status counted. m itself is left
+// untouched, since copies of a state share it.
+func (m *runMetrics) record(status string) *runMetrics {
+	next := runMetrics{}
+	if m != nil {
+		next = *m
+	}
+	switch status {
+	case "sent":
+		next.Sends++
+	case "missed":
+		next.Skips++
+		next.Missed++
+	default:
+		next.Skips++
+	}
+	return &next
+}
+
+// historyEntry is one send recorded in state.history.
+type historyEntry struct {
+	Date      string `json:"date"`
+	TimeOfDay string `json:"time_of_day"`
+}
+
+// sentThisMonth returns how many sends s counts for today's month, which is
+// none once the month has changed.
+func (s goblinState) sentThisMonth(today string) int {
+	if s.CapMonth != today[:7] {
+		return 0
+	}
+	return s.MonthSends
+}
+
+// digestDay is one day recorded in state.digest.
+type digestDay struct {
+	Date      string `json:"date"`
+	TimeOfDay string `json:"time_of_day"`
+	WouldSend bool   `json:"would_send"`
+}
+
+// digestDays is how far back data.digest reaches, today included.
+const digestDays = 7
+
+// recordDigest returns days with an entry for day added if it has none yet,
+// dropping entries older than digestDays. A day's time_of_day comes from its
+// schedule when one is picked for it, and otherwise from a pick seeded by the
+// date alone, so the label doesn't depend on which run sees the day first.
+func (a goblinArgs) recordDigest(days []digestDay, day time.Time, scheduledFor string) ([]digestDay, error) {
+	date := day.Format("2006-01-02")
+	cutoff := day.AddDate(0, 0, -digestDays+1).Format("2006-01-02")
+	kept := make([]digestDay, 0, len(days)+1)
+	for _, d := range days {
+		if d.Date >= cutoff && d.Date != date {
+			kept = append(kept, d)
+		}
+	}
+	for _, d := range days {
+		if d.Date == date {
+			return append(kept, d), nil
+		}
+	}
+	daily := a
+	daily.Cadence = "daily"
+	if !strings.HasPrefix(scheduledFor, date) {
+		h := fnv.New64a()
+		h.Write([]byte(date))
+		picked, err := pickSchedule(daily, date, rand.New(rand.NewSource(int64(h.Sum64()))).Intn)
+		if err != nil {
+			return nil, err
+		}
+		scheduledFor = picked
+	}
+	wall, err := parseWallClock(scheduledFor)
+	if err != nil {
+		return nil, err
+	}
+	return append(kept, digestDay{
+		Date:      date,
+		TimeOfDay: describeTimeOfDay(wall.Hour(), a.boundaries(), a.locale()).Label,
+		WouldSend: daily.dayAllowed(day) && !daily.skipped(date),
+	}), nil
+}
+
+// stateLock guards against two workers processing the same state at once.
+type stateLock struct {
+	Token string `json:"token"`
+
+	// AcquiredAt is the RFC 3339 instant the lock was taken.
+	AcquiredAt string `json:"acquired_at"`
+}
+
+// heldByOther reports whether l is a live lock belonging to a worker other
+// than token. Locks that are stale or unreadable are treated as released.
+func (l *stateLock) heldByOther(token string, now time.Time, ttl time.Duration) bool {
+	if l == nil || l.Token == token {
+		return false
+	}
+	acquired, err := time.Parse(time.RFC3339, l.AcquiredAt)
+	if err != nil {
+		return false
+	}
+	return now.Sub(acquired) < ttl
+}
+
+func parseState(raw map[string]any) (goblinState, error) {
+	raw, err := expandState(raw)
+	if err != nil {
+		return goblinState{}, err
+	}
+	s, err := decodeState(raw)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// A field of the wrong type (a numeric scheduled_for, say) would
+		// otherwise fail every run until fixed by hand. Drop each such
+		// field, falling back to its default, and carry on.
+		s, err = decodeStateLeniently(raw)
+	}
+	if err != nil {
+		return goblinState{}, err
+	}
+	return migrateState(s)
+}
+
+// decodeState decodes raw into a goblinState as is, failing on any field of
+// the wrong type.
+func decodeState(raw map[string]any) (goblinState, error) {
+	var s goblinState
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return goblinState{}, fmt.Errorf("marshal state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return goblinState{}, fmt.Errorf("unmarshal state: %w", err)
+	}
+	return s, nil
+}
+
+// decodeStateLeniently decodes raw field by field, discarding the fields whose
+// values don't fit their type and noting each in the state's warnings.
+func decodeStateLeniently(raw map[string]any) (goblinState, error) {
+	kept := make(map[string]any, len(raw))
+	var warnings []string
+	for _, k := range sortedKeys(raw) {
+		field, err := json.Marshal(map[string]any{k: raw[k]})
+		if err != nil {
+			return goblinState{}, fmt.Errorf("marshal state: %w", err)
+		}
+		if err := json.Unmarshal(field, &goblinState{}); err != nil {
+			value, _ := json.Marshal(raw[k])
+			warnings = append(warnings, fmt.Sprintf("state.%s: discarded unreadable value %s", k, value))
+			continue
+		}
+		kept[k] = raw[k]
+	}
+
+	s, err := decodeState(kept)
+	if err != nil {
+		return goblinState{}, err
+	}
+	s.warnings = warnings
+	return s, nil
+}
+
+// migrateState upgrades state written by an older version of the goblin to
+// stateVersion, one version at a time. State from a newer version is an
+// error: its fields may mean something this version doesn't understand.
+func migrateState(s goblinState) (goblinState, error) {
+	if s.Version < 0 || s.Version > stateVersion {
+		return goblinState{}, fmt.Errorf(
+			"state version %d is not supported (this goblin reads up to version %d)", s.Version, stateVersion,
+		)
+	}
+	if s.Version == 0 {
+		// Unversioned state could carry full timestamps where dates and
+		// minutes are now stored, and predates the streak counter. The
+		// oldest has no scheduled_for at all, which needs no filling in:
+		// it reads as no send time picked yet, so the next run picks one.
+		if len(s.LastSentDate) > len("2006-01-02") {
+			s.LastSentDate = s.LastSentDate[:len("2006-01-02")]
+		}
+		if len(s.ScheduledFor) > len("2006-01-02T15:04") {
+			s.ScheduledFor = s.ScheduledFor[:len("2006-01-02T15:04")]
+		}
+		if s.LastSentDate != "" && s.Streak == 0 {
+			s.Streak = 1
+		}
+		s.Version = 1
+	}
+	return s, nil
+}
+
+// MergeState applies patch on top of current and returns the result. Only
+// keys naming goblinState fields are applied — anything else is ignored — and
+// a null value clears the field. The merged state is validated, so a patch
+// can't leave malformed dates or negative counters behind.
+func MergeState(current goblinState, patch map[string]any) (goblinState, error) {
+	merged := saveState(current)
+	if merged == nil {
+		merged = map[string]any{}
+	}
+	for _, name := range stateFields {
+		v, ok := patch[name]
+		switch {
+		case !ok:
+		case v == nil:
+			delete(merged, name)
+		default:
+			merged[name] = v
+		}
+	}
+	// Unlike stored state, a patch is written on purpose, so a field of the
+	// wrong type is an error rather than quietly dropped.
+	s, err := decodeState(merged)
+	if err != nil {
+		return goblinState{}, err
+	}
+	if s, err = migrateState(s); err != nil {
+		return goblinState{}, err
+	}
+	if err := s.validate(); err != nil {
+		return goblinState{}, err
+	}
+	return s, nil
+}
+
+// stateFields lists the JSON names of goblinState's fields.
+var stateFields = func() []string {
+	var names []string
+	t := reflect.TypeOf(goblinState{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" {
+			names = append(names, strings.Split(tag, ",")[0])
+		}
+	}
+	return names
+}()
+
+// validate checks that the state's fields are well-formed.
+func (s goblinState) validate() error {
+	if s.CreatedDate != "" {
+		if _, err := time.Parse("2006-01-02", s.CreatedDate); err != nil {
+			return fmt.Errorf("created_date %q is not a YYYY-MM-DD date", s.CreatedDate)
+		}
+	}
+	if s.LastSentDate != "" {
+		if _, err := time.Parse("2006-01-02", s.LastSentDate); err != nil {
+			return fmt.Errorf("last_sent_date %q is not a YYYY-MM-DD date", s.LastSentDate)
+		}
+	}
+	if s.LastSentAt != "" {
+		if _, err := time.Parse(time.RFC3339, s.LastSentAt); err != nil {
+			return fmt.Errorf("last_sent_at %q is not an RFC 3339 time", s.LastSentAt)
+		}
+	}
+	if s.ScheduledFor != "" {
+		_, compactErr := parseWallClock(s.ScheduledFor)
+		if _, err := time.Parse(time.RFC3339, s.ScheduledFor); err != nil && compactErr != nil {
+			return fmt.Errorf("scheduled_for %q is not a YYYY-MM-DDTHH:MM or RFC 3339 time", s.ScheduledFor)
+		}
+	}
+	if s.SilentDate != "" {
+		if _, err := time.Parse("2006-01-02", s.SilentDate); err != nil {
+			return fmt.Errorf("silent_date %q is not a YYYY-MM-DD date", s.SilentDate)
+		}
+	}
+	if s.SnoozeUntil != "" {
+		if _, err := time.Parse("2006-01-02", s.SnoozeUntil); err != nil {
+			return fmt.Errorf("snooze_until %q is not a YYYY-MM-DD date", s.SnoozeUntil)
+		}
+	}
+	if s.Streak < 0 {
+		return fmt.Errorf("streak (%d) must not be negative", s.Streak)
+	}
+	if s.MessageIndex < 0 {
+		return fmt.Errorf("message_index (%d) must not be negative", s.MessageIndex)
+	}
+	if s.PendingEvents < 0 {
+		return fmt.Errorf("pending_events (%d) must not be negative", s.PendingEvents)
+	}
+	if m := s.Metrics; m != nil && (m.Sends < 0 || m.Skips < 0 || m.Missed < 0) {
+		return fmt.Errorf("metrics (%+v) must not be negative", *m)
+	}
+	for _, h := range s.History {
+		if _, err := time.Parse("2006-01-02", h.Date); err != nil {
+			return fmt.Errorf("history: %q is not a YYYY-MM-DD date", h.Date)
+		}
+	}
+	return nil
+}
+
+func saveState(s goblinState) map[string]any {
+	s.Version = stateVersion
+	data, _ := json.Marshal(s)
+	var m map[string]any
+	_ = json.Unmarshal(data, &m)
+	pruneEmpty(m)
+	return m
+}
+
+// pruneEmpty deletes the keys of m, at any depth, whose values are zero — 0,
+// "", false or null — or collections left empty, since parseState reads an
+// absent field as its zero value anyway. omitempty only covers the top
+// level; this catches nested counters like metrics.missed too. List elements
+// are pruned but kept, as their positions count.
+func pruneEmpty(m map[string]any) {
+	for k, v := range m {
+		if isEmptyValue(v) {
+			delete(m, k)
+		}
+	}
+}
+
+// isEmptyValue prunes v's contents, and reports whether what's left is
+// empty.
+func isEmptyValue(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []any:
+		for _, e := range v {
+			if m, ok := e.(map[string]any); ok {
+				pruneEmpty(m)
+			}
+		}
+		return len(v) == 0
+	case map[string]any:
+		pruneEmpty(v)
+		return len(v) == 0
+	}
+	return false
+}
+
+// compactStateKey holds the whole state in compact_state's encoding.
+const compactStateKey = "_c"
+
+// compactState packs a saved state into compact_state's encoding: the JSON
+// gzipped and base64-encoded under compactStateKey.
+func compactState(m map[string]any) map[string]any {
+	data, _ := json.Marshal(m)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(data)
+	zw.Close()
+	return map[string]any{compactStateKey: base64.StdEncoding.EncodeToString(b.Bytes())}
+}
+
+// expandState unpacks a state saved with compact_state, and returns any
+// other state as is. Keys stored beside the compact value (written by the
+// host, say) take precedence over those inside it.
+func expandState(raw map[string]any) (map[string]any, error) {
+	v, ok := raw[compactStateKey]
+	if !ok {
+		return raw, nil
+	}
+	encoded, _ := v.(string)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("state.%s: %w", compactStateKey, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("state.%s: %w", compactStateKey, err)
+	}
+	if data, err = io.ReadAll(zr); err != nil {
+		return nil, fmt.Errorf("state.%s: %w", compactStateKey, err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("state.%s: %w", compactStateKey, err)
+	}
+	if m == nil {
+		m = map[string]any{}
+	}
+	for k, v := range raw {
+		if k != compactStateKey {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+// ── Core logic ────────────────────────────────────────────────────────────────
+
+// Logger receives run's decision path: Debugf for the inputs it worked from,
+// Infof for the outcome and the schedule it resolved.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+}
+
+// nopLogger discards everything; run falls back to it when given no logger.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+
+// ErrorKind classifies the errors run returns, so a caller can tell a
+// problem for the user to fix from one worth retrying or alerting on.
+type ErrorKind string
+
+const (
+	// ConfigError means the arguments, state_patch included, are invalid.
+	ConfigError ErrorKind = "config"
+	// StateError means the incoming state can't be read.
+	StateError ErrorKind = "state"
+	// InternalError is anything else that went wrong during the run.
+	InternalError ErrorKind = "internal"
+)
+
+// RunError is the error run returns, with its Kind.
+type RunError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *RunError) Error() string { return e.Err.Error() }
+func (e *RunError) Unwrap() error { return e.Err }
+
+// KindOf returns the ErrorKind of an error from run, or InternalError for
+// any other error.
+func KindOf(err error) ErrorKind {
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		return runErr.Kind
+	}
+	return InternalError
+}
+
+// run is the goblin's business logic.
+//
+// It is separated from main so it can be unit-tested without WASM or the SDK.
+// Dependencies on the current time, randomness and logging are injected so
+// tests are fully deterministic; a nil log discards the log events.
+//
+// "Today" and all times below are evaluated in the configured timezone.
+//
+// Behaviour:
+//  1. If lock_token is set and another worker holds a live lock → skip.
+//  2. If the salutation has already been sent today → skip.
+//  3. If today is listed in skip_dates → skip, dropping any schedule for today.
+//  4. If today is not one of the allowed days → skip, dropping any pending
+//     schedule (unless repick_target is "next_eligible").
+//  5. If no send time has been chosen for today yet → pick one at random within
+//     the configured window, persist it, report the day's plan, and skip (will
+//     send when the time comes). With repick_target "next_eligible" the pick
+//     is for the first allowed day from today, and a pick for a later day is
+//     kept until then. A chosen time that the window as now configured no
+//     longer covers is picked again the same way.
+//  6. If the chosen send time has not yet arrived → skip.
+//  7. If the chosen send time passed more than max_delay_minutes ago → give up
+//     on today: mark it done without sending, and skip.
+//  8. If the chosen send time has arrived → send the salutation and reset state.
+func run(input sdk.Input, now time.Time, randIntn func(int) int, log Logger) (sdk.Output, error) {
+	if log == nil {
+		log = nopLogger{}
+	}
+	args, err := parseArgs(input.Arguments)
+	if err != nil {
+		return sdk.Output{}, &RunError{ConfigError, fmt.Errorf("parse arguments: %w", err)}
+	}
+
+	state, err := parseState(input.State)
+	if err != nil {
+		return sdk.Output{}, &RunError{StateError, fmt.Errorf("parse state: %w", err)}
+	}
+	if args.StatePatch != nil {
+		// state_patch is an argument, so a bad one is the blueprint's to fix.
+		if state, err = MergeState(state, args.StatePatch); err != nil {
+			return sdk.Output{}, &RunError{ConfigError, fmt.Errorf("apply state_patch: %w", err)}
+		}
+		log.Debugf("applied state_patch")
+	}
+	log.Debugf("state: last_sent_date %q, scheduled_for %q", state.LastSentDate, state.ScheduledFor)
+
+	// No name in the arguments — fall back to one kept in state before the
+	// default.
+	if given, _ := input.Arguments["name"].(string); strings.TrimSpace(given) == "" && args.Names == nil && state.Name != "" {
+		if args.Name, err = cleanName(state.Name, args.MaxNameLength); err != nil {
+			return sdk.Output{}, &RunError{StateError, fmt.Errorf("state: %w", err)}
+		}
+	}
+
+	// snooze_until is written by users; a malformed one is ignored (and
+	// dropped by evaluate) rather than failing every run.
+	if _, err := time.Parse("2006-01-02", state.SnoozeUntil); err != nil && state.SnoozeUntil != "" {
+		state.warnings = append(state.warnings, fmt.Sprintf("state.snooze_until %q is not a YYYY-MM-DD date; ignored", state.SnoozeUntil))
+	}
+
+	// A last_sent_date after today (clock skew, a hand edit) would never
+	// match today, leaving the streak and interval logic reasoning about a
+	// send that hasn't happened. Treat the goblin as never having sent.
+	if today := now.In(args.location()).Format("2006-01-02"); state.LastSentDate > today {
+		if _, err := time.Parse("2006-01-02", state.LastSentDate); err == nil {
+			msg := fmt.Sprintf("state.last_sent_date %s is after today (%s); reset", state.LastSentDate, today)
+			log.Infof("warning: %s", msg)
+			state.warnings = append(state.warnings, msg)
+			state.LastSentDate, state.LastSentAt = "", ""
+		}
+	}
+
+	// Count data.days_active from the day the goblin started, today if it
+	// hasn't yet. A malformed created_date is kept as found, since it is
+	// never overwritten.
+	date := now.In(args.location()).Format("2006-01-02")
+	created := state.CreatedDate
+	if created == "" {
+		created = date
+	}
+	daysActive, activeErr := daysBetween(created, date)
+	if activeErr != nil {
+		state.warnings = append(state.warnings, fmt.Sprintf("state.created_date %q is not a YYYY-MM-DD date; days_active omitted", state.CreatedDate))
+	}
+
+	// Fold anything a faulty random source returns outside [0,n) back into
+	// range, so it can't produce an out-of-window schedule.
+	clamped := false
+	inRange := func(n int) int {
+		v := randIntn(n)
+		if v < 0 || v >= n {
+			clamped = true
+			v = ((v % n) + n) % n
+		}
+		return v
+	}
+
+	// One recipient a day from the pool: drawn on the day's first run, then
+	// kept so later runs greet the same person. A choice no longer in the
+	// pool is drawn again.
+	if args.Selection == "one_weighted" {
+		inPool := slices.ContainsFunc(args.RecipientPool, func(e poolEntry) bool { return e.Name == state.PoolChoice })
+		if state.PoolDate != date || !inPool {
+			state.PoolDate, state.PoolChoice = date, pickWeighted(args.RecipientPool, inRange)
+		}
+		args.Name, args.Names = state.PoolChoice, nil
+	}
+
+	// With anchor, today's window follows the sun; the preview below
+	// anchors each of its days itself.
+	today := args.anchoredTo(now)
+	out, err := evaluate(today, state, now, inRange)
+	if err != nil {
+		return out, &RunError{InternalError, err}
+	}
+	// Only a run whose state is saved starts the count; a locked run hands
+	// the state back as found.
+	if state.CreatedDate == "" && fmt.Sprint(out.Data["skip_reason"]) != string(SkipLocked) {
+		out.State["created_date"] = date
+	}
+	if out.ContinueToLLM {
+		log.Infof("send: to %s", args.recipientList())
+	} else {
+		log.Infof("skip: %s (%s)", out.Data["status"], out.Data["skip_reason"])
+	}
+	if v, ok := out.State["scheduled_for"].(string); ok {
+		log.Infof("schedule: %s", v)
+	}
+	out.Data["schedule_fingerprint"] = args.scheduleFingerprint()
+	if activeErr == nil {
+		// A created_date after today (a clock running fast) counts as today.
+		out.Data["days_active"] = max(daysActive, 0)
+	}
+	if warnings := append(append([]string(nil), today.warnings...), state.warnings...); len(warnings) > 0 {
+		out.Data["warnings"] = warnings
+	}
+	if args.PreviewDays > 0 {
+		next, err := parseState(out.State)
+		if err != nil {
+			return sdk.Output{}, &RunError{InternalError, err}
+		}
+		if out.Data["preview"], err = previewSchedule(args, next, now, inRange); err != nil {
+			return sdk.Output{}, &RunError{InternalError, fmt.Errorf("preview: %w", err)}
+		}
+	}
+	if args.SuppressIntermediate && out.Data["status"] == "waiting" {
+		out.Data["silent"] = true
+	}
+	if clamped {
+		log.Debugf("random source returned out-of-range values; clamped")
+		out.Data["random_clamped"] = true
+	}
+	if args.TimeFormat == "rfc3339" {
+		plan, _ := out.Data["today_plan"].(map[string]any)
+		for _, m := range []map[string]any{out.State, plan} {
+			if v, ok := m["scheduled_for"].(string); ok {
+				m["scheduled_for"] = args.formatSchedule(v)
+			}
+		}
+		if v, ok := out.Data["next_send"].(string); ok {
+			out.Data["next_send"] = args.formatSchedule(v)
+		}
+	}
+	if out.ContinueToLLM {
+		for _, name := range args.Postprocess {
+			out.Data = postProcessors[name](out.Data)
+		}
+	}
+	if !args.DryRun {
+		if args.CompactState {
+			out.State = compactState(out.State)
+		}
+		return out, nil
+	}
+
+	// Dry run — report the schedule the run resolved, then hand back the
+	// state exactly as it came in.
+	scheduledFor := state.ScheduledFor
+	if v, ok := out.State["scheduled_for"].(string); ok {
+		scheduledFor = v
+	}
+	log.Debugf("dry run: state left unchanged")
+	out.Data["dry_run"] = true
+	if scheduledFor != "" {
+		out.Data["scheduled_for"] = args.formatSchedule(scheduledFor)
+	}
+	out.State = input.State
+	return out, nil
+}
+
+// Decision names what a run did, for programmatic callers that would
+// otherwise match on data.status and data.skip_reason.
+type Decision string
+
+const (
+	DecisionSent        Decision = "sent"         // the salutation went out
+	DecisionScheduled   Decision = "scheduled"    // a send time was just picked (or picked again)
+	DecisionWaiting     Decision = "waiting"      // a send is still to come today
+	DecisionAlreadySent Decision = "already_sent" // today's (or this period's) send is done
+	DecisionConfirmed   Decision = "confirmed"    // the delivery step acknowledged the send
+	DecisionMissed      Decision = "missed"       // today was given up on without a send
+	DecisionSkipped     Decision = "skipped"      // not a sending day, or nothing to send
+	DecisionSnoozed     Decision = "snoozed"      // a snooze is active until snooze_until
+	DecisionCapped      Decision = "capped"       // monthly_cap is used up for this month
+	DecisionLocked      Decision = "locked"       // another worker holds the lock
+	DecisionExpired     Decision = "expired"      // expires_on has passed
+	DecisionCompleted   Decision = "completed"    // the single send under once has gone out
+)
+
+// statusDecisions maps each data.status to its Decision; "waiting" is
+// further split by decisionOf.
+var statusDecisions = map[string]Decision{
+	"sent":         DecisionSent,
+	"waiting":      DecisionWaiting,
+	"already_sent": DecisionAlreadySent,
+	"confirmed":    DecisionConfirmed,
+	"missed":       DecisionMissed,
+	"day_off":      DecisionSkipped,
+	"holiday":      DecisionSkipped,
+	"silent":       DecisionSkipped,
+	"skipped":      DecisionSkipped,
+	"snoozed":      DecisionSnoozed,
+	"capped":       DecisionCapped,
+	"locked":       DecisionLocked,
+	"expired":      DecisionExpired,
+	"completed":    DecisionCompleted,
+}
+
+// Decide runs the goblin like run, and also returns the Decision the run
+// came to. It is the entry point main uses.
+func Decide(input sdk.Input, now time.Time, randIntn func(int) int, log Logger) (Decision, sdk.Output, error) {
+	out, err := run(input, now, randIntn, log)
+	if err != nil {
+		return "", sdk.Output{}, err
+	}
+	d, err := decisionOf(out)
+	if err != nil {
+		return "", sdk.Output{}, &RunError{InternalError, err}
+	}
+	return d, out, nil
+}
+
+// decisionOf reads the Decision from out's data.status and skip_reason.
+func decisionOf(out sdk.Output) (Decision, error) {
+	status, _ := out.Data["status"].(string)
+	d, ok := statusDecisions[status]
+	if !ok {
+		return "", fmt.Errorf("decision: unknown status %q", status)
+	}
+	if d == DecisionWaiting {
+		switch SkipReason(fmt.Sprint(out.Data["skip_reason"])) {
+		case SkipSchedulePicked, SkipStaleScheduleRepicked, SkipInvalidScheduleRepicked, SkipOutOfWindowRepicked:
+			d = DecisionScheduled
+		}
+	}
+	return d, nil
+}
+
+// WouldSend reports whether a run at the given instant would send the
+// salutation, given already-parsed arguments and state. It evaluates the same
+// decision as run but has no side effects, so external schedulers can poll it
+// cheaply. A send that hangs on a send_probability roll not yet made (the
+// pick of an immediate_first_run) is reported conservatively, as no send.
+func WouldSend(args goblinArgs, state goblinState, at time.Time) bool {
+	// Only that roll can turn a pick into a send, so with it always lost
+	// any source gives the same answer.
+	if args.SendProbability < 1 {
+		args.SendProbability = 0
+	}
+	out, err := evaluate(args, state, at, func(int) int { return 0 })
+	return err == nil && out.ContinueToLLM
+}
+
+// simulationStart is the first day AssertOneSendPerDay simulates: a Monday in
+// a leap year, so longer runs cross month ends and both DST transitions.
+const simulationStart = "2024-01-01"
+
+// simulationTick is how often AssertOneSendPerDay invokes the goblin.
+const simulationTick = 15 * time.Minute
+
+// AssertOneSendPerDay simulates the goblin running every simulationTick for
+// the given number of days from simulationStart, and returns an error naming
+// the first day that breaks the core invariant: exactly one send on every
+// eligible day and none on any other. A day is eligible when the days filter,
+// skip_dates, cadence and interval_days all allow a send; days that
+// send_probability or trigger_count legitimately silence are excused. It lets
+// blueprint CI catch configurations that drop or duplicate sends.
+func AssertOneSendPerDay(args goblinArgs, days int, randIntn func(int) int) error {
+	// History has no say in when sends happen; not recording it keeps the
+	// state round trip on every tick cheap.
+	args.HistoryLimit = 0
+	loc := args.location()
+	day, err := time.ParseInLocation("2006-01-02", simulationStart, loc)
+	if err != nil {
+		return err
+	}
+	var state goblinState
+	var lastSend string
+	for i := 0; i < days; i++ {
+		date := day.Format("2006-01-02")
+		next := day.AddDate(0, 0, 1)
+
+		sends, excused := 0, false
+		for now := day; now.Before(next); now = now.Add(simulationTick) {
+			out, err := evaluate(args, state, now, randIntn)
+			if err != nil {
+				return fmt.Errorf("%s: %w", now.Format("2006-01-02T15:04"), err)
+			}
+			if out.ContinueToLLM {
+				sends++
+			}
+			switch out.Data["skip_reason"] {
+			case string(SkipSilentDay), string(SkipAwaitingEvents):
+				excused = true
+			}
+			if state, err = parseState(out.State); err != nil {
+				return fmt.Errorf("%s: %w", now.Format("2006-01-02T15:04"), err)
+			}
+		}
+
+		eligible := args.dayAllowed(day) && !args.skipped(date)
+		if gap, err := daysBetween(lastSend, date); err == nil && gap < args.IntervalDays {
+			eligible = false
+		}
+		if args.Cadence == "weekly" && sameISOWeek(lastSend, date) {
+			eligible = false
+		}
+		switch {
+		case eligible && sends != 1 && !(sends == 0 && excused):
+			return fmt.Errorf("%s: %d sends on an eligible day, want exactly 1", date, sends)
+		case !eligible && sends != 0:
+			return fmt.Errorf("%s: %d sends on an ineligible day, want none", date, sends)
+		}
+		if sends > 0 {
+			lastSend = date
+		}
+		day = next
+	}
+	return nil
+}
+
+// ReplayStep is one run in a Replay: the instant it happens at and, when
+// they change, the arguments and state it sees.
+type ReplayStep struct {
+	Now time.Time
+
+	// Arguments are the blueprint arguments for this run; nil keeps the
+	// previous step's.
+	Arguments map[string]any
+
+	// State, when set, replaces the state carried over from the previous
+	// step, as when an operator edited it between runs.
+	State map[string]any
+
+	// RandIntn is the random source for this run; nil uses the replay's
+	// own, seeded the same way every time so a replay is reproducible.
+	RandIntn func(int) int
+}
+
+// replaySeed seeds the random source steps without a RandIntn share.
+const replaySeed = 1
+
+// Replay runs run over steps in order, threading each output's state into the
+// next step, and returns every output — the decision path a user saw. It
+// stops at the first failing step, returning the outputs before it alongside
+// an error naming the step.
+func Replay(steps []ReplayStep) ([]sdk.Output, error) {
+	randIntn := rand.New(rand.NewSource(replaySeed)).Intn
+	args := map[string]any{}
+	state := map[string]any{}
+	outs := make([]sdk.Output, 0, len(steps))
+	for i, step := range steps {
+		if step.Arguments != nil {
+			args = step.Arguments
+		}
+		if step.State != nil {
+			state = step.State
+		}
+		r := step.RandIntn
+		if r == nil {
+			r = randIntn
+		}
+		out, err := run(sdk.Input{Arguments: args, State: state}, step.Now, r, nil)
+		if err != nil {
+			return outs, fmt.Errorf("replay step %d (%s): %w", i, step.Now.Format(time.RFC3339), err)
+		}
+		outs = append(outs, out)
+		state = out.State
+	}
+	return outs, nil
+}
+
+// healthCheck is one of HealthCheck's self-tests.
+type healthCheck struct {
+	name  string
+	check func(randIntn func(int) int) error
+}
+
+// healthChecks are the invariants HealthCheck confirms, in order. None reads
+// real input or state.
+var healthChecks = []healthCheck{
+	{"parse_defaults", func(func(int) int) error {
+		args, err := parseArgs(map[string]any{})
+		if err != nil {
+			return err
+		}
+		return args.validateWindow()
+	}},
+	{"pick_in_window", func(randIntn func(int) int) error {
+		args, _ := parseArgs(map[string]any{})
+		day, _ := time.Parse("2006-01-02", simulationStart)
+		earliest, latest, err := EffectiveWindow(args, day)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			picked, err := pickSchedule(args, simulationStart, randIntn)
+			if err != nil {
+				return err
+			}
+			at, err := args.scheduledInstant(picked)
+			if err != nil {
+				return err
+			}
+			if at.Before(earliest) || !at.Before(latest) {
+				return fmt.Errorf("picked %s, outside %s–%s", picked, earliest.Format("15:04"), latest.Format("15:04"))
+			}
+		}
+		return nil
+	}},
+	{"state_round_trip", func(func(int) int) error {
+		want := goblinState{
+			LastSentDate: simulationStart,
+			ScheduledFor: simulationStart + "T09:30",
+			Streak:       3,
+			History:      []historyEntry{{Date: simulationStart, TimeOfDay: "morning"}},
+		}
+		got, err := parseState(saveState(want))
+		if err != nil {
+			return err
+		}
+		want.Version = stateVersion
+		if !reflect.DeepEqual(saveState(got), saveState(want)) {
+			return fmt.Errorf("state came back as %v, want %v", saveState(got), saveState(want))
+		}
+		return nil
+	}},
+	{"pick_then_send", func(randIntn func(int) int) error {
+		day, _ := time.Parse("2006-01-02", simulationStart)
+		out, err := run(sdk.Input{Arguments: map[string]any{}, State: map[string]any{}}, day, randIntn, nil)
+		if err != nil {
+			return err
+		}
+		scheduledFor, _ := out.State["scheduled_for"].(string)
+		at, err := time.Parse("2006-01-02T15:04", scheduledFor)
+		if err != nil {
+			return fmt.Errorf("first run saved no schedule: %v", out.State)
+		}
+		out, err = run(sdk.Input{Arguments: map[string]any{}, State: out.State}, at, randIntn, nil)
+		if err != nil {
+			return err
+		}
+		if !out.ContinueToLLM {
+			return fmt.Errorf("no send at the scheduled %s: %v", scheduledFor, out.Data)
+		}
+		return nil
+	}},
+}
+
+// HealthCheck runs the goblin's self-tests — defaults parse, picks land in
+// the window, state round-trips, and a schedule picked on one run sends on
+// the next — and returns an error naming the first that fails. It gives a
+// deployment smoke test a quick answer to whether the binary is sane.
+func HealthCheck(randIntn func(int) int) error {
+	return runHealthChecks(healthChecks, randIntn)
+}
+
+func runHealthChecks(checks []healthCheck, randIntn func(int) int) error {
+	for _, c := range checks {
+		if err := c.check(randIntn); err != nil {
+			return fmt.Errorf("healthcheck %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// previewSchedule plays the PreviewDays days after now through evaluate,
+// starting from state: each day is evaluated at midnight, which picks its
+// schedule, and again at the scheduled time, which sends. Days that don't
+// send report their skip_reason instead of a scheduled_for.
+func previewSchedule(args goblinArgs, state goblinState, now time.Time, randIntn func(int) int) ([]map[string]any, error) {
+	// Only the schedule matters: no forced sends, no confirmation round
+	// trips, no events from runs that haven't happened, and no history.
+	args.Force = false
+	args.ConfirmDelivery = false
+	args.Events = 0
+	args.HistoryLimit = 0
+	local := now.In(args.location())
+	preview := make([]map[string]any, 0, args.PreviewDays)
+	for i := 1; i <= args.PreviewDays; i++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+i, 0, 0, 0, 0, args.location())
+		date := day.Format("2006-01-02")
+		entry := map[string]any{"date": date}
+		dayArgs := args.anchoredTo(day)
+		out, err := evaluate(dayArgs, state, day, randIntn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", date, err)
+		}
+		if state, err = parseState(out.State); err != nil {
+			return nil, fmt.Errorf("%s: %w", date, err)
+		}
+		if strings.HasPrefix(state.ScheduledFor, date) {
+			scheduledFor := state.ScheduledFor
+			at, err := args.scheduledInstant(scheduledFor)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", date, err)
+			}
+			if out, err = evaluate(dayArgs, state, at, randIntn); err != nil {
+				return nil, fmt.Errorf("%s: %w", date, err)
+			}
+			if state, err = parseState(out.State); err != nil {
+				return nil, fmt.Errorf("%s: %w", date, err)
+			}
+			if out.ContinueToLLM {
+				entry["scheduled_for"] = args.formatSchedule(scheduledFor)
+			}
+		}
+		if _, ok := entry["scheduled_for"]; !ok {
+			entry["skip_reason"] = out.Data["skip_reason"]
+		}
+		preview = append(preview, entry)
+	}
+	return preview, nil
+}
+
+// evaluate is the decision logic behind run, operating on parsed arguments and
+// state. It never modifies its inputs; the next state is returned in the Output.
+func evaluate(args goblinArgs, state goblinState, now time.Time, randIntn func(int) int) (sdk.Output, error) {
+	// Normalise now into the configured zone up front, whatever Location the
+	// host passed it in, so every date and hour below is local.
+	now = now.In(args.location())
+	today := now.Format("2006-01-02")
+
+	// Read a schedule stored as RFC 3339 as local wall-clock time, so the
+	// decision below only deals with one format.
+	if t, err := time.Parse(time.RFC3339, state.ScheduledFor); err == nil {
+		state.ScheduledFor = formatWallClock(t.In(args.location()))
+	}
+
+	// A schedule that doesn't parse at all (a truncated write, say) is
+	// dropped so a fresh one is picked, rather than failing every run until
+	// the state is fixed by hand.
+	invalidSchedule := false
+	if _, err := parseWallClock(state.ScheduledFor); err != nil && state.ScheduledFor != "" {
+		state.ScheduledFor = ""
+		invalidSchedule = true
+	}
+
+	// Another worker holds the lock — leave the state exactly as found.
+	if args.LockToken != "" {
+		ttl := time.Duration(args.LockTTLMinutes) * time.Minute
+		if state.Lock.heldByOther(args.LockToken, now, ttl) {
+			// Not even the metrics move: the lock holder counts its own run.
+			out := skip(state, "locked", SkipLocked, nil)
+			out.Data["metrics"] = state.Metrics
+			out.State = saveState(state)
+			return out, nil
+		}
+		state.Lock = &stateLock{Token: args.LockToken, AcquiredAt: now.UTC().Format(time.RFC3339)}
+	}
+
+	// The one send of once has gone out; nothing will again.
+	if state.Completed {
+		state.ScheduledFor = ""
+		return skip(state, "completed", SkipCompleted, nil), nil
+	}
+
+	// The campaign is over — drop any pending schedule and stop for good.
+	if args.ExpiresOn != "" && today >= args.ExpiresOn {
+		state.ScheduledFor = ""
+		state.ResumePending = args.ResumeGreeting
+		return skip(state, "expired", SkipExpired, nil), nil
+	}
+
+	// Count this run's events whatever else happens, so none are lost to a
+	// skip.
+	state.PendingEvents += args.Events
+
+	if args.Digest {
+		digest, err := args.recordDigest(state.Digest, now, state.ScheduledFor)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		state.Digest = digest
+	}
+
+	// Snoozed — nothing is sent or scheduled until snooze_until, and a
+	// schedule picked before the snooze is dropped. Afterwards, or if it
+	// doesn't parse, the snooze is forgotten.
+	if state.SnoozeUntil != "" {
+		_, err := time.Parse("2006-01-02", state.SnoozeUntil)
+		if err == nil && today < state.SnoozeUntil {
+			state.ScheduledFor = ""
+			state.ResumePending = args.ResumeGreeting
+			return skip(state, "snoozed", SkipSnoozed, map[string]any{"snooze_until": state.SnoozeUntil}), nil
+		}
+		// A snooze that ran out between runs still lapses here.
+		if err == nil && args.ResumeGreeting {
+			state.ResumePending = true
+		}
+		state.SnoozeUntil = ""
+	}
+
+	// A send is awaiting confirmation: re-emit it as it was first built
+	// until the delivery step confirms it or the retries run out.
+	if args.ConfirmDelivery && state.PendingSendAt != "" {
+		sentAt, err := time.Parse(time.RFC3339, state.PendingSendAt)
+		sentAt = sentAt.In(args.location())
+		switch {
+		case err != nil || sentAt.Format("2006-01-02") != today:
+			// Unreadable, or left over from a day that has ended — forget it.
+			state = clearPending(state)
+		case !state.DeliveryConfirmed && state.DeliveryAttempts > args.MaxRetries:
+			state = clearPending(state)
+			state.LastSentDate = today
+			state.ScheduledFor = ""
+			return skip(state, "missed", SkipDeliveryFailed, nil), nil
+		default:
+			return send(args, state, sentAt, randIntn)
+		}
+	}
+
+	// The month's cap is used up — nothing more goes out until the next one.
+	if args.MonthlyCap > 0 && state.sentThisMonth(today) >= args.MonthlyCap {
+		// A schedule for a later day (under next_eligible) may fall in the
+		// next month; one for today is dropped.
+		if len(state.ScheduledFor) < len("2006-01-02") || state.ScheduledFor[:10] <= today {
+			state.ScheduledFor = ""
+		}
+		return skip(state, "capped", SkipMonthlyCapReached, map[string]any{"month_sends": state.MonthSends}), nil
+	}
+
+	// Forced — send right away, whatever the schedule, the day or the window.
+	if args.Force {
+		out, err := send(args, state, now, randIntn)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		out.Data["forced"] = true
+		return out, nil
+	}
+
+	// Several sends a day — each slot keeps its own schedule.
+	if args.SendsPerDay > 1 {
+		return evaluateSlots(args, state, now, randIntn)
+	}
+
+	// Already sent today — nothing to do, unless it went to a name that has
+	// since been corrected.
+	if state.LastSentDate == today {
+		if args.ResendOnNameChange && state.LastSentName != "" && state.LastSentName != args.recipientList() {
+			out, err := send(args, state, now, randIntn)
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			out.Data["resent"] = true
+			return out, nil
+		}
+		return skip(state, "already_sent", SkipAlreadySentToday, map[string]any{"next_send": nextSend(state, today)}), nil
+	}
+
+	// Weekly cadence: already sent earlier this ISO week.
+	if args.Cadence == "weekly" && sameISOWeek(state.LastSentDate, today) {
+		return skip(state, "already_sent", SkipAlreadySentThisWeek, map[string]any{"next_send": nextSend(state, today)}), nil
+	}
+
+	// Interval cadence: too few days since the last send.
+	if gap, err := daysBetween(state.LastSentDate, today); err == nil && gap < args.IntervalDays {
+		return skip(state, "already_sent", SkipIntervalNotElapsed, map[string]any{"next_send": nextSend(state, today)}), nil
+	}
+
+	nextEligible := args.RepickTarget == "next_eligible"
+	var scheduledDate string
+	if len(state.ScheduledFor) >= 10 {
+		scheduledDate = state.ScheduledFor[:10]
+	}
+
+	// Holiday — skip without scheduling or marking the day sent. A schedule
+	// picked for today before the date was added to skip_dates is dropped.
+	if args.skipped(today) {
+		if scheduledDate <= today {
+			state.ScheduledFor = ""
+		}
+		return skip(state, "holiday", SkipHoliday, nil), nil
+	}
+
+	// The probability roll made today a silent day.
+	if state.SilentDate == today {
+		if scheduledDate <= today {
+			state.ScheduledFor = ""
+		}
+		return skip(state, "silent", SkipSilentDay, nil), nil
+	}
+
+	// Not a sending day — skip without scheduling, and drop any schedule left
+	// over from an earlier day so it can't fire later. With next_eligible the
+	// schedule for the next allowed day is picked (or kept) below instead.
+	if !args.dayAllowed(now) && !nextEligible {
+		state.ScheduledFor = ""
+		return skip(state, "day_off", SkipDayOff, nil), nil
+	}
+
+	// A snooze or expiry has just lapsed — greet now if the window is open,
+	// whatever was scheduled. Outside it the resume waits for a run inside.
+	if args.ResumeGreeting && state.ResumePending {
+		// A window blacked out entirely is left for the pick below to report.
+		earliest, latest, err := EffectiveWindow(args, now)
+		if err == nil && !now.Before(earliest) && now.Before(latest) {
+			out, err := send(args, state, now, randIntn)
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			if _, ok := out.Data["occasion"]; !ok {
+				out.Data["occasion"] = "resumed"
+			}
+			return out, nil
+		}
+	}
+
+	// The window was narrowed (or moved) since the schedule was picked, so
+	// the pending time no longer falls inside it. Pick again rather than
+	// send at a time the current configuration wouldn't choose.
+	outOfWindow := false
+	if state.ScheduledFor != "" && args.FixedTime == "" && (scheduledDate == today || nextEligible && scheduledDate > today) {
+		// Compare wall-clock minutes, so a time shifted by a DST gap still
+		// counts as the one picked.
+		if wc, err := parseWallClock(state.ScheduledFor); err == nil {
+			w := args.windowOn(time.Date(wc.Year(), wc.Month(), wc.Day(), 12, 0, 0, 0, args.location()))
+			start, end := w.window()
+			if m := wc.Hour()*60 + wc.Minute(); m < start || m >= end || w.blackedOut(m) {
+				outOfWindow = true
+				scheduledDate = ""
+			}
+		}
+	}
+
+	// No send time chosen for today (or, with next_eligible, an upcoming
+	// allowed day) yet — pick one and wait.
+	if scheduledDate != today && !(nextEligible && scheduledDate > today) {
+		// Not enough events yet to earn a salutation.
+		if args.TriggerCount > 0 && state.PendingEvents < args.TriggerCount {
+			return skip(state, "waiting", SkipAwaitingEvents, map[string]any{
+				"pending_events": state.PendingEvents,
+			}), nil
+		}
+		target := today
+		if nextEligible {
+			target = args.nextEligibleDay(now)
+		}
+		reason := SkipSchedulePicked
+		switch {
+		case outOfWindow:
+			reason = SkipOutOfWindowRepicked
+		case invalidSchedule:
+			reason = SkipInvalidScheduleRepicked
+		case state.ScheduledFor != "":
+			reason = SkipStaleScheduleRepicked
+		}
+		firstRun := state.LastSentDate == "" && state.ScheduledFor == "" && len(state.History) == 0
+		// Today's pick only draws from what is left of the window; a day
+		// whose window has already closed is counted as missed for good.
+		from := 0
+		if target == today {
+			from = minuteFrom(now)
+		}
+		scheduledFor, err := pickScheduleFrom(args, target, from, randIntn)
+		if errors.Is(err, errWindowPassed) {
+			state.LastSentDate = today
+			state.ScheduledFor = ""
+			return skip(state, "missed", SkipPickedInPast, nil), nil
+		}
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		state.ScheduledFor = scheduledFor
+		// Roll once for the day being scheduled; a losing roll makes it
+		// silent. A future day keeps its schedule so it isn't rolled again.
+		if args.SendProbability < 1 && randIntn(100) >= int(math.Round(args.SendProbability*100)) {
+			state.SilentDate = target
+			if target == today {
+				state.ScheduledFor = ""
+			}
+			return skip(state, "silent", SkipSilentDay, nil), nil
+		}
+		// With immediate_first_run, a first run that is already inside
+		// today's window sends now rather than waiting for the pick.
+		if firstRun && args.ImmediateFirstRun && args.FixedTime == "" && target == today {
+			earliest, latest, err := EffectiveWindow(args, now)
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			m := now.Hour()*60 + now.Minute()
+			if !now.Before(earliest) && now.Before(latest) && !args.windowOn(now).blackedOut(m) {
+				return send(args, state, now, randIntn)
+			}
+		}
+		scheduledAt, err := args.scheduledInstant(state.ScheduledFor)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		// A fixed_time, a seeded pick (or a DST shift) can still land
+		// before now, which the next run would send the moment it sees.
+		// Count today as missed instead of sending retroactively.
+		if scheduledAt.Before(now) {
+			state.LastSentDate = today
+			state.ScheduledFor = ""
+			return skip(state, "missed", SkipPickedInPast, nil), nil
+		}
+		return skip(state, "waiting", reason, map[string]any{
+			"next_send":              state.ScheduledFor,
+			"scheduled_for_epoch_ms": scheduledAt.UnixMilli(),
+			"today_plan":             todayPlan(args, target, state.ScheduledFor),
+		}), nil
+	}
+
+	// Send time chosen but not yet reached, even allowing for
+	// send_tolerance_minutes — keep waiting.
+	scheduledAt, err := args.scheduledInstant(state.ScheduledFor)
+	if err != nil {
+		return sdk.Output{}, err
+	}
+	early := !args.reached(now, scheduledAt)
+	if tolerance := time.Duration(args.SendToleranceMinutes) * time.Minute; early && tolerance > 0 {
+		opens, _, err := EffectiveWindow(args, scheduledAt)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		early = !args.reached(now.Add(tolerance), scheduledAt) || now.Before(opens)
+	}
+	if early {
+		return skip(state, "waiting", SkipBeforeScheduledTime, map[string]any{
+			"next_send":              state.ScheduledFor,
+			"minutes_until_send":     minutesUntil(now, scheduledAt),
+			"scheduled_for_epoch_ms": scheduledAt.UnixMilli(),
+			"ics_event":              icsEvent(args, state.ScheduledFor[:10], scheduledAt, now),
+		}), nil
+	}
+
+	// Send time passed too long ago — give up on today rather than send
+	// stale. A day already part-way through its batches carries on.
+	if args.MaxDelayMinutes > 0 && state.BatchDate != today && now.Sub(scheduledAt) > time.Duration(args.MaxDelayMinutes)*time.Minute {
+		state.LastSentDate = today
+		state.ScheduledFor = ""
+		return skip(state, "missed", SkipTooLate, nil), nil
+	}
+
+	// Too soon after the previous send — hold on to the schedule until the
+	// gap has passed.
+	if last, err := time.Parse(time.RFC3339, state.LastSentAt); err == nil && args.MinGapHours > 0 {
+		if allowed := last.Add(time.Duration(args.MinGapHours) * time.Hour); !args.reached(now, allowed) {
+			return skip(state, "waiting", SkipMinGap, map[string]any{
+				"next_send":          state.ScheduledFor,
+				"minutes_until_send": minutesUntil(now, allowed),
+			}), nil
+		}
+	}
+
+	// Time to send.
+	return send(args, state, now, randIntn)
+}
+
+// reached reports whether now has reached the instant at, counting the
+// instant itself only when inclusive is set.
+func (a goblinArgs) reached(now, at time.Time) bool {
+	if a.Inclusive {
+		return !now.Before(at)
+	}
+	return now.After(at)
+}
+
+// evaluateSlots decides a run under sends_per_day 2: it works through the
+// slots in order, picking each one's time when first reached and sending it
+// once that time comes. A slot whose window closes before any run gets to
+// send it is missed for the day. At most one slot sends per run.
+func evaluateSlots(args goblinArgs, state goblinState, now time.Time, randIntn func(int) int) (sdk.Output, error) {
+	today := now.Format("2006-01-02")
+	if state.SlotDate != today {
+		state.SlotDate, state.SentSlots, state.SlotSchedules = today, nil, nil
+	}
+	if args.skipped(today) {
+		return skip(state, "holiday", SkipHoliday, nil), nil
+	}
+	if !args.dayAllowed(now) {
+		return skip(state, "day_off", SkipDayOff, nil), nil
+	}
+	schedules := make(map[string]string, len(args.Slots))
+	for name, v := range state.SlotSchedules {
+		schedules[name] = v
+	}
+	state.SlotSchedules = schedules
+
+	for _, slot := range args.Slots {
+		if slices.Contains(state.SentSlots, slot.Name) {
+			continue
+		}
+		slotArgs := args.forSlot(slot)
+		_, end := slotArgs.window()
+		if closes := time.Date(now.Year(), now.Month(), now.Day(), 0, end, 0, 0, now.Location()); !now.Before(closes) {
+			continue
+		}
+		reason := SkipBeforeScheduledTime
+		if _, ok := state.SlotSchedules[slot.Name]; !ok {
+			// As with a single send, the pick draws from what's left of
+			// the slot. A slot with nothing left, or whose seeded pick has
+			// passed, is missed rather than sent late.
+			picked, err := pickScheduleFrom(slotArgs, today, minuteFrom(now), randIntn)
+			if errors.Is(err, errWindowPassed) {
+				continue
+			}
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			pickedAt, err := args.scheduledInstant(picked)
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			if pickedAt.Before(now) {
+				continue
+			}
+			state.SlotSchedules[slot.Name] = picked
+			reason = SkipSchedulePicked
+		}
+		scheduledAt, err := args.scheduledInstant(state.SlotSchedules[slot.Name])
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		if !args.reached(now, scheduledAt) {
+			return skip(state, "waiting", reason, map[string]any{
+				"slot":                   slot.Name,
+				"next_send":              state.SlotSchedules[slot.Name],
+				"scheduled_for_epoch_ms": scheduledAt.UnixMilli(),
+			}), nil
+		}
+		state.SentSlots = append(append([]string(nil), state.SentSlots...), slot.Name)
+		out, err := send(args, state, now, randIntn)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		out.Data["slot"] = slot.Name
+		out.Data["idempotency_key"] = idempotencyKey(args.recipientList(), today, slot.Name)
+		return out, nil
+	}
+	return skip(state, "already_sent", SkipAlreadySentToday, map[string]any{"next_send": nil}), nil
+}
+
+// send builds the output of a run that delivers today's salutation, at now
+// (already in the configured zone), and records it in the next state.
+func send(args goblinArgs, state goblinState, now time.Time, randIntn func(int) int) (sdk.Output, error) {
+	today := now.Format("2006-01-02")
+	everyone := args.recipientList()
+
+	// Under batch_size only the next recipients not yet greeted today go
+	// out, and the day stays open while any are left.
+	var greeted []string
+	remaining := 0
+	if args.BatchSize > 0 && args.Names != nil {
+		if state.BatchDate == today {
+			greeted = state.BatchSent
+		}
+		var pending []string
+		for _, name := range args.Names {
+			if !slices.Contains(greeted, name) {
+				pending = append(pending, name)
+			}
+		}
+		if len(pending) == 0 {
+			// Everyone left on the list has been greeted already.
+			done := sentState(state, today)
+			return skip(done, "already_sent", SkipAlreadySentToday, map[string]any{"next_send": nextSend(done, today)}), nil
+		}
+		batch := pending[:min(args.BatchSize, len(pending))]
+		greeted = append(slices.Clone(greeted), batch...)
+		remaining = len(pending) - len(batch)
+		args.Names = batch
+	}
+	// Under label_source "scheduled" the labels describe today's chosen
+	// time. A later batch is labelled when it runs, since it goes out after
+	// that time by design.
+	hour := now.Hour()
+	if wall, err := parseWallClock(state.ScheduledFor); err == nil && args.LabelSource == "scheduled" && wall.Format("2006-01-02") == today && state.BatchDate != today {
+		hour = wall.Hour()
+	}
+	part := describeTimeOfDay(hour, args.boundaries(), args.locale())
+	tod := part.Label
+	data := map[string]any{
+		"status":          "sent",
+		"nonce":           nonce(randIntn),
+		"idempotency_key": idempotencyKey(args.recipientList(), today, ""),
+		"weekday_name":    weekdayName(now.Weekday(), args.locale()),
+	}
+	if args.IncludeConfig {
+		data["config"] = args.resolvedConfig()
+	}
+	if args.Channel != "" {
+		data["channel"] = args.Channel
+	}
+	if args.CatchUp {
+		if missed := args.missedDays(state.lastSendDate(), today); len(missed) > 0 {
+			data["missed_days"] = map[string]any{"count": len(missed), "dates": missed}
+		}
+	}
+	next := clearPending(sentState(state, today))
+	next.LastSentAt = now.Format(time.RFC3339)
+	next.LastSentName = everyone
+	next.BatchDate, next.BatchSent = "", nil
+	if args.MonthlyCap > 0 {
+		next.MonthSends = state.sentThisMonth(today) + 1
+		next.CapMonth = today[:7]
+	}
+	if args.Digest {
+		// Today's entry reflects the send that actually happened.
+		digest := slices.Clone(state.Digest)
+		for i := range digest {
+			if digest[i].Date == today {
+				digest[i].TimeOfDay, digest[i].WouldSend = tod, true
+			}
+		}
+		data["digest"] = digest
+		next.Digest = nil
+	}
+	next.Completed = args.Once
+	next.ResumePending = false
+	next.PendingEvents = 0
+	next.Streak = nextStreak(state, today)
+	data["streak"] = next.Streak
+	if args.IncludeMood {
+		data["mood"] = mood(dayPart(hour, args.boundaries()), next.Streak)
+	}
+	if args.VariantCount > 0 {
+		data["variant_index"] = variantIndex(today, args.VariantCount)
+	}
+	next.History = appendHistory(state.History, historyEntry{Date: today, TimeOfDay: tod}, args.HistoryLimit)
+	if next.History != nil {
+		data["history"] = next.History
+	}
+
+	tmpl := defaultMessage
+	rendered := args.Format == "markdown"
+	if occasion, msg, _ := args.occasionOn(today); occasion != "" {
+		// The occasion's message stands in for the rotation, which
+		// resumes where it left off tomorrow.
+		data["occasion"] = occasion
+		tmpl = msg
+		rendered = true
+	} else if n := len(args.Messages); n > 0 {
+		i := ((state.MessageIndex % n) + n) % n
+		tmpl = args.Messages[i]
+		next.MessageIndex = (i + 1) % n
+		rendered = true
+	}
+	message := func(name string) (string, error) {
+		return renderMessage(tmpl, name, tod), nil
+	}
+	if args.tmpl != nil {
+		rendered = true
+		ctx := templateContext{
+			TimeOfDay: tod,
+			Date:      today,
+			Weekday:   weekdayName(now.Weekday(), args.locale()),
+			Streak:    next.Streak,
+			Occasion:  args.occasion(today),
+		}
+		message = func(name string) (string, error) {
+			ctx.Name = name
+			var b strings.Builder
+			if err := args.tmpl.Execute(&b, ctx); err != nil {
+				return "", fmt.Errorf("render template: %w", err)
+			}
+			return b.String(), nil
+		}
+	}
+	greeting := func(name string) (map[string]any, error) {
+		g := map[string]any{"name": name, "time_of_day": tod, "greeting": part.Phrase, "hour": part.Hour}
+		if rendered {
+			msg, err := message(name)
+			if err != nil {
+				return nil, err
+			}
+			g["message"] = msg
+		}
+		if args.Format == "markdown" {
+			md, err := renderers["markdown"](message, name)
+			if err != nil {
+				return nil, err
+			}
+			g["markdown"] = md
+		}
+		if len(args.Formats) > 0 {
+			out := make(map[string]any, len(args.Formats))
+			for _, f := range args.Formats {
+				text, err := renderers[f](message, name)
+				if err != nil {
+					return nil, err
+				}
+				out[f] = text
+			}
+			g["rendered"] = out
+		}
+		return g, nil
+	}
+	if args.Names != nil {
+		messages := make([]map[string]any, len(args.Names))
+		for i, name := range args.Names {
+			g, err := greeting(name)
+			if err != nil {
+				return sdk.Output{}, err
+			}
+			messages[i] = g
+		}
+		data["messages"] = messages
+	} else {
+		g, err := greeting(args.Name)
+		if err != nil {
+			return sdk.Output{}, err
+		}
+		for k, v := range g {
+			data[k] = v
+		}
+	}
+
+	// The template rendered to nothing — under the skip policy, give up on
+	// today rather than deliver an empty greeting. The rotation still moves
+	// on so tomorrow uses the next template.
+	if rendered && args.OnEmptyMessage == "skip" {
+		if msg, _ := message(args.recipients()[0]); strings.TrimSpace(msg) == "" {
+			state.LastSentDate = today
+			state.ScheduledFor = ""
+			state.MessageIndex = next.MessageIndex
+			return skip(clearPending(state), "skipped", SkipEmptyMessage, nil), nil
+		}
+	}
+
+	if args.ConfirmDelivery {
+		// The delivery step acknowledged the send — record it, without
+		// delivering again. Only now does metrics.sends count it, once
+		// however many times it was emitted.
+		if state.PendingSendAt != "" && state.DeliveryConfirmed {
+			next.Metrics = next.Metrics.record("sent")
+			return sdk.Output{
+				Data: map[string]any{
+					"status":      "confirmed",
+					"skip_reason": string(SkipDeliveryConfirmed),
+					"metrics":     next.Metrics,
+				},
+				State: saveState(next),
+			}, nil
+		}
+		// Otherwise leave the day open: the state is kept as it was before
+		// the send, so each retry builds the same greeting.
+		if state.PendingSendAt == "" {
+			state.PendingSendAt = now.Format(time.RFC3339)
+		}
+		state.DeliveryAttempts++
+		data["delivery_attempt"] = state.DeliveryAttempts
+		data["metrics"] = state.Metrics
+		data["next_send"] = nextSend(state, today)
+		return sdk.Output{
+			Data:          data,
+			State:         saveState(state),
+			ContinueToLLM: true,
+		}, nil
+	}
+
+	if remaining > 0 {
+		// More batches to go: record this one and keep the schedule, so the
+		// next run carries on with the rest.
+		state.BatchDate, state.BatchSent = today, greeted
+		state.Metrics = state.Metrics.record("sent")
+		data["metrics"] = state.Metrics
+		data["batch_remaining"] = remaining
+		data["next_send"] = nextSend(state, today)
+		return sdk.Output{
+			Data:          data,
+			State:         saveState(state),
+			ContinueToLLM: true,
+		}, nil
+	}
+
+	next.Metrics = next.Metrics.record("sent")
+	data["metrics"] = next.Metrics
+	data["next_send"] = nextSend(next, today)
+	return sdk.Output{
+		Data:          data,
+		State:         saveState(next),
+		ContinueToLLM: true,
+	}, nil
+}
+
+// nextSend is the data.next_send of a run that sends or has already sent
+// on today: a schedule s holds for a later day (under next_eligible), or
+// null when nothing is scheduled. Today's own schedule is spent.
+func nextSend(s goblinState, today string) any {
+	if len(s.ScheduledFor) < len("2006-01-02") || s.ScheduledFor[:10] <= today {
+		return nil
+	}
+	return s.ScheduledFor
+}
+
+// templateContext is what a template argument is executed against.
+type templateContext struct {
+	Name      string
+	TimeOfDay string
+	Date      string // local date, YYYY-MM-DD
+	Weekday   string // localised, as data.weekday_name
+	Streak    int
+	Occasion  string // e.g. "birthday"; empty on ordinary days
+}
+
+// SkipReason explains why a run did not send. Every skipped run reports one
+// in data.skip_reason.
+type SkipReason string
+
+const (
+	SkipLocked                  SkipReason = "locked"
+	SkipExpired                 SkipReason = "expired"
+	SkipAlreadySentToday        SkipReason = "already_sent_today"
+	SkipAlreadySentThisWeek     SkipReason = "already_sent_this_week"
+	SkipIntervalNotElapsed      SkipReason = "interval_not_elapsed"
+	SkipHoliday                 SkipReason = "holiday"
+	SkipDayOff                  SkipReason = "day_off"
+	SkipSchedulePicked          SkipReason = "schedule_just_picked"
+	SkipStaleScheduleRepicked   SkipReason = "stale_schedule_repicked"
+	SkipInvalidScheduleRepicked SkipReason = "invalid_schedule_repicked"
+	SkipOutOfWindowRepicked     SkipReason = "out_of_window_repicked"
+	SkipBeforeScheduledTime     SkipReason = "before_scheduled_time"
+	SkipTooLate                 SkipReason = "too_late"
+	SkipPickedInPast            SkipReason = "picked_in_past"
+	SkipEmptyMessage            SkipReason = "empty_message"
+	SkipSilentDay               SkipReason = "silent_day"
+	SkipAwaitingEvents          SkipReason = "awaiting_events"
+	SkipDeliveryConfirmed       SkipReason = "delivery_confirmed"
+	SkipDeliveryFailed          SkipReason = "delivery_failed"
+	SkipMinGap                  SkipReason = "min_gap"
+	SkipSnoozed                 SkipReason = "snoozed"
+	SkipCompleted               SkipReason = "completed"
+	SkipMonthlyCapReached       SkipReason = "monthly_cap_reached"
+)
+
+// skip builds the output of a run that doesn't send, adding status and
+// skip_reason to data (which may be nil).
+func skip(state goblinState, status string, reason SkipReason, data map[string]any) sdk.Output {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["status"] = status
+	data["skip_reason"] = string(reason)
+	state.Metrics = state.Metrics.record(status)
+	data["metrics"] = state.Metrics
+	return sdk.Output{Data: data, State: saveState(state)}
+}
+
+// maxPickAttempts bounds how many times pickSchedule re-rolls a time that
+// lands in a blackout range.
+const maxPickAttempts = 32
+
+// pickSchedule chooses a send time (YYYY-MM-DDTHH:MM) on the given date, over
+// the minutes of the window outside the blackout ranges, shaped by the
+// distribution argument. With a seed the draw is reproducible for that date;
+// otherwise it comes from randIntn. A fixed_time is returned as is, with no
+// draw at all, unless jitter_minutes spreads it over a band around the time.
+func pickSchedule(args goblinArgs, date string, randIntn func(int) int) (string, error) {
+	return pickScheduleFrom(args, date, 0, randIntn)
+}
+
+// minuteFrom returns the first whole minute of now's day (minutes after
+// midnight) at or after now.
+func minuteFrom(now time.Time) int {
+	m := now.Hour()*60 + now.Minute()
+	if now.Second() > 0 || now.Nanosecond() > 0 {
+		m++
+	}
+	return m
+}
+
+// errWindowPassed reports that nothing of a day's window is left to pick
+// from.
+var errWindowPassed = errors.New("pick schedule: the window has passed")
+
+// pickScheduleFrom is pickSchedule limited to the part of the window from
+// minute from of the day on. It returns errWindowPassed if that part holds
+// no open minute. A fixed_time isn't limited, and nor is a seeded pick,
+// which must come out the same on a date whenever it's made.
+func pickScheduleFrom(args goblinArgs, date string, from int, randIntn func(int) int) (string, error) {
+	if args.FixedTime != "" && args.JitterMinutes == 0 {
+		return date + "T" + args.FixedTime, nil
+	}
+	if args.seed != nil {
+		from = 0
+		h := fnv.New64a()
+		h.Write([]byte(date))
+		randIntn = rand.New(rand.NewSource(*args.seed ^ int64(h.Sum64()))).Intn
+	}
+	if args.FixedTime != "" {
+		m := args.fixedMinute() - args.JitterMinutes + randIntn(2*args.JitterMinutes+1)
+		return fmt.Sprintf("%sT%02d:%02d", date, m/60, m%60), nil
+	}
+	if day, err := time.ParseInLocation("2006-01-02", date, args.location()); err == nil {
+		args = args.windowOn(day)
+	}
+	start, end := args.window()
+	if end <= start {
+		// parseArgs rejects an empty top-level window, but a resolved
+		// sub-window could still end up with none; randIntn would panic.
+		return "", fmt.Errorf("pick schedule: window on %s is empty (%02d:%02d to %02d:%02d)", date, start/60, start%60, end/60, end%60)
+	}
+	// Draw over the window's minutes on the minute_granularity grid — with
+	// the default of 1, every minute of it.
+	first, n := args.grid()
+	if n == 0 {
+		return "", fmt.Errorf("pick schedule: window on %s holds no multiple of %d minutes", date, args.MinuteGranularity)
+	}
+	step := max(args.MinuteGranularity, 1)
+	if from > first {
+		skipped := (from - first + step - 1) / step
+		first, n = first+skipped*step, n-skipped
+		open := 0
+		for i := 0; i < n; i++ {
+			if !args.blackedOut(first + i*step) {
+				open++
+			}
+		}
+		if open == 0 {
+			return "", errWindowPassed
+		}
+	}
+	draw := func() int { return randIntn(n) }
+	if args.Distribution == "early_weighted" {
+		// The smaller of two uniform draws is triangular: most likely at
+		// the start of the window and never beyond its end.
+		draw = func() int { return min(randIntn(n), randIntn(n)) }
+	}
+	for i := 0; i < maxPickAttempts; i++ {
+		if m := first + draw()*step; !args.blackedOut(m) {
+			if args.Precision == "second" {
+				return fmt.Sprintf("%sT%02d:%02d:%02d", date, m/60, m%60, randIntn(60)), nil
+			}
+			return fmt.Sprintf("%sT%02d:%02d", date, m/60, m%60), nil
+		}
+	}
+	return "", fmt.Errorf("pick schedule: no time outside blackout_ranges after %d attempts", maxPickAttempts)
+}
+
+// solarEvent returns the instant of sunrise (or, with rise false, sunset) at
+// lat/lon on date's calendar day, by the sunrise equation with the standard
+// -0.833° altitude allowing for refraction and the sun's radius. It is good
+// to a minute or two. ok is false when the sun stays up or down all day.
+func solarEvent(date time.Time, lat, lon float64, rise bool) (t time.Time, ok bool) {
+	const rad = math.Pi / 180
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	n := math.Round(float64(noon.Unix())/86400 + 2440587.5 - 2451545) // days since J2000
+	meanNoon := n - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	longitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545 + meanNoon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*longitude*rad)
+	sinDecl := math.Sin(longitude*rad) * math.Sin(23.4397*rad)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDecl) / (math.Cos(lat*rad) * cosDecl)
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, false
+	}
+	offset := math.Acos(cosHour) / rad / 360
+	if rise {
+		offset = -offset
+	}
+	jd := transit + offset
+	return time.UnixMilli(int64(math.Round((jd - 2440587.5) * 86400000))).UTC(), true
+}
+
+// scheduledInstant turns a scheduled_for value into the instant it names in
+// the configured zone. A wall-clock time inside a spring-forward gap doesn't
+// exist, and time.Date may normalise it either side of the gap, so it is
+// shifted forward to the transition — the first moment after the gap. A
+// repeated fall-back hour is resolved per dst_ambiguous. An RFC 3339 value
+// already names an exact instant and is used as is.
+func (a goblinArgs) scheduledInstant(scheduledFor string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, scheduledFor); err == nil {
+		return t.In(a.location()), nil
+	}
+	wall, err := parseWallClock(scheduledFor)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse scheduled_for %q: %w", scheduledFor, err)
+	}
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, a.location())
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	switch start, end := t.ZoneBounds(); {
+	case got.Before(wall):
+		t = end
+	case got.After(wall):
+		t = start
+	}
+	return resolveAmbiguous(t, a.DSTAmbiguous), nil
+}
+
+// parseWallClock parses a compact scheduled_for, with or without seconds, as
+// a wall-clock time (in UTC, standing in for no zone at all).
+func parseWallClock(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02T15:04:05", v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02T15:04", v)
+}
+
+// formatWallClock writes t's wall-clock time as a compact scheduled_for,
+// including seconds only when there are any.
+func formatWallClock(t time.Time) string {
+	if t.Second() != 0 {
+		return t.Format("2006-01-02T15:04:05")
+	}
+	return t.Format("2006-01-02T15:04")
+}
+
+// minutesUntil returns the whole minutes from now until t, rounding a partial
+// minute up so the countdown only reaches 0 once t arrives. Never negative.
+func minutesUntil(now, t time.Time) int {
+	d := t.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Minute - 1) / time.Minute)
+}
+
+// formatSchedule writes a scheduled_for value in the configured time_format.
+func (a goblinArgs) formatSchedule(scheduledFor string) string {
+	if a.TimeFormat != "rfc3339" {
+		return scheduledFor
+	}
+	t, err := a.scheduledInstant(scheduledFor)
+	if err != nil {
+		return scheduledFor
+	}
+	return t.Format(time.RFC3339)
+}
+
+// sentState returns the state to persist after sending on today: the date is
+// recorded and the now-spent schedule is cleared.
+func sentState(s goblinState, today string) goblinState {
+	s.LastSentDate = today
+	s.ScheduledFor = ""
+	return s
+}
+
+// lastSendDate returns the local date (YYYY-MM-DD) of the most recent
+// salutation actually sent. LastSentDate also marks days given up on (too
+// late, an empty message, a failed delivery), so the date is read off
+// LastSentAt, falling back to LastSentDate for state from before it was kept.
+func (s goblinState) lastSendDate() string {
+	if _, err := time.Parse(time.RFC3339, s.LastSentAt); err == nil {
+		return s.LastSentAt[:len("2006-01-02")]
+	}
+	return s.LastSentDate
+}
+
+// clearPending returns s without a send awaiting confirmation.
+func clearPending(s goblinState) goblinState {
+	s.PendingSendAt = ""
+	s.DeliveryAttempts = 0
+	s.DeliveryConfirmed = false
+	return s
+}
+
+// appendHistory returns history with entry added at the end, keeping at most
+// the newest limit entries. history itself is left untouched.
+func appendHistory(history []historyEntry, entry historyEntry, limit int) []historyEntry {
+	if limit <= 0 {
+		return nil
+	}
+	out := append(append([]historyEntry(nil), history...), entry)
+	if len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	return out
+}
+
+// weekdayNamesByLanguage holds localised weekday names, indexed by
+// time.Weekday (Sunday first).
+var weekdayNamesByLanguage = map[string][7]string{
+	"en": {"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	"es": {"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+	"fr": {"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	"de": {"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+	"it": {"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+	"pt": {"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+}
+
+// weekdayName returns wd's name in language, falling back to English.
+func weekdayName(wd time.Weekday, language string) string {
+	names, ok := weekdayNamesByLanguage[strings.ToLower(language)]
+	if !ok {
+		names = weekdayNamesByLanguage["en"]
+	}
+	return names[wd]
+}
+
+// mood maps a time-of-day label and streak to a mood word. Streaks of a week
+// or more lift the mood.
+func mood(timeOfDay string, streak int) string {
+	onARoll := streak >= 7
+	switch timeOfDay {
+	case "morning":
+		if onARoll {
+			return "radiant"
+		}
+		return "cheerful"
+	case "afternoon":
+		if onARoll {
+			return "buoyant"
+		}
+		return "upbeat"
+	case "evening":
+		if onARoll {
+			return "glowing"
+		}
+		return "mellow"
+	default:
+		return "sleepy"
+	}
+}
+
+// nextStreak returns the streak after sending on today: one more than the
+// stored streak if the previous send was yesterday, unchanged if it was
+// earlier today, otherwise a fresh 1.
+func nextStreak(s goblinState, today string) int {
+	gap, err := daysBetween(s.lastSendDate(), today)
+	switch {
+	case err == nil && gap == 1:
+		return s.Streak + 1
+	case err == nil && gap == 0 && s.Streak > 0:
+		return s.Streak // a second send the same day
+	}
+	return 1
+}
+
+// daysBetween returns the number of calendar days from date a to date b, both
+// YYYY-MM-DD. It counts midnights crossed rather than elapsed hours, so 23:00
+// one day and 00:30 the next are one day apart.
+func daysBetween(a, b string) (int, error) {
+	from, err := time.Parse("2006-01-02", a)
+	if err != nil {
+		return 0, err
+	}
+	to, err := time.Parse("2006-01-02", b)
+	if err != nil {
+		return 0, err
+	}
+	// Both dates are parsed as UTC midnights, which are exactly 24h apart.
+	return int(to.Sub(from).Hours() / 24), nil
+}
+
+// variantIndex maps date (YYYY-MM-DD) to a variant in [0, count), counting
+// calendar days since the Unix epoch so consecutive days take consecutive
+// variants and wrap round after count days.
+func variantIndex(date string, count int) int {
+	days, err := daysBetween("1970-01-01", date)
+	if err != nil {
+		return 0
+	}
+	return ((days % count) + count) % count
+}
+
+// sameISOWeek reports whether dates a and b (YYYY-MM-DD) fall in the same
+// ISO week. An unparseable date, such as an empty one, matches nothing.
+func sameISOWeek(a, b string) bool {
+	ta, err := time.Parse("2006-01-02", a)
+	if err != nil {
+		return false
+	}
+	tb, err := time.Parse("2006-01-02", b)
+	if err != nil {
+		return false
+	}
+	ya, wa := ta.ISOWeek()
+	yb, wb := tb.ISOWeek()
+	return ya == yb && wa == wb
+}
+
+// resolveAmbiguous picks the occurrence of t's wall-clock time selected by
+// policy ("first" or "second") when a DST fall-back transition in t's location
+// makes that wall-clock time occur twice. Unambiguous times are returned as-is.
+func resolveAmbiguous(t time.Time, policy string) time.Time {
+	_, offset := t.Zone()
+	start, end := t.ZoneBounds()
+
+	// t is the second occurrence: the zone that ended at start had a larger
+	// offset, and t lies within that difference of the transition.
+	if !start.IsZero() {
+		_, prevOffset := start.Add(-time.Second).Zone()
+		if shift := time.Duration(prevOffset-offset) * time.Second; shift > 0 && t.Sub(start) < shift {
+			if policy == "first" {
+				return t.Add(-shift)
+			}
+			return t
+		}
+	}
+
+	// t is the first occurrence: the zone starting at end has a smaller
+	// offset, so the same wall-clock time comes round again after end.
+	if !end.IsZero() {
+		_, nextOffset := end.Zone()
+		if shift := time.Duration(offset-nextOffset) * time.Second; shift > 0 && end.Sub(t) <= shift {
+			if policy == "second" {
+				return t.Add(shift)
+			}
+			return t
+		}
+	}
+	return t
+}
+
+// nonce returns a fresh 64-bit hex token drawn from randIntn. Unlike anything
+// derived from state it differs on every send, so downstream systems can use
+// it for at-least-once dedupe of individual deliveries.
+func nonce(randIntn func(int) int) string {
+	var b strings.Builder
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&b, "%04x", randIntn(1<<16))
+	}
+	return b.String()
+}
+
+// idempotencyKey identifies one logical send — these recipients, on this date,
+// in this slot ("" outside sends_per_day) — as a 64-bit hex hash. Unlike the
+// nonce it is the same every time that send is emitted, so a delivery step
+// can drop repeats.
+func idempotencyKey(recipients, date, slot string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", recipients, date, slot)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// defaultMessage is the greeting rendered when pre-rendered output is asked
+// for but no messages are configured.
+const defaultMessage = "Good {time_of_day}, {name}!"
+
+// renderMessage substitutes the {name} and {time_of_day} placeholders in tmpl.
+func renderMessage(tmpl, name, timeOfDay string) string {
+	return strings.NewReplacer("{name}", name, "{time_of_day}", timeOfDay).Replace(tmpl)
+}
+
+// renderers turn a greeting into each of the formats a send can carry. A
+// renderer gets the message for a name and the name itself.
+var renderers = map[string]func(message func(string) (string, error), name string) (string, error){
+	"plain": func(message func(string) (string, error), name string) (string, error) {
+		return message(name)
+	},
+	"markdown": func(message func(string) (string, error), name string) (string, error) {
+		return message("**" + escapeMarkdown(name) + "**")
+	},
+	"html": func(message func(string) (string, error), name string) (string, error) {
+		// Render around a placeholder so the whole message can be escaped
+		// before the markup for the name goes in.
+		const mark = "\x00"
+		msg, err := message(mark)
+		if err != nil {
+			return "", err
+		}
+		return strings.ReplaceAll(html.EscapeString(msg), mark, "<strong>"+html.EscapeString(name)+"</strong>"), nil
+	},
+}
+
+// renderFormats returns the renderers' names, sorted.
+func renderFormats() []string {
+	return sortedKeys(renderers)
+}
+
+// sortedKeys returns m's keys in sorted order. Anything built from a map —
+// output, errors, warnings, hashes — ranges over these instead of the map,
+// so identical input gives byte-identical results.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeMarkdown backslash-escapes characters that would otherwise change
+// the emphasis of surrounding markdown.
+func escapeMarkdown(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`").Replace(s)
+}
+
+// icsEvent renders the pending send as a minimal iCalendar VEVENT, so users
+// can preview it on a calendar. The UID depends only on the date, so clients
+// update the same event on every run rather than adding duplicates.
+func icsEvent(args goblinArgs, date string, scheduledAt, now time.Time) string {
+	const stamp = "20060102T150405Z"
+	summary := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).
+		Replace("Salutation for " + strings.Join(args.recipients(), " & "))
+	return strings.Join([]string{
+		"BEGIN:VEVENT",
+		"UID:salutation-" + date + "@goblin-starter",
+		"DTSTAMP:" + now.UTC().Format(stamp),
+		"DTSTART:" + scheduledAt.UTC().Format(stamp),
+		"SUMMARY:" + summary,
+		"END:VEVENT",
+	}, "\r\n") + "\r\n"
+}
+
+// todayPlan summarises what the goblin intends to do today. It is emitted on
+// the first tick of the day, right after the schedule is picked, so operators
+// can see the plan before anything is sent.
+func todayPlan(args goblinArgs, today, scheduledFor string) map[string]any {
+	plan := map[string]any{
+		"date":          today,
+		"scheduled_for": scheduledFor,
+		"recipients":    args.recipients(),
+	}
+	if occasion := args.occasion(today); occasion != "" {
+		plan["occasion"] = occasion
+	}
+	return plan
+}
+
+// dayBoundaries holds the local hours at which each time_of_day label begins.
+type dayBoundaries struct {
+	MorningStart, AfternoonStart, EveningStart, NightStart int
+}
+
+// defaultBoundaries has no night: morning runs from midnight to noon.
+var defaultBoundaries = dayBoundaries{MorningStart: 0, AfternoonStart: 12, EveningStart: 17, NightStart: 24}
+
+func (a goblinArgs) boundaries() dayBoundaries {
+	return dayBoundaries{
+		MorningStart:   a.MorningStart,
+		AfternoonStart: a.AfternoonStart,
+		EveningStart:   a.EveningStart,
+		NightStart:     a.NightStart,
+	}
+}
+
+func (b dayBoundaries) validate() error {
+	bounds := []struct {
+		field string
+		hour  int
+		max   int
+	}{
+		{"morning_start", b.MorningStart, 23},
+		{"afternoon_start", b.AfternoonStart, 23},
+		{"evening_start", b.EveningStart, 23},
+		{"night_start", b.NightStart, 24},
+	}
+	for i, bd := range bounds {
+		if bd.hour < 0 || bd.hour > bd.max {
+			return fmt.Errorf("%s (%d) must be between 0 and %d", bd.field, bd.hour, bd.max)
+		}
+		if i > 0 && bd.hour <= bounds[i-1].hour {
+			return fmt.Errorf(
+				"%s (%d) must be greater than %s (%d)",
+				bd.field, bd.hour, bounds[i-1].field, bounds[i-1].hour,
+			)
+		}
+	}
+	return nil
+}
+
+// timeOfDayLabels holds the localised time_of_day labels, keyed by locale
+// and then by the English label dayPart returns.
+var timeOfDayLabels = map[string]map[string]string{
+	"es": {"morning": "mañana", "afternoon": "tarde", "evening": "noche", "night": "madrugada"},
+	"fr": {"morning": "matin", "afternoon": "après-midi", "evening": "soir", "night": "nuit"},
+	"de": {"morning": "Morgen", "afternoon": "Nachmittag", "evening": "Abend", "night": "Nacht"},
+	"it": {"morning": "mattina", "afternoon": "pomeriggio", "evening": "sera", "night": "notte"},
+	"pt": {"morning": "manhã", "afternoon": "tarde", "evening": "noite", "night": "madrugada"},
+}
+
+// greetingPhrases holds the localised greeting for each part of the day, keyed
+// by locale and then by English label. Locales missing here use English.
+var greetingPhrases = map[string]map[string]string{
+	"en": {"morning": "Good morning", "afternoon": "Good afternoon", "evening": "Good evening", "night": "Good night"},
+	"es": {"morning": "Buenos días", "afternoon": "Buenas tardes", "evening": "Buenas noches", "night": "Buenas noches"},
+	"fr": {"morning": "Bonjour", "afternoon": "Bon après-midi", "evening": "Bonsoir", "night": "Bonne nuit"},
+	"de": {"morning": "Guten Morgen", "afternoon": "Guten Tag", "evening": "Guten Abend", "night": "Gute Nacht"},
+	"it": {"morning": "Buongiorno", "afternoon": "Buon pomeriggio", "evening": "Buonasera", "night": "Buonanotte"},
+	"pt": {"morning": "Bom dia", "afternoon": "Boa tarde", "evening": "Boa noite", "night": "Boa noite"},
+}
+
+// dayTime describes the local hour of a send.
+type dayTime struct {
+	Label  string // as returned by timeOfDay
+	Phrase string // ready-made greeting, e.g. "Good morning"
+	Hour   int
+}
+
+// describeTimeOfDay returns the time_of_day label for hour along with the
+// matching greeting phrase, both in locale.
+func describeTimeOfDay(hour int, b dayBoundaries, locale string) dayTime {
+	phrases, ok := greetingPhrases[strings.ToLower(locale)]
+	if !ok {
+		phrases = greetingPhrases["en"]
+	}
+	return dayTime{
+		Label:  timeOfDay(hour, b, locale),
+		Phrase: phrases[dayPart(hour, b)],
+		Hour:   hour,
+	}
+}
+
+// timeOfDay returns a human-readable part of the day for the given local hour,
+// in locale. English, the default, is also the fallback for unknown locales.
+func timeOfDay(hour int, b dayBoundaries, locale string) string {
+	part := dayPart(hour, b)
+	if label, ok := timeOfDayLabels[strings.ToLower(locale)][part]; ok {
+		return label
+	}
+	return part
 }
 
-// timeOfDay returns a human-readable part of the day for the given UTC hour.
-func timeOfDay(hour int) string {
+// dayPart buckets the local hour into morning, afternoon, evening or night,
+// independent of language.
+func dayPart(hour int, b dayBoundaries) string {
 	switch {
-	case hour < 12:
+	case hour < b.MorningStart || hour >= b.NightStart:
+		return "night"
+	case hour < b.AfternoonStart:
 		return "morning"
-	case hour < 17:
+	case hour < b.EveningStart:
 		return "afternoon"
 	default:
 		return "evening"
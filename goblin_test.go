@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,6 +32,17 @@ func at(s string) time.Time {
 	return t.UTC()
 }
 
+// captureLogger records every log event, prefixed with its level.
+type captureLogger struct{ events []string }
+
+func (l *captureLogger) Debugf(format string, args ...any) {
+	l.events = append(l.events, "debug: "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Infof(format string, args ...any) {
+	l.events = append(l.events, "info: "+fmt.Sprintf(format, args...))
+}
+
 func inputWith(args map[string]any, state map[string]any) sdk.Input {
 	if args == nil {
 		args = map[string]any{}
@@ -72,6 +91,204 @@ func TestParseArgs_CustomValues(t *testing.T) {
 	}
 }
 
+func TestParseArgs_NumericRepresentations(t *testing.T) {
+	for _, v := range []any{float64(9), 9, int64(9), "9", " 9 "} {
+		a, err := parseArgs(map[string]any{"earliest_hour": v})
+		if err != nil {
+			t.Errorf("earliest_hour=%#v: unexpected error: %v", v, err)
+			continue
+		}
+		if a.EarliestHour != 9 {
+			t.Errorf("earliest_hour=%#v: EarliestHour = %d, want 9", v, a.EarliestHour)
+		}
+	}
+
+	// Applies to every integer argument, including optional ones.
+	a, err := parseArgs(map[string]any{"latest_minute": "15", "max_delay_minutes": "30"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.LatestMinute == nil || *a.LatestMinute != 15 || a.MaxDelayMinutes != 30 {
+		t.Errorf("LatestMinute = %v, MaxDelayMinutes = %d, want 15 and 30", a.LatestMinute, a.MaxDelayMinutes)
+	}
+
+	// And to the float ones.
+	a, err = parseArgs(map[string]any{"send_probability": "0.5", "latitude": " 51.5 ", "longitude": "-0.12"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.SendProbability != 0.5 || a.Latitude == nil || *a.Latitude != 51.5 || a.Longitude == nil || *a.Longitude != -0.12 {
+		t.Errorf("SendProbability = %v, Latitude = %v, Longitude = %v, want 0.5, 51.5 and -0.12", a.SendProbability, a.Latitude, a.Longitude)
+	}
+}
+
+func TestParseArgs_NonNumericString_ReturnsError(t *testing.T) {
+	for _, v := range []string{"nine", "9.5", ""} {
+		_, err := parseArgs(map[string]any{"earliest_hour": v})
+		if err == nil {
+			t.Errorf("earliest_hour=%q: expected error, got nil", v)
+			continue
+		}
+		if !strings.Contains(err.Error(), "earliest_hour") {
+			t.Errorf("error %q does not name earliest_hour", err)
+		}
+	}
+
+	// Floats, and values of the wrong JSON type, name the argument too.
+	for name, v := range map[string]any{"send_probability": "half", "latitude": "north", "dry_run": "yes"} {
+		_, err := parseArgs(map[string]any{name: v})
+		if err == nil || !strings.HasPrefix(err.Error(), name+":") {
+			t.Errorf("%s=%q: error = %v, want one naming %s", name, v, err, name)
+		}
+	}
+}
+
+func TestParseArgs_Aliases(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              map[string]any
+		earliest, latest int
+		warnings         []string
+	}{
+		{"aliases honoured", map[string]any{"start_hour": 9, "end_hour": "17"}, 9, 17, []string{
+			"end_hour is deprecated; use latest_hour",
+			"start_hour is deprecated; use earliest_hour",
+		}},
+		{"canonical wins", map[string]any{"start_hour": 6, "earliest_hour": 10}, 10, 20, []string{
+			"start_hour is deprecated and ignored because earliest_hour is set",
+		}},
+		{"no aliases", map[string]any{"earliest_hour": 10}, 10, 20, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseArgs(tt.raw)
+			if err != nil {
+				t.Fatalf("parseArgs: %v", err)
+			}
+			if a.EarliestHour != tt.earliest || a.LatestHour != tt.latest {
+				t.Errorf("window = %d–%d, want %d–%d", a.EarliestHour, a.LatestHour, tt.earliest, tt.latest)
+			}
+			if strings.Join(a.warnings, "|") != strings.Join(tt.warnings, "|") {
+				t.Errorf("warnings = %q, want %q", a.warnings, tt.warnings)
+			}
+		})
+	}
+
+	// The caller's map is left alone.
+	raw := map[string]any{"start_hour": 9}
+	if _, err := parseArgs(raw); err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if _, ok := raw["earliest_hour"]; ok || raw["start_hour"] != 9 {
+		t.Errorf("raw = %v, want it unchanged", raw)
+	}
+}
+
+func TestRun_DeprecatedAlias_Warns(t *testing.T) {
+	out, err := run(inputWith(map[string]any{"start_hour": 9}, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	warnings, _ := out.Data["warnings"].([]string)
+	if strings.Join(warnings, "|") != "start_hour is deprecated; use earliest_hour" {
+		t.Errorf("warnings = %v, want the deprecation", out.Data["warnings"])
+	}
+	if out.State["scheduled_for"] != "2026-02-22T09:00" {
+		t.Errorf("scheduled_for = %v, want the aliased 09:00 start", out.State["scheduled_for"])
+	}
+}
+
+func TestParseArgs_NameList(t *testing.T) {
+	a, err := parseArgs(map[string]any{"name": []any{"Alice", "Bob"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(a.recipients()) != "[Alice Bob]" {
+		t.Errorf("recipients = %v, want [Alice Bob]", a.recipients())
+	}
+	for _, bad := range [][]any{{}, {"Alice", float64(7)}} {
+		if _, err := parseArgs(map[string]any{"name": bad}); err == nil {
+			t.Errorf("name=%v: expected error, got nil", bad)
+		}
+	}
+}
+
+func TestParseArgs_Name_Sanitised(t *testing.T) {
+	tests := []struct {
+		raw  any
+		want string
+	}{
+		{"  Alice \t", "Alice"},
+		{"   ", "friend"}, // nothing left: the default
+		{"Zoë", "Zoë"},
+	}
+	for _, tt := range tests {
+		a, err := parseArgs(map[string]any{"name": tt.raw})
+		if err != nil {
+			t.Fatalf("name=%q: unexpected error: %v", tt.raw, err)
+		}
+		if a.Name != tt.want {
+			t.Errorf("name=%q: Name = %q, want %q", tt.raw, a.Name, tt.want)
+		}
+	}
+
+	rejected := []map[string]any{
+		{"name": "Alice\nBob"},
+		{"name": "Al\x07ice"},
+		{"name": []any{"Alice", "Bo\rb"}},
+		{"name": strings.Repeat("a", 101)},
+		{"name": "Alice", "max_name_length": 3},
+	}
+	for _, raw := range rejected {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%q: expected error, got nil", raw)
+		}
+	}
+	if _, err := parseArgs(map[string]any{"name": strings.Repeat("ä", 100)}); err != nil {
+		t.Errorf("100 characters: unexpected error: %v", err)
+	}
+}
+
+func TestParseArgs_BlankName_UsesDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  map[string]any
+	}{
+		{"absent", map[string]any{}},
+		{"empty", map[string]any{"name": ""}},
+		{"spaces", map[string]any{"name": "   "}},
+		{"mixed whitespace", map[string]any{"name": " \t\n "}},
+		{"null", map[string]any{"name": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parseArgs(tt.raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.Name != "friend" || a.Names != nil {
+				t.Errorf("Name = %q, Names = %q, want the friend default", a.Name, a.Names)
+			}
+			out, err := run(inputWith(tt.raw, map[string]any{"scheduled_for": "2026-02-22T09:00"}), at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("run: unexpected error: %v", err)
+			}
+			if out.Data["name"] != "friend" {
+				t.Errorf("data.name = %v, want friend", out.Data["name"])
+			}
+		})
+	}
+
+	// A blank recipient in a list is defaulted the same way.
+	a, err := parseArgs(map[string]any{"name": []any{"Alice", "  "}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(a.Names) != "[Alice friend]" {
+		t.Errorf("Names = %q, want [Alice friend]", a.Names)
+	}
+}
+
 func TestParseArgs_InvalidWindow(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -94,203 +311,5762 @@ func TestParseArgs_InvalidWindow(t *testing.T) {
 	}
 }
 
-// ── timeOfDay ─────────────────────────────────────────────────────────────────
+func TestParseArgs_Days(t *testing.T) {
+	a, err := parseArgs(map[string]any{"days": []any{"Mon", "tuesday", " FRI "}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"mon", "tue", "fri"}
+	if fmt.Sprint(a.Days) != fmt.Sprint(want) {
+		t.Errorf("Days = %v, want %v", a.Days, want)
+	}
 
-func TestTimeOfDay(t *testing.T) {
-	tests := []struct {
-		hour int
-		want string
+	for _, days := range [][]any{{"mon", "funday"}, {}} {
+		if _, err := parseArgs(map[string]any{"days": days}); err == nil {
+			t.Errorf("days=%v: expected error, got nil", days)
+		}
+	}
+}
+
+func TestParseArgs_HourRange(t *testing.T) {
+	cases := []struct {
+		name     string
+		earliest int
+		latest   int
+		field    string // offending field, or "" if valid
 	}{
-		{0, "morning"},
-		{7, "morning"},
-		{11, "morning"},
-		{12, "afternoon"},
-		{16, "afternoon"},
-		{17, "evening"},
-		{23, "evening"},
+		{"negative earliest", -1, 10, "earliest_hour"},
+		{"negative latest", -5, -1, "earliest_hour"},
+		{"earliest 24", 24, 25, "earliest_hour"},
+		{"latest 25", 8, 25, "latest_hour"},
+		{"earliest 0", 0, 10, ""},
+		{"earliest 23", 23, 24, ""},
+		{"latest 24 is midnight", 8, 24, ""},
+		{"full day", 0, 24, ""},
 	}
-	for _, tt := range tests {
-		t.Run(fmt.Sprintf("hour_%d", tt.hour), func(t *testing.T) {
-			got := timeOfDay(tt.hour)
-			if got != tt.want {
-				t.Errorf("timeOfDay(%d) = %q, want %q", tt.hour, got, tt.want)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseArgs(map[string]any{
+				"earliest_hour": float64(tc.earliest),
+				"latest_hour":   float64(tc.latest),
+			})
+			switch {
+			case tc.field == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.field != "" && err == nil:
+				t.Errorf("expected error naming %s, got nil", tc.field)
+			case tc.field != "" && !strings.Contains(err.Error(), tc.field):
+				t.Errorf("error %q does not name %s", err, tc.field)
 			}
 		})
 	}
 }
 
-// ── run ───────────────────────────────────────────────────────────────────────
+func TestParseArgs_LatestMinuteAtMidnight_Rejected(t *testing.T) {
+	if _, err := parseArgs(map[string]any{"latest_hour": float64(24), "latest_minute": float64(0)}); err == nil {
+		t.Error("expected error for latest_minute with latest_hour 24, got nil")
+	}
+}
 
-func TestRun_AlreadySentToday_Skips(t *testing.T) {
-	now := at("2026-02-22T14:00")
-	input := inputWith(
-		map[string]any{"name": "Alice"},
-		map[string]any{"last_sent_date": "2026-02-22", "scheduled_for": "2026-02-22T10:00"},
-	)
+func TestParseArgs_MinWindowMinutes(t *testing.T) {
+	// A one-hour window satisfies a 60-minute minimum exactly...
+	if _, err := parseArgs(map[string]any{
+		"earliest_hour":      float64(9),
+		"latest_hour":        float64(10),
+		"min_window_minutes": float64(60),
+	}); err != nil {
+		t.Errorf("unexpected error for window equal to minimum: %v", err)
+	}
+
+	// ...but not a 90-minute one.
+	if _, err := parseArgs(map[string]any{
+		"earliest_hour":      float64(9),
+		"latest_hour":        float64(10),
+		"min_window_minutes": float64(90),
+	}); err == nil {
+		t.Error("expected error for window narrower than min_window_minutes, got nil")
+	}
+}
 
-	out, err := run(input, now, fixedRand(0))
+func TestParseArgs_Timezone(t *testing.T) {
+	a, err := parseArgs(map[string]any{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=false when already sent today")
+	if a.location() != time.UTC {
+		t.Errorf("default location = %v, want UTC", a.location())
 	}
-}
-
-func TestRun_FirstRun_PicksScheduleAndSkips(t *testing.T) {
-	// fixedRand(2) → hour offset=2, minute=2 → send at EarliestHour+2:02 = 10:02
-	now := at("2026-02-22T08:00")
-	input := inputWith(map[string]any{"name": "Alice"}, nil)
 
-	out, err := run(input, now, fixedRand(2))
+	a, err = parseArgs(map[string]any{"timezone": "Asia/Tokyo"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=false on first run (no schedule yet)")
+	if a.location().String() != "Asia/Tokyo" {
+		t.Errorf("location = %v, want Asia/Tokyo", a.location())
 	}
-	if out.State["scheduled_for"] != "2026-02-22T10:02" {
-		t.Errorf("scheduled_for = %v, want 2026-02-22T10:02", out.State["scheduled_for"])
+
+	if _, err := parseArgs(map[string]any{"timezone": "Mars/Olympus_Mons"}); err == nil {
+		t.Error("expected error for unknown timezone, got nil")
 	}
 }
 
-func TestRun_ScheduledTimeNotYetReached_Skips(t *testing.T) {
-	now := at("2026-02-22T09:00")
-	input := inputWith(
-		map[string]any{"name": "Alice"},
-		map[string]any{"scheduled_for": "2026-02-22T14:30"},
-	)
+func TestParseArgs_Timezone_FixedOffset(t *testing.T) {
+	tests := []struct {
+		tz     string
+		name   string
+		offset int
+	}{
+		{"Asia/Kolkata", "Asia/Kolkata", 0}, // IANA names still come first
+		{"+05:30", "UTC+05:30", 5*3600 + 30*60},
+		{"-0800", "UTC-08:00", -8 * 3600},
+		{"UTC-8", "UTC-08:00", -8 * 3600},
+		{"gmt+2", "UTC+02:00", 2 * 3600},
+		{"UTC+14:00", "UTC+14:00", 14 * 3600},
+	}
+	for _, tt := range tests {
+		a, err := parseArgs(map[string]any{"timezone": tt.tz})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.tz, err)
+			continue
+		}
+		if got := a.location().String(); got != tt.name {
+			t.Errorf("%q: location = %s, want %s", tt.tz, got, tt.name)
+		}
+		if tt.offset != 0 {
+			if _, off := time.Date(2026, 2, 22, 12, 0, 0, 0, a.location()).Zone(); off != tt.offset {
+				t.Errorf("%q: offset = %ds, want %ds", tt.tz, off, tt.offset)
+			}
+		}
+	}
+
+	for _, tz := range []string{"+5:3", "UTC+15", "+05:60", "UTC+", "5:30", "+0x:00", "+123"} {
+		_, err := parseArgs(map[string]any{"timezone": tz})
+		if err == nil || !strings.Contains(err.Error(), "fixed offset") {
+			t.Errorf("%q: err = %v, want an error naming both forms", tz, err)
+		}
+	}
 
-	out, err := run(input, now, fixedRand(0))
+	// A fixed offset localises the schedule like any other zone.
+	out, err := run(inputWith(map[string]any{"name": "Alice", "timezone": "+05:30"}, nil), at("2026-02-22T01:00"), fixedRand(0), nil)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=false when scheduled time not yet reached")
+	if out.State["scheduled_for"] != "2026-02-22T08:00" || out.Data["scheduled_for_epoch_ms"] != at("2026-02-22T02:30").UnixMilli() {
+		t.Errorf("data = %v, state = %v; want 08:00 at +05:30", out.Data, out.State)
 	}
 }
 
-func TestRun_ScheduledTimeReached_Sends(t *testing.T) {
-	now := at("2026-02-22T14:30")
-	input := inputWith(
-		map[string]any{"name": "Alice"},
-		map[string]any{"scheduled_for": "2026-02-22T14:30"},
-	)
-
-	out, err := run(input, now, fixedRand(0))
+func TestParseArgs_DSTAmbiguous(t *testing.T) {
+	a, err := parseArgs(map[string]any{"dst_ambiguous": "second"})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if !out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=true when scheduled time reached")
+	if a.DSTAmbiguous != "second" {
+		t.Errorf("DSTAmbiguous = %q, want %q", a.DSTAmbiguous, "second")
 	}
-	if out.Data["name"] != "Alice" {
-		t.Errorf("data.name = %v, want Alice", out.Data["name"])
+
+	if _, err := parseArgs(map[string]any{"dst_ambiguous": "both"}); err == nil {
+		t.Error("expected error for unknown dst_ambiguous, got nil")
 	}
-	if out.Data["time_of_day"] != "afternoon" {
-		t.Errorf("data.time_of_day = %v, want afternoon", out.Data["time_of_day"])
+}
+
+func TestParseArgs_WindowPreset(t *testing.T) {
+	tests := []struct {
+		raw      map[string]any
+		earliest int
+		latest   int
+	}{
+		{map[string]any{"window_preset": "business_hours"}, 9, 17},
+		{map[string]any{"window_preset": "daytime"}, 8, 20},
+		{map[string]any{"window_preset": "evening"}, 17, 22},
+		{map[string]any{"window_preset": "anytime"}, 0, 24},
+		{map[string]any{"window_preset": "evening", "earliest_hour": float64(18), "latest_hour": float64(21)}, 18, 21},
+		{map[string]any{"window_preset": "business_hours", "latest_hour": "18"}, 9, 18},
 	}
-	if out.State["last_sent_date"] != "2026-02-22" {
-		t.Errorf("state.last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+	for _, tt := range tests {
+		a, err := parseArgs(tt.raw)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.raw, err)
+		}
+		if a.EarliestHour != tt.earliest || a.LatestHour != tt.latest {
+			t.Errorf("%v: window = %d–%d, want %d–%d", tt.raw, a.EarliestHour, a.LatestHour, tt.earliest, tt.latest)
+		}
 	}
-	// scheduled_for should be cleared after sending.
-	if _, hasSchedule := out.State["scheduled_for"]; hasSchedule {
-		t.Error("scheduled_for should be absent from state after sending")
+
+	if _, err := parseArgs(map[string]any{"window_preset": "night_owl"}); err == nil {
+		t.Error("expected error for unknown window_preset, got nil")
 	}
 }
 
-func TestRun_AfterSending_NewDayPicksNewSchedule(t *testing.T) {
-	// Simulate a new day after having sent yesterday.
-	now := at("2026-02-23T08:05")
-	input := inputWith(
-		map[string]any{"name": "Alice"},
-		map[string]any{"last_sent_date": "2026-02-22"},
-	)
+func TestParseArgs_Windows_Validated(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows map[string]any
+		want    string
+	}{
+		{"unknown weekday", map[string]any{"caturday": map[string]any{"earliest_hour": 10}}, "caturday"},
+		{"hour out of range", map[string]any{"sat": map[string]any{"latest_hour": 25}}, "latest_hour"},
+		{"ends before it starts", map[string]any{"sat": map[string]any{"earliest_hour": 12, "latest_hour": 10}}, "window end"},
+		{"end before default start", map[string]any{"sun": map[string]any{"latest_hour": 7}}, "window end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseArgs(map[string]any{"windows": tt.windows})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
 
-	out, err := run(input, now, fixedRand(0))
+	a, err := parseArgs(map[string]any{"windows": map[string]any{"Saturday": map[string]any{"earliest_hour": 10, "latest_hour": 12}}})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=false — new day, schedule just picked")
-	}
-	sched, _ := out.State["scheduled_for"].(string)
-	if len(sched) < 10 || sched[:10] != "2026-02-23" {
-		t.Errorf("scheduled_for = %q, expected date prefix 2026-02-23", sched)
+	if _, ok := a.Windows["sat"]; !ok {
+		t.Errorf("windows = %v, want the key normalised to sat", a.Windows)
 	}
 }
 
-func TestRun_ScheduleStaleFromYesterday_RepicksForToday(t *testing.T) {
-	// scheduled_for is from yesterday — must be repicked for today.
-	now := at("2026-02-23T09:00")
-	input := inputWith(
-		map[string]any{"name": "Alice"},
-		map[string]any{"scheduled_for": "2026-02-22T14:00"},
-	)
+func TestParseArgs_Windows_SpellingsOfOneDayResolveStably(t *testing.T) {
+	// "Mon" sorts before "monday", so monday's window wins every time.
+	raw := map[string]any{"windows": map[string]any{
+		"Mon":    map[string]any{"earliest_hour": 9, "latest_hour": 10},
+		"monday": map[string]any{"earliest_hour": 14, "latest_hour": 15},
+		"MONDAY": map[string]any{"earliest_hour": 6, "latest_hour": 7},
+	}}
+	for i := 0; i < 50; i++ {
+		a, err := parseArgs(raw)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if start, _ := a.forWeekday("mon").window(); start != 14*60 {
+			t.Fatalf("run %d: monday opens at minute %d, want %d", i, start, 14*60)
+		}
+	}
+}
 
-	out, err := run(input, now, fixedRand(0))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+func TestParseArgs_MonthlyNthWeekday(t *testing.T) {
+	tests := []struct {
+		nth  map[string]any
+		want []string // matching days, January–May 2026
+	}{
+		{map[string]any{"weekday": "monday", "n": 1}, []string{"2026-01-05", "2026-02-02", "2026-03-02", "2026-04-06", "2026-05-04"}},
+		{map[string]any{"weekday": "Wed", "n": 3}, []string{"2026-01-21", "2026-02-18", "2026-03-18", "2026-04-15", "2026-05-20"}},
+		{map[string]any{"weekday": "fri", "n": -1}, []string{"2026-01-30", "2026-02-27", "2026-03-27", "2026-04-24", "2026-05-29"}},
+		// Only January and May have a fifth Friday.
+		{map[string]any{"weekday": "fri", "n": 5}, []string{"2026-01-30", "2026-05-29"}},
 	}
-	if out.ContinueToLLM {
-		t.Error("expected ContinueToLLM=false — must repick schedule for new day")
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.nth), func(t *testing.T) {
+			a, err := parseArgs(map[string]any{"monthly_nth_weekday": tt.nth})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for d := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC); d.Month() <= time.May; d = d.AddDate(0, 0, 1) {
+				if a.dayAllowed(d) {
+					got = append(got, d.Format("2006-01-02"))
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("days = %v, want %v", got, tt.want)
+			}
+		})
 	}
-	sched, _ := out.State["scheduled_for"].(string)
-	if len(sched) < 10 || sched[:10] != "2026-02-23" {
-		t.Errorf("scheduled_for = %q, expected today's date prefix", sched)
+
+	for _, bad := range []map[string]any{{"weekday": "someday", "n": 1}, {"weekday": "mon", "n": 0}, {"weekday": "mon", "n": 6}} {
+		if _, err := parseArgs(map[string]any{"monthly_nth_weekday": bad}); err == nil {
+			t.Errorf("monthly_nth_weekday=%v: expected error, got nil", bad)
+		}
 	}
 }
 
-func TestRun_DefaultName_UsedWhenArgMissing(t *testing.T) {
-	now := at("2026-02-22T15:00")
-	input := inputWith(
-		nil, // no arguments
-		map[string]any{"scheduled_for": "2026-02-22T14:00"},
-	)
+// ── ArgsSchema ────────────────────────────────────────────────────────────────
 
-	out, err := run(input, now, fixedRand(0))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+func TestArgsSchema(t *testing.T) {
+	var schema struct {
+		Type       string                    `json:"type"`
+		Properties map[string]map[string]any `json:"properties"`
 	}
-	if out.Data["name"] != "friend" {
-		t.Errorf("data.name = %v, want friend (default)", out.Data["name"])
+	if err := json.Unmarshal(ArgsSchema(), &schema); err != nil {
+		t.Fatalf("unmarshal schema: %v", err)
+	}
+	if schema.Type != "object" {
+		t.Errorf("type = %q, want object", schema.Type)
 	}
-}
 
-func TestRun_InvalidArgs_ReturnsError(t *testing.T) {
-	now := at("2026-02-22T10:00")
-	input := inputWith(
-		map[string]any{"earliest_hour": float64(20), "latest_hour": float64(8)},
-		nil,
-	)
+	// Every argument parseArgs reads is described.
+	for _, name := range append(sortedKeys(numericArgs), "name", "timezone", "days", "skip_dates", "format", "seed") {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("schema is missing %q", name)
+		}
+	}
 
-	_, err := run(input, now, fixedRand(0))
-	if err == nil {
-		t.Error("expected error for invalid hour window, got nil")
+	checks := []struct {
+		prop, key string
+		want      any
+	}{
+		{"name", "default", "friend"},
+		{"timezone", "default", "UTC"},
+		{"earliest_hour", "default", float64(8)},
+		{"earliest_hour", "minimum", float64(0)},
+		{"earliest_hour", "maximum", float64(23)},
+		{"latest_hour", "default", float64(20)},
+		{"latest_hour", "maximum", float64(24)},
+		{"lock_ttl_minutes", "minimum", float64(1)},
+		{"send_probability", "type", "number"},
+		{"dry_run", "default", false},
+		{"format", "enum", []any{"plain", "markdown"}},
+	}
+	for _, c := range checks {
+		if got := schema.Properties[c.prop][c.key]; fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s.%s = %v, want %v", c.prop, c.key, got, c.want)
+		}
+	}
+	if !strings.Contains(fmt.Sprint(schema.Properties["weekday"]["enum"]), "mon") {
+		t.Errorf("weekday.enum = %v, want the weekday names", schema.Properties["weekday"]["enum"])
+	}
+	if _, ok := schema.Properties["max_delay_minutes"]["maximum"]; ok {
+		t.Error("max_delay_minutes should have no maximum")
 	}
 }
 
-func TestRun_ScheduleRespectsWindow(t *testing.T) {
-	// With earliest=9, latest=17 and fixedRand returning the max offset (7),
-	// the scheduled hour should be within [9, 17).
-	now := at("2026-02-22T08:00")
-	input := inputWith(
-		map[string]any{"earliest_hour": float64(9), "latest_hour": float64(17)},
-		nil,
-	)
+// ── ValidateArgs ──────────────────────────────────────────────────────────────
 
-	out, err := run(input, now, fixedRand(7))
+func TestValidateArgs(t *testing.T) {
+	config, err := ValidateArgs([]byte(`{"name": "Alice", "timezone": "Europe/Paris", "earliest_hour": "9"}`))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	var resolved map[string]any
+	if err := json.Unmarshal(config, &resolved); err != nil {
+		t.Fatalf("unmarshal config: %v", err)
+	}
+	if resolved["name"] != "Alice" || resolved["earliest_hour"] != float64(9) || resolved["latest_hour"] != float64(20) {
+		t.Errorf("config = %v, want the arguments resolved with defaults filled in", resolved)
+	}
+}
+
+func TestValidateArgs_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"not JSON", `{"name": `, "read arguments"},
+		{"not an object", `["Alice"]`, "read arguments"},
+		{"out of range", `{"earliest_hour": 30}`, "earliest_hour"},
+		{"unknown timezone", `{"timezone": "Mars/Olympus_Mons"}`, "Mars/Olympus_Mons"},
+		{"template names an unknown field", `{"template": "Hi {{.Nmae}}"}`, "can't evaluate field Nmae"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ValidateArgs([]byte(tt.args))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+			if config != nil {
+				t.Errorf("config = %s, want none alongside an error", config)
+			}
+		})
+	}
+}
+
+// ── resolveAmbiguous ──────────────────────────────────────────────────────────
+
+func TestResolveAmbiguous_FallBack(t *testing.T) {
+	// 2026-11-01 01:30 occurs twice in New York: first at EDT (-04:00), then
+	// again an hour later at EST (-05:00).
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("tz database unavailable: %v", err)
+	}
+	wall := time.Date(2026, 11, 1, 1, 30, 0, 0, loc)
+	first := time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC)
+	second := time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		policy string
+		want   time.Time
+	}{
+		{"first", first},
+		{"second", second},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			// Both occurrences must resolve the same way regardless of which
+			// one time.Date happened to return.
+			for _, in := range []time.Time{wall, first.In(loc), second.In(loc)} {
+				got := resolveAmbiguous(in, tc.policy)
+				if !got.Equal(tc.want) {
+					t.Errorf("resolveAmbiguous(%v, %q) = %v, want %v", in, tc.policy, got.UTC(), tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveAmbiguous_UnambiguousUnchanged(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("tz database unavailable: %v", err)
+	}
+	for _, in := range []time.Time{
+		time.Date(2026, 11, 1, 0, 59, 0, 0, loc),
+		time.Date(2026, 11, 1, 2, 0, 0, 0, loc),
+		time.Date(2026, 7, 1, 1, 30, 0, 0, loc),
+		at("2026-11-01T01:30"),
+	} {
+		got := resolveAmbiguous(in, "second")
+		if !got.Equal(in) {
+			t.Errorf("resolveAmbiguous(%v) = %v, want unchanged", in, got)
+		}
+	}
+}
+
+func TestParseArgs_Format(t *testing.T) {
+	if _, err := parseArgs(map[string]any{"format": "markdown"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := parseArgs(map[string]any{"format": "rtf"}); err == nil {
+		t.Error("expected error for unknown format, got nil")
+	}
+}
+
+func TestParseArgs_Channel_RejectsUnknown(t *testing.T) {
+	_, err := parseArgs(map[string]any{"channel": "pigeon"})
+	if err == nil {
+		t.Fatal("expected error for unknown channel, got nil")
+	}
+	if want := `channel must be "email", "push" or "sms", got "pigeon"`; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+}
+
+func TestParseArgs_Postprocess_RejectsUnknown(t *testing.T) {
+	_, err := parseArgs(map[string]any{"postprocess": []any{"uppercase_name", "add_tenant"}})
+	if err == nil {
+		t.Fatal("expected error for unknown postprocess, got nil")
+	}
+	if !strings.Contains(err.Error(), `"add_tenant"`) || !strings.Contains(err.Error(), "uppercase_name") {
+		t.Errorf("error = %q, want the unknown name and the known ones", err)
+	}
+}
+
+func TestParseArgs_Formats_RejectsUnknown(t *testing.T) {
+	_, err := parseArgs(map[string]any{"formats": []any{"plain", "rtf"}})
+	if err == nil {
+		t.Fatal("expected error for unknown format, got nil")
+	}
+	if !strings.Contains(err.Error(), `"rtf"`) || !strings.Contains(err.Error(), "html, markdown, plain") {
+		t.Errorf("error = %q, want the unknown format and the known ones", err)
+	}
+}
+
+func TestParseArgs_SendProbability(t *testing.T) {
+	for _, p := range []float64{0, 0.5, 1} {
+		if _, err := parseArgs(map[string]any{"send_probability": p}); err != nil {
+			t.Errorf("send_probability=%g: unexpected error: %v", p, err)
+		}
+	}
+	for _, p := range []float64{-0.1, 1.5} {
+		if _, err := parseArgs(map[string]any{"send_probability": p}); err == nil {
+			t.Errorf("send_probability=%g: expected error, got nil", p)
+		}
+	}
+}
+
+func TestParseArgs_Seed(t *testing.T) {
+	for _, seed := range []any{float64(42), "42", "-7"} {
+		a, err := parseArgs(map[string]any{"seed": seed})
+		if err != nil {
+			t.Errorf("seed=%v: unexpected error: %v", seed, err)
+			continue
+		}
+		if a.seed == nil {
+			t.Errorf("seed=%v: not resolved", seed)
+		}
+	}
+	for _, seed := range []any{"forty-two", float64(4.2), true} {
+		if _, err := parseArgs(map[string]any{"seed": seed}); err == nil {
+			t.Errorf("seed=%v: expected error, got nil", seed)
+		}
+	}
+}
+
+func TestParseArgs_MinuteWindow(t *testing.T) {
+	a, err := parseArgs(map[string]any{
+		"earliest_hour":   float64(8),
+		"earliest_minute": float64(30),
+		"latest_hour":     float64(9),
+		"latest_minute":   float64(15),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if start, end := a.window(); start != 8*60+30 || end != 9*60+16 {
+		t.Errorf("window = [%d, %d), want [510, 556)", start, end)
+	}
+
+	cases := []struct {
+		name string
+		args map[string]any
+	}{
+		{"single moment", map[string]any{
+			"earliest_hour": float64(8), "earliest_minute": float64(30),
+			"latest_hour": float64(8), "latest_minute": float64(30),
+		}},
+		{"end before start", map[string]any{
+			"earliest_hour": float64(8), "earliest_minute": float64(45),
+			"latest_hour": float64(8), "latest_minute": float64(30),
+		}},
+		{"exclusive hour at start", map[string]any{
+			"earliest_hour": float64(9), "earliest_minute": float64(15), "latest_hour": float64(9),
+		}},
+		{"minute out of range", map[string]any{"earliest_minute": float64(60)}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseArgs(tc.args); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseArgs_SkipDates_RejectsMalformed(t *testing.T) {
+	for _, d := range []string{"2026-13-01", "25/12/2026", "2026-12-25T00:00"} {
+		if _, err := parseArgs(map[string]any{"skip_dates": []any{d}}); err == nil {
+			t.Errorf("skip_dates=[%q]: expected error, got nil", d)
+		}
+	}
+}
+
+// ── parseState ────────────────────────────────────────────────────────────────
+
+func TestParseState_MigratesUnversionedState(t *testing.T) {
+	got, err := parseState(map[string]any{
+		"last_sent_date": "2026-02-21T14:30:00Z",
+		"scheduled_for":  "2026-02-22T10:00:00",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := goblinState{
+		Version:      stateVersion,
+		LastSentDate: "2026-02-21",
+		ScheduledFor: "2026-02-22T10:00",
+		Streak:       1,
+	}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("parseState = %+v, want %+v", got, want)
+	}
+	if err := got.validate(); err != nil {
+		t.Errorf("migrated state is invalid: %v", err)
+	}
+}
+
+func TestParseState_EmptyStateIsCurrentVersion(t *testing.T) {
+	got, err := parseState(map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Version != stateVersion || got.Streak != 0 {
+		t.Errorf("parseState({}) = %+v, want version %d and no streak", got, stateVersion)
+	}
+}
+
+func TestParseState_RejectsUnknownVersion(t *testing.T) {
+	for _, v := range []float64{stateVersion + 1, -1} {
+		if _, err := parseState(map[string]any{"version": v}); err == nil {
+			t.Errorf("version %v: expected error, got nil", v)
+		}
+	}
+}
+
+func TestRun_UnversionedStateWithoutSchedule_PicksCleanly(t *testing.T) {
+	// State from before scheduled_for existed: only the last send date.
+	input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"last_sent_date": "2026-02-21"})
+
+	out, err := run(input, at("2026-02-22T07:00"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipSchedulePicked) {
+		t.Errorf("skip_reason = %v, want %s", out.Data["skip_reason"], SkipSchedulePicked)
+	}
+	if out.State["scheduled_for"] != "2026-02-22T08:02" || out.State["version"] != float64(stateVersion) {
+		t.Errorf("state = %v, want today's schedule at version %d", out.State, stateVersion)
+	}
+
+	// The migrated streak carries on from yesterday's send.
+	out, err = run(inputWith(map[string]any{"name": "Alice"}, out.State), at("2026-02-22T08:02"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || out.Data["streak"] != 2 {
+		t.Errorf("data = %v, want a send with streak 2", out.Data)
+	}
+}
+
+func TestRun_WritesCurrentStateVersion(t *testing.T) {
+	out, err := run(inputWith(nil, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["version"] != float64(stateVersion) {
+		t.Errorf("state.version = %v, want %d", out.State["version"], stateVersion)
+	}
+}
+
+func TestParseState_DiscardsMistypedFields(t *testing.T) {
+	s, err := parseState(map[string]any{
+		"version":        stateVersion,
+		"scheduled_for":  float64(202602221000),
+		"last_sent_date": map[string]any{"when": "yesterday"},
+		"streak":         float64(4),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.ScheduledFor != "" || s.LastSentDate != "" {
+		t.Errorf("state = %+v, want the mistyped fields back at their defaults", s)
+	}
+	if s.Streak != 4 {
+		t.Errorf("streak = %d, want the well-typed field kept", s.Streak)
+	}
+	want := []string{
+		`state.last_sent_date: discarded unreadable value {"when":"yesterday"}`,
+		`state.scheduled_for: discarded unreadable value 202602221000`,
+	}
+	if fmt.Sprint(s.warnings) != fmt.Sprint(want) {
+		t.Errorf("warnings = %q, want %q", s.warnings, want)
+	}
+}
+
+func TestRun_MistypedState_RecoversWithWarning(t *testing.T) {
+	out, err := run(inputWith(nil, map[string]any{"scheduled_for": float64(900)}), at("2026-02-22T07:00"), fixedRand(60), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipSchedulePicked) || out.State["scheduled_for"] != "2026-02-22T09:00" {
+		t.Errorf("data = %v, want a fresh schedule picked", out.Data)
+	}
+	warnings, _ := out.Data["warnings"].([]string)
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "state.scheduled_for:") {
+		t.Errorf("warnings = %q, want one for state.scheduled_for", warnings)
+	}
+}
+
+func TestParseState_CompactRoundTrip(t *testing.T) {
+	want := goblinState{
+		Version:      stateVersion,
+		LastSentDate: "2026-02-22",
+		LastSentAt:   "2026-02-22T09:14:00Z",
+		Streak:       4,
+		History: []historyEntry{
+			{Date: "2026-02-21", TimeOfDay: "morning"},
+			{Date: "2026-02-22", TimeOfDay: "morning"},
+		},
+		Metrics: &runMetrics{Sends: 2, Skips: 17, Missed: 1},
+	}
+	compact := compactState(saveState(want))
+	if len(compact) != 1 || compact["_c"] == nil {
+		t.Fatalf("compact state = %v, want a single _c key", compact)
+	}
+	got, err := parseState(compact)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(saveState(got)) != fmt.Sprint(saveState(want)) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Plain JSON state written before compact_state was switched on still
+	// reads the same.
+	if legacy, err := parseState(saveState(want)); err != nil || fmt.Sprint(saveState(legacy)) != fmt.Sprint(saveState(want)) {
+		t.Errorf("legacy state = %+v, %v, want %+v", legacy, err, want)
+	}
+}
+
+func TestSaveState_OmitsEmptyValues(t *testing.T) {
+	// Empty collections and zero counters, nested or not, aren't written.
+	empty := goblinState{
+		Lock:          &stateLock{},
+		History:       []historyEntry{},
+		SentSlots:     []string{},
+		SlotSchedules: map[string]string{},
+		Metrics:       &runMetrics{},
+		BatchSent:     []string{},
+		Digest:        []digestDay{},
+	}
+	if got := saveState(empty); fmt.Sprint(got) != fmt.Sprint(map[string]any{"version": float64(stateVersion)}) {
+		t.Errorf("saveState = %v, want only the version", got)
+	}
+	parsed, err := parseState(saveState(empty))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defaults, _ := parseState(map[string]any{})
+	if fmt.Sprintf("%+v", parsed) != fmt.Sprintf("%+v", defaults) {
+		t.Errorf("reparsed = %+v, want the defaults %+v", parsed, defaults)
+	}
+
+	// Only the zero parts of a partly set value go; list entries stay put.
+	s := goblinState{
+		Metrics:       &runMetrics{Skips: 3},
+		SlotSchedules: map[string]string{"morning": "2026-02-22T08:10", "evening": ""},
+		Digest:        []digestDay{{Date: "2026-02-21"}, {Date: "2026-02-22", TimeOfDay: "morning", WouldSend: true}},
+	}
+	saved := saveState(s)
+	if got := fmt.Sprint(saved["metrics"]); got != "map[skips:3]" {
+		t.Errorf("metrics = %s, want map[skips:3]", got)
+	}
+	if got := fmt.Sprint(saved["slot_schedules"]); got != "map[morning:2026-02-22T08:10]" {
+		t.Errorf("slot_schedules = %s, want only morning", got)
+	}
+	if got := fmt.Sprint(saved["digest"]); got != "[map[date:2026-02-21] map[date:2026-02-22 time_of_day:morning would_send:true]]" {
+		t.Errorf("digest = %s, want both days", got)
+	}
+	back, err := parseState(saved)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *back.Metrics != *s.Metrics || back.SlotSchedules["morning"] != "2026-02-22T08:10" || fmt.Sprint(back.Digest) != fmt.Sprint(s.Digest) {
+		t.Errorf("reparsed = %+v, want %+v", back, s)
+	}
+}
+
+func TestRun_FreshState_IsMinimal(t *testing.T) {
+	out, err := run(inputWith(nil, nil), at("2026-02-22T08:00"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]any{
+		"version":       float64(stateVersion),
+		"created_date":  "2026-02-22",
+		"scheduled_for": "2026-02-22T08:02",
+		"metrics":       map[string]any{"skips": float64(1)},
+	}
+	if fmt.Sprint(out.State) != fmt.Sprint(want) {
+		t.Errorf("state = %v, want %v", out.State, want)
+	}
+}
+
+func TestParseState_CompactKeysBesideOverride(t *testing.T) {
+	raw := compactState(saveState(goblinState{LastSentDate: "2026-02-21", Streak: 2}))
+	raw["last_sent_date"] = "2026-02-22"
+	got, err := parseState(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.LastSentDate != "2026-02-22" || got.Streak != 2 {
+		t.Errorf("got %+v, want last_sent_date overridden and streak kept", got)
+	}
+}
+
+func TestParseState_CompactCorrupt_ReturnsError(t *testing.T) {
+	for _, v := range []any{"not base64!", "aGVsbG8=", 42} {
+		if _, err := parseState(map[string]any{"_c": v}); err == nil {
+			t.Errorf("_c=%v: expected error, got nil", v)
+		}
+	}
+}
+
+func TestRun_CompactState(t *testing.T) {
+	args := map[string]any{"name": "Alice", "compact_state": true}
+	out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T09:00"}), at("2026-02-22T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || len(out.State) != 1 || out.State["_c"] == nil {
+		t.Fatalf("state = %v, want a sent run saving only _c", out.State)
+	}
+
+	// The next run reads the compact state back: today is already sent.
+	out, err = run(inputWith(args, out.State), at("2026-02-22T11:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipAlreadySentToday) {
+		t.Errorf("data = %v, want already sent today", out.Data)
+	}
+}
+
+// ── MergeState ────────────────────────────────────────────────────────────────
+
+func TestMergeState_AppliesKnownFieldsAndIgnoresUnknown(t *testing.T) {
+	current := goblinState{LastSentDate: "2026-02-21", ScheduledFor: "2026-02-22T10:00", Streak: 3}
+
+	got, err := MergeState(current, map[string]any{
+		"last_sent_date": "2026-02-22",
+		"scheduled_for":  nil,
+		"paused":         true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := goblinState{Version: stateVersion, LastSentDate: "2026-02-22", Streak: 3}
+	if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("MergeState = %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeState_RejectsInvalidValues(t *testing.T) {
+	patches := []map[string]any{
+		{"last_sent_date": "yesterday"},
+		{"created_date": "last spring"},
+		{"scheduled_for": "2026-02-22 10:00"},
+		{"streak": float64(-1)},
+		{"streak": "many"},
+	}
+	for _, patch := range patches {
+		if _, err := MergeState(goblinState{}, patch); err == nil {
+			t.Errorf("MergeState(%v): expected error, got nil", patch)
+		}
+	}
+}
+
+func TestMergeState_SnoozeUntil_Validated(t *testing.T) {
+	if _, err := MergeState(goblinState{}, map[string]any{"snooze_until": "2026-3-1"}); err == nil {
+		t.Error("expected error for a malformed snooze_until patch, got nil")
+	}
+}
+
+// ── timeOfDay ─────────────────────────────────────────────────────────────────
+
+func TestTimeOfDay(t *testing.T) {
+	tests := []struct {
+		hour int
+		want string
+	}{
+		{0, "morning"},
+		{7, "morning"},
+		{11, "morning"},
+		{12, "afternoon"},
+		{16, "afternoon"},
+		{17, "evening"},
+		{23, "evening"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("hour_%d", tt.hour), func(t *testing.T) {
+			got := timeOfDay(tt.hour, defaultBoundaries, "en")
+			if got != tt.want {
+				t.Errorf("timeOfDay(%d) = %q, want %q", tt.hour, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfDay_CustomBoundaries(t *testing.T) {
+	b := dayBoundaries{MorningStart: 5, AfternoonStart: 12, EveningStart: 17, NightStart: 21}
+	tests := []struct {
+		hour int
+		want string
+	}{
+		{0, "night"},
+		{4, "night"},
+		{5, "morning"},
+		{11, "morning"},
+		{12, "afternoon"},
+		{17, "evening"},
+		{20, "evening"},
+		{21, "night"},
+		{23, "night"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("hour_%d", tt.hour), func(t *testing.T) {
+			if got := timeOfDay(tt.hour, b, "en"); got != tt.want {
+				t.Errorf("timeOfDay(%d) = %q, want %q", tt.hour, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfDay_Localized(t *testing.T) {
+	tests := []struct {
+		hour   int
+		locale string
+		want   string
+	}{
+		{9, "es", "mañana"},
+		{9, "fr", "matin"},
+		{9, "de", "Morgen"},
+		{14, "es", "tarde"},
+		{19, "fr", "soir"},
+		{9, "ES", "mañana"},
+		{9, "xx", "morning"}, // unknown locale falls back to English
+		{9, "", "morning"},
+	}
+	for _, tt := range tests {
+		if got := timeOfDay(tt.hour, defaultBoundaries, tt.locale); got != tt.want {
+			t.Errorf("timeOfDay(%d, %q) = %q, want %q", tt.hour, tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestRun_Locale_LocalizesTimeOfDay(t *testing.T) {
+	input := inputWith(
+		map[string]any{"name": "Ana", "locale": "es", "include_mood": true},
+		map[string]any{"scheduled_for": "2026-02-22T09:00"},
+	)
+
+	out, err := run(input, at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["time_of_day"] != "mañana" || out.Data["weekday_name"] != "domingo" {
+		t.Errorf("time_of_day = %v, weekday_name = %v, want mañana and domingo", out.Data["time_of_day"], out.Data["weekday_name"])
+	}
+	if out.Data["mood"] != mood("morning", 1) {
+		t.Errorf("mood = %v, want the morning mood", out.Data["mood"])
+	}
+}
+
+func TestParseArgs_DayBoundaries(t *testing.T) {
+	a, err := parseArgs(map[string]any{"morning_start": float64(5), "night_start": float64(21)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := dayBoundaries{MorningStart: 5, AfternoonStart: 12, EveningStart: 17, NightStart: 21}
+	if a.boundaries() != want {
+		t.Errorf("boundaries = %+v, want %+v", a.boundaries(), want)
+	}
+
+	cases := []struct {
+		name string
+		args map[string]any
+	}{
+		{"not increasing", map[string]any{"afternoon_start": float64(17)}},
+		{"night before evening", map[string]any{"night_start": float64(16)}},
+		{"negative", map[string]any{"morning_start": float64(-1)}},
+		{"past midnight", map[string]any{"evening_start": float64(24)}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseArgs(tc.args); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestDescribeTimeOfDay(t *testing.T) {
+	b := dayBoundaries{MorningStart: 5, AfternoonStart: 12, EveningStart: 17, NightStart: 21}
+	tests := []struct {
+		hour   int
+		locale string
+		want   dayTime
+	}{
+		{8, "en", dayTime{"morning", "Good morning", 8}},
+		{13, "en", dayTime{"afternoon", "Good afternoon", 13}},
+		{18, "en", dayTime{"evening", "Good evening", 18}},
+		{23, "en", dayTime{"night", "Good night", 23}},
+		{8, "de", dayTime{"Morgen", "Guten Morgen", 8}},
+		{18, "es", dayTime{"noche", "Buenas noches", 18}},
+		{13, "xx", dayTime{"afternoon", "Good afternoon", 13}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%d", tt.locale, tt.hour), func(t *testing.T) {
+			if got := describeTimeOfDay(tt.hour, b, tt.locale); got != tt.want {
+				t.Errorf("describeTimeOfDay(%d, %q) = %+v, want %+v", tt.hour, tt.locale, got, tt.want)
+			}
+		})
+	}
+}
+
+// ── mood ──────────────────────────────────────────────────────────────────────
+
+func TestMood(t *testing.T) {
+	tests := []struct {
+		timeOfDay string
+		streak    int
+		want      string
+	}{
+		{"morning", 1, "cheerful"},
+		{"morning", 7, "radiant"},
+		{"afternoon", 2, "upbeat"},
+		{"evening", 30, "glowing"},
+		{"night", 30, "sleepy"},
+	}
+	for _, tt := range tests {
+		if got := mood(tt.timeOfDay, tt.streak); got != tt.want {
+			t.Errorf("mood(%q, %d) = %q, want %q", tt.timeOfDay, tt.streak, got, tt.want)
+		}
+	}
+}
+
+// ── weekdayName ───────────────────────────────────────────────────────────────
+
+func TestWeekdayName(t *testing.T) {
+	tests := []struct {
+		wd       time.Weekday
+		language string
+		want     string
+	}{
+		{time.Tuesday, "es", "martes"},
+		{time.Sunday, "fr", "dimanche"},
+		{time.Friday, "DE", "Freitag"},
+		{time.Monday, "en", "Monday"},
+		{time.Monday, "tlh", "Monday"},
+	}
+	for _, tt := range tests {
+		if got := weekdayName(tt.wd, tt.language); got != tt.want {
+			t.Errorf("weekdayName(%v, %q) = %q, want %q", tt.wd, tt.language, got, tt.want)
+		}
+	}
+}
+
+// ── run ───────────────────────────────────────────────────────────────────────
+
+func TestRun_AlreadySentToday_Skips(t *testing.T) {
+	now := at("2026-02-22T14:00")
+	input := inputWith(
+		map[string]any{"name": "Alice"},
+		map[string]any{"last_sent_date": "2026-02-22", "scheduled_for": "2026-02-22T10:00"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false when already sent today")
+	}
+	if out.Data["status"] != "already_sent" {
+		t.Errorf("data.status = %v, want already_sent", out.Data["status"])
+	}
+	if v, ok := out.Data["next_send"]; !ok || v != nil {
+		t.Errorf("data.next_send = %v (present %v), want null once sent", v, ok)
+	}
+
+	// A schedule already held for a later day is the next send.
+	input = inputWith(
+		map[string]any{"name": "Alice", "repick_target": "next_eligible"},
+		map[string]any{"last_sent_date": "2026-02-22", "scheduled_for": "2026-02-23T09:00"},
+	)
+	out, err = run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "already_sent" || out.Data["next_send"] != "2026-02-23T09:00" {
+		t.Errorf("data = %v, want already_sent with next_send 2026-02-23T09:00", out.Data)
+	}
+}
+
+func TestRun_FirstRun_PicksScheduleAndSkips(t *testing.T) {
+	// fixedRand(2) → 2 minutes into the window → send at 08:02
+	now := at("2026-02-22T08:00")
+	input := inputWith(map[string]any{"name": "Alice"}, nil)
+
+	out, err := run(input, now, fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false on first run (no schedule yet)")
+	}
+	if out.State["scheduled_for"] != "2026-02-22T08:02" {
+		t.Errorf("scheduled_for = %v, want 2026-02-22T08:02", out.State["scheduled_for"])
+	}
+	if out.Data["status"] != "waiting" {
+		t.Errorf("data.status = %v, want waiting", out.Data["status"])
+	}
+	if out.Data["next_send"] != "2026-02-22T08:02" {
+		t.Errorf("data.next_send = %v, want 2026-02-22T08:02", out.Data["next_send"])
+	}
+}
+
+func TestRun_OutOfRangeRandom_IsClampedIntoWindow(t *testing.T) {
+	for _, v := range []int{10000, -5} {
+		out, err := run(inputWith(map[string]any{"name": "Alice"}, nil), at("2026-02-22T07:00"), fixedRand(v), nil)
+		if err != nil {
+			t.Fatalf("rand %d: unexpected error: %v", v, err)
+		}
+		scheduled, err := time.Parse("2006-01-02T15:04", out.State["scheduled_for"].(string))
+		if err != nil {
+			t.Fatalf("rand %d: scheduled_for = %v: %v", v, out.State["scheduled_for"], err)
+		}
+		if scheduled.Day() != 22 || scheduled.Hour() < 8 || scheduled.Hour() >= 20 {
+			t.Errorf("rand %d: scheduled_for = %v, want within 08:00–19:59 today", v, out.State["scheduled_for"])
+		}
+		if out.Data["random_clamped"] != true {
+			t.Errorf("rand %d: data.random_clamped = %v, want true", v, out.Data["random_clamped"])
+		}
+	}
+
+	out, err := run(inputWith(map[string]any{"name": "Alice"}, nil), at("2026-02-22T07:00"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["random_clamped"]; ok {
+		t.Error("data.random_clamped should be absent for in-range values")
+	}
+}
+
+func TestRun_LateFirstRun_MissesTodayInsteadOfSendingRetroactively(t *testing.T) {
+	// First run at 23:50; fixedRand(382) picks 14:22, long gone.
+	input := inputWith(map[string]any{"name": "Alice"}, nil)
+
+	out, err := run(input, at("2026-02-22T23:50"), fixedRand(382), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["status"] != "missed" || out.Data["skip_reason"] != string(SkipPickedInPast) {
+		t.Fatalf("data = %v, want a picked_in_past miss", out.Data)
+	}
+	if out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("last_sent_date = %v, want today marked as done", out.State["last_sent_date"])
+	}
+	if _, ok := out.State["scheduled_for"]; ok {
+		t.Errorf("scheduled_for = %v, want none", out.State["scheduled_for"])
+	}
+
+	// The next invocation the same night doesn't send either.
+	out, err = run(inputWith(map[string]any{"name": "Alice"}, out.State), at("2026-02-22T23:55"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Errorf("data = %v, want no retroactive send", out.Data)
+	}
+}
+
+func TestRun_FirstRun_PickAheadOfNow_Waits(t *testing.T) {
+	// First run mid-window: the pick is drawn from what's left of it, so
+	// fixedRand(142) lands 142 minutes after now.
+	out, err := run(inputWith(map[string]any{"name": "Alice"}, nil), at("2026-02-22T12:00"), fixedRand(142), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" || out.State["scheduled_for"] != "2026-02-22T14:22" {
+		t.Errorf("data = %v, state = %v, want waiting for 14:22", out.Data, out.State)
+	}
+}
+
+func TestRun_ImmediateFirstRun(t *testing.T) {
+	// fixedRand(382) picks 14:22 in the default 08:00–20:00 window, or 18:22
+	// when drawn from 12:00 on.
+	tests := []struct {
+		name      string
+		now       string
+		state     map[string]any
+		status    string
+		scheduled any
+	}{
+		{"inside the window sends now", "2026-02-22T12:00", nil, "sent", nil},
+		{"before the window schedules", "2026-02-22T06:00", nil, "waiting", "2026-02-22T14:22"},
+		{"after the window misses today", "2026-02-22T21:00", nil, "missed", nil},
+		{"not a first run waits for the pick", "2026-02-22T12:00",
+			map[string]any{"last_sent_date": "2026-02-21"}, "waiting", "2026-02-22T18:22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := inputWith(map[string]any{"name": "Alice", "immediate_first_run": true}, tt.state)
+			out, err := run(input, at(tt.now), fixedRand(382), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["status"] != tt.status {
+				t.Fatalf("status = %v, want %v (data = %v)", out.Data["status"], tt.status, out.Data)
+			}
+			if out.ContinueToLLM != (tt.status == "sent") {
+				t.Errorf("ContinueToLLM = %v, want %v", out.ContinueToLLM, tt.status == "sent")
+			}
+			if out.State["scheduled_for"] != tt.scheduled {
+				t.Errorf("scheduled_for = %v, want %v", out.State["scheduled_for"], tt.scheduled)
+			}
+		})
+	}
+}
+
+func TestPickSchedule_AvoidsBlackouts(t *testing.T) {
+	args, err := parseArgs(map[string]any{
+		"blackout_ranges": []any{
+			map[string]any{"start": 12, "end": 13},
+			map[string]any{"start": 18, "end": 20},
+		},
+	})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		got, err := pickSchedule(args, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if hm := got[11:]; (hm >= "12:00" && hm < "13:00") || hm >= "18:00" {
+			t.Fatalf("picked %s, inside a blackout", got)
+		}
+	}
+
+	// A roll inside a blackout is re-rolled: 12:00 and 12:30, then 13:00.
+	rolls := []int{240, 270, 300}
+	got, err := pickSchedule(args, "2026-02-22", func(int) int { v := rolls[0]; rolls = rolls[1:]; return v })
+	if err != nil || got != "2026-02-22T13:00" {
+		t.Errorf("pickSchedule = %q, %v; want 2026-02-22T13:00", got, err)
+	}
+
+	// A source stuck inside a blackout gives up with an error.
+	if _, err := pickSchedule(args, "2026-02-22", fixedRand(240)); err == nil {
+		t.Error("expected an error after repeated blacked-out rolls, got nil")
+	}
+}
+
+func TestPickSchedule_MidnightWindowStaysBeforeMidnight(t *testing.T) {
+	args, err := parseArgs(map[string]any{"earliest_hour": float64(20), "latest_hour": float64(24)})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+
+	// The largest roll the source can return lands on the window's last
+	// minute, 23:59 — never 24:00.
+	got, err := pickSchedule(args, "2026-02-22", func(n int) int { return n - 1 })
+	if err != nil || got != "2026-02-22T23:59" {
+		t.Errorf("pickSchedule = %q, %v; want 2026-02-22T23:59", got, err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		got, err := pickSchedule(args, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		picked, err := time.Parse("2006-01-02T15:04", got)
+		if err != nil {
+			t.Fatalf("picked %q, which doesn't parse: %v", got, err)
+		}
+		if picked.Hour() < 20 || picked.Format("2006-01-02") != "2026-02-22" {
+			t.Fatalf("picked %s, want 20:00–23:59 on the same day", got)
+		}
+	}
+}
+
+func TestPickSchedule_AllDayWindow(t *testing.T) {
+	args, err := parseArgs(map[string]any{"earliest_hour": float64(0), "latest_hour": float64(24)})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if n := args.openMinutes(); n != 24*60 {
+		t.Fatalf("openMinutes = %d, want all 1440", n)
+	}
+
+	// Every offset the source can return maps to its own minute of the day.
+	for offset := 0; offset < 24*60; offset++ {
+		got, err := pickSchedule(args, "2026-02-22", fixedRand(offset))
+		if err != nil {
+			t.Fatalf("offset %d: unexpected error: %v", offset, err)
+		}
+		if want := fmt.Sprintf("2026-02-22T%02d:%02d", offset/60, offset%60); got != want {
+			t.Fatalf("offset %d: picked %s, want %s", offset, got, want)
+		}
+	}
+
+	// Random picks reach every hour, from midnight to 23:xx.
+	hours := map[int]bool{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		got, err := pickSchedule(args, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		picked, err := time.Parse("2006-01-02T15:04", got)
+		if err != nil || picked.Format("2006-01-02") != "2026-02-22" {
+			t.Fatalf("picked %q, want a valid time on 2026-02-22 (%v)", got, err)
+		}
+		hours[picked.Hour()] = true
+	}
+	if len(hours) != 24 {
+		t.Errorf("picks covered %d hours, want all 24", len(hours))
+	}
+}
+
+func TestRun_AnytimeWindow_EndToEnd(t *testing.T) {
+	args := map[string]any{"name": "Alice", "window_preset": "anytime"}
+
+	// Picked on the midnight run, for the day's last minute.
+	out, err := run(inputWith(args, nil), at("2026-02-22T00:00"), fixedRand(24*60-1), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" || out.State["scheduled_for"] != "2026-02-22T23:59" {
+		t.Fatalf("data = %v, state = %v, want waiting for 23:59", out.Data, out.State)
+	}
+
+	out, err = run(inputWith(args, out.State), at("2026-02-22T23:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("data = %v, state = %v, want sent on the same day", out.Data, out.State)
+	}
+}
+
+func TestRun_FixedTime_SchedulesTheSameTimeDaily(t *testing.T) {
+	// 06:30 is outside the default 08:00–20:00 window, which fixed_time
+	// ignores.
+	args := map[string]any{"name": "Alice", "fixed_time": "06:30"}
+	r := rand.New(rand.NewSource(1))
+	for _, day := range []string{"2026-02-22", "2026-02-23", "2026-02-24"} {
+		out, err := run(inputWith(args, nil), at(day+"T00:00"), r.Intn, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", day, err)
+		}
+		if out.State["scheduled_for"] != day+"T06:30" {
+			t.Errorf("%s: scheduled_for = %v, want %sT06:30", day, out.State["scheduled_for"], day)
+		}
+		sent, err := run(inputWith(args, out.State), at(day+"T06:30"), r.Intn, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", day, err)
+		}
+		if !sent.ContinueToLLM {
+			t.Errorf("%s: data = %v, want a send at 06:30", day, sent.Data)
+		}
+	}
+}
+
+func TestParseArgs_FixedTime_RejectsMalformed(t *testing.T) {
+	for _, v := range []string{"24:00", "09:60", "9am", "9:00"} {
+		if _, err := parseArgs(map[string]any{"fixed_time": v}); err == nil {
+			t.Errorf("fixed_time=%q: expected error, got nil", v)
+		}
+	}
+}
+
+func TestPickSchedule_EmptyResolvedWindow_ReturnsError(t *testing.T) {
+	args, err := parseArgs(map[string]any{})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	// Slip a zero-width Sunday override past parseArgs' validation.
+	ten := 10
+	args.Windows = map[string]windowOverride{"sun": {EarliestHour: &ten, LatestHour: &ten}}
+	randIntn := func(n int) int {
+		if n <= 0 {
+			t.Fatalf("randIntn called with %d", n)
+		}
+		return 0
+	}
+	_, err = pickSchedule(args, "2026-02-22", randIntn)
+	if err == nil || !strings.Contains(err.Error(), "window on 2026-02-22 is empty") {
+		t.Fatalf("err = %v, want an empty-window error", err)
+	}
+	// Other days keep the default window.
+	if _, err := pickSchedule(args, "2026-02-23", randIntn); err != nil {
+		t.Errorf("Monday: unexpected error: %v", err)
+	}
+}
+
+func TestPickSchedule_Jitter_StaysInBand(t *testing.T) {
+	args, err := parseArgs(map[string]any{"fixed_time": "09:00", "jitter_minutes": 15})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	seen := map[string]bool{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		got, err := pickSchedule(args, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got < "2026-02-22T08:45" || got > "2026-02-22T09:15" {
+			t.Fatalf("picked %s, want within 08:45–09:15", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) != 31 {
+		t.Errorf("picked %d distinct minutes, want all 31 of the band", len(seen))
+	}
+
+	// Both edges of the band are reachable.
+	for offset, want := range map[int]string{0: "2026-02-22T08:45", 30: "2026-02-22T09:15"} {
+		if got, _ := pickSchedule(args, "2026-02-22", fixedRand(offset)); got != want {
+			t.Errorf("offset %d: picked %s, want %s", offset, got, want)
+		}
+	}
+}
+
+func TestPickSchedule_Jitter_Seeded(t *testing.T) {
+	args, err := parseArgs(map[string]any{"fixed_time": "09:00", "jitter_minutes": 15, "seed": 7})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	first, err := pickSchedule(args, "2026-02-22", rand.New(rand.NewSource(1)).Intn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, _ := pickSchedule(args, "2026-02-22", rand.New(rand.NewSource(2)).Intn)
+	if first != again {
+		t.Errorf("seeded picks differ: %s vs %s", first, again)
+	}
+}
+
+func TestParseArgs_Jitter_Validated(t *testing.T) {
+	tests := []map[string]any{
+		{"jitter_minutes": 15},
+		{"fixed_time": "00:10", "jitter_minutes": 15},
+		{"fixed_time": "23:50", "jitter_minutes": 10},
+		{"fixed_time": "09:00", "jitter_minutes": -1},
+	}
+	for _, raw := range tests {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%v: expected error, got nil", raw)
+		}
+	}
+	if _, err := parseArgs(map[string]any{"fixed_time": "23:50", "jitter_minutes": 9}); err != nil {
+		t.Errorf("jitter up to 23:59: unexpected error: %v", err)
+	}
+}
+
+func TestParseArgs_Anchor_Validated(t *testing.T) {
+	tests := []map[string]any{
+		{"anchor": "noon", "latitude": 51.5, "longitude": 0.0},
+		{"anchor": "sunrise", "latitude": 51.5},
+		{"anchor": "sunset", "longitude": 0.0},
+		{"anchor": "sunrise", "latitude": 91.0, "longitude": 0.0},
+		{"anchor": "sunrise", "latitude": 51.5, "longitude": -181.0},
+		{"anchor": "sunrise", "latitude": 51.5, "longitude": 0.0, "anchor_window_minutes": 0},
+	}
+	for _, raw := range tests {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%v: expected error, got nil", raw)
+		}
+	}
+}
+
+func TestSolarEvent(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	midsummer := time.Date(2026, 6, 21, 0, 0, 0, 0, london)
+	tests := []struct {
+		name     string
+		lat, lon float64
+		rise     bool
+		want     string // local HH:MM, or "" for none
+	}{
+		{"London sunrise", 51.5074, -0.1278, true, "04:43"},
+		{"London sunset", 51.5074, -0.1278, false, "21:21"},
+		{"Tromsø polar day", 69.6496, 18.956, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := solarEvent(midsummer, tt.lat, tt.lon, tt.rise)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("got %v, want no event", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("got no event")
+			}
+			want, _ := time.ParseInLocation("2006-01-02 15:04", "2026-06-21 "+tt.want, london)
+			if d := got.Sub(want); d < -3*time.Minute || d > 3*time.Minute {
+				t.Errorf("got %s, want within 3 minutes of %s", got.In(london).Format("15:04:05"), tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Anchor(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      map[string]any
+		now       string
+		rand      int
+		scheduled string
+		warned    bool
+	}{
+		{
+			name:      "opens at sunrise",
+			args:      map[string]any{"anchor": "sunrise", "timezone": "Europe/London", "latitude": 51.5074, "longitude": -0.1278},
+			now:       "2026-06-21T02:00",
+			rand:      0,
+			scheduled: "2026-06-21T04:43",
+		},
+		{
+			name:      "closes anchor_window_minutes later",
+			args:      map[string]any{"anchor": "sunrise", "timezone": "Europe/London", "latitude": 51.5074, "longitude": -0.1278},
+			now:       "2026-06-21T02:00",
+			rand:      59,
+			scheduled: "2026-06-21T05:42",
+		},
+		{
+			name:      "sunset",
+			args:      map[string]any{"anchor": "sunset", "timezone": "Europe/London", "latitude": 51.5074, "longitude": -0.1278, "anchor_window_minutes": 30},
+			now:       "2026-06-21T12:00",
+			rand:      29,
+			scheduled: "2026-06-21T21:50",
+		},
+		{
+			name:      "polar day falls back to the fixed window",
+			args:      map[string]any{"anchor": "sunrise", "timezone": "Europe/Oslo", "latitude": 69.6496, "longitude": 18.956},
+			now:       "2026-06-21T04:00",
+			rand:      382,
+			scheduled: "2026-06-21T14:22",
+			warned:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(inputWith(tt.args, nil), at(tt.now), fixedRand(tt.rand), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.State["scheduled_for"] != tt.scheduled {
+				t.Errorf("scheduled_for = %v, want %s", out.State["scheduled_for"], tt.scheduled)
+			}
+			warnings, _ := out.Data["warnings"].([]string)
+			if warned := len(warnings) > 0 && strings.HasPrefix(warnings[0], "anchor: no sunrise"); warned != tt.warned {
+				t.Errorf("warnings = %q, want an anchor warning: %v", warnings, tt.warned)
+			}
+		})
+	}
+}
+
+func TestPickSchedule_SecondPrecision(t *testing.T) {
+	args, err := parseArgs(map[string]any{"earliest_hour": float64(9), "latest_hour": float64(10), "precision": "second"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	seconds := map[int]bool{}
+	for i := 0; i < 500; i++ {
+		got, err := pickSchedule(args, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		picked, err := time.Parse("2006-01-02T15:04:05", got)
+		if err != nil {
+			t.Fatalf("picked %q: %v", got, err)
+		}
+		if picked.Hour() != 9 {
+			t.Fatalf("picked %s, want within 09:00:00–09:59:59", got)
+		}
+		seconds[picked.Second()] = true
+	}
+	if len(seconds) < 30 {
+		t.Errorf("only %d distinct seconds picked, want them spread across the minute", len(seconds))
+	}
+}
+
+func TestPickSchedule_MinuteGranularity(t *testing.T) {
+	for _, g := range []int{5, 15} {
+		// An odd window edge each side, and a blackout, to snap around.
+		args, err := parseArgs(map[string]any{
+			"minute_granularity": g,
+			"earliest_hour":      8,
+			"earliest_minute":    7,
+			"latest_hour":        10,
+			"latest_minute":      58,
+			"blackout_ranges":    []any{map[string]any{"start": 9, "end": 10}},
+			"distribution":       "early_weighted",
+		})
+		if err != nil {
+			t.Fatalf("granularity %d: parseArgs: %v", g, err)
+		}
+		r := rand.New(rand.NewSource(1))
+		seen := map[string]bool{}
+		for i := 0; i < 2000; i++ {
+			got, err := pickSchedule(args, "2026-02-22", r.Intn)
+			if err != nil {
+				t.Fatalf("granularity %d: unexpected error: %v", g, err)
+			}
+			wc, _ := parseWallClock(got)
+			m := wc.Hour()*60 + wc.Minute()
+			if m%g != 0 || m < 8*60+7 || m >= 10*60+58 || wc.Hour() == 9 {
+				t.Fatalf("granularity %d: picked %s, off the grid or outside the window", g, got)
+			}
+			seen[got[11:]] = true
+		}
+		// Both ends of the grid are reachable.
+		first, last := "08:10", "10:55"
+		if g == 15 {
+			first, last = "08:15", "10:45"
+		}
+		if !seen[first] || !seen[last] {
+			t.Errorf("granularity %d: picks %v, want %s and %s among them", g, seen, first, last)
+		}
+	}
+}
+
+func TestParseArgs_MinuteGranularity_Validated(t *testing.T) {
+	tests := []map[string]any{
+		{"minute_granularity": 0},
+		{"minute_granularity": 61},
+		{"minute_granularity": 7},
+		{"minute_granularity": 5, "precision": "second"},
+		{"minute_granularity": 5, "earliest_hour": 8, "earliest_minute": 1, "latest_hour": 8, "latest_minute": 4},
+		{"minute_granularity": 60, "earliest_hour": 8, "earliest_minute": 30, "latest_hour": 10, "blackout_ranges": []any{map[string]any{"start": 9, "end": 10}}},
+	}
+	for _, raw := range tests {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%v: expected error, got nil", raw)
+		}
+	}
+	for _, g := range []int{1, 2, 3, 4, 5, 6, 10, 12, 15, 20, 30, 60} {
+		if _, err := parseArgs(map[string]any{"minute_granularity": g}); err != nil {
+			t.Errorf("granularity %d: unexpected error: %v", g, err)
+		}
+	}
+}
+
+func TestPickSchedule_EarlyWeighted(t *testing.T) {
+	// sequence replays the same random values for each mode.
+	sequence := func() func(int) int {
+		values := []int{300, 60}
+		return func(int) int { v := values[0]; values = values[1:]; return v }
+	}
+	uniform, _ := parseArgs(map[string]any{})
+	early, _ := parseArgs(map[string]any{"distribution": "early_weighted"})
+
+	u, err := pickSchedule(uniform, "2026-02-22", sequence())
+	if err != nil {
+		t.Fatalf("uniform: unexpected error: %v", err)
+	}
+	e, err := pickSchedule(early, "2026-02-22", sequence())
+	if err != nil {
+		t.Fatalf("early_weighted: unexpected error: %v", err)
+	}
+	if u != "2026-02-22T13:00" || e != "2026-02-22T09:00" {
+		t.Errorf("uniform = %s, early_weighted = %s; want 13:00 and 09:00", u, e)
+	}
+
+	// Every draw stays inside the window and most land in its first half.
+	r := rand.New(rand.NewSource(1))
+	firstHalf := 0
+	for i := 0; i < 2000; i++ {
+		got, err := pickSchedule(early, "2026-02-22", r.Intn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if hm := got[11:]; hm < "08:00" || hm > "19:59" {
+			t.Fatalf("picked %s, outside the window", got)
+		} else if hm < "14:00" {
+			firstHalf++
+		}
+	}
+	if firstHalf < 1400 {
+		t.Errorf("%d of 2000 picks in the first half, want about 1500", firstHalf)
+	}
+}
+
+func TestParseArgs_BlackoutRanges(t *testing.T) {
+	ranges := func(pairs ...[2]int) map[string]any {
+		list := make([]any, len(pairs))
+		for i, p := range pairs {
+			list[i] = map[string]any{"start": p[0], "end": p[1]}
+		}
+		return map[string]any{"earliest_hour": 8, "latest_hour": 12, "blackout_ranges": list}
+	}
+	if _, err := parseArgs(ranges([2]int{9, 10})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for name, raw := range map[string]map[string]any{
+		"outside the window": ranges([2]int{6, 9}),
+		"empty range":        ranges([2]int{10, 10}),
+		"whole window":       ranges([2]int{8, 10}, [2]int{10, 12}),
+	} {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+func TestParseArgs_BlackoutRanges_ClippedToReplacedWindows(t *testing.T) {
+	// A 12–13 lunch blackout inside 08–20 needn't fit the windows that
+	// replace it on some days; only a window it covers entirely is an error.
+	lunch := []any{map[string]any{"start": 12, "end": 13}}
+	slot := func(name string, from, to int) map[string]any {
+		return map[string]any{"name": name, "earliest_hour": from, "latest_hour": to}
+	}
+	tests := []struct {
+		name string
+		args map[string]any
+		want string // "" for accepted
+	}{
+		{"weekday override beside it", map[string]any{"windows": map[string]any{"sat": map[string]any{"earliest_hour": 9, "latest_hour": 11}}}, ""},
+		{"weekday override overlapping it", map[string]any{"windows": map[string]any{"sat": map[string]any{"earliest_hour": 11, "latest_hour": 13}}}, ""},
+		{"weekday override inside it", map[string]any{"windows": map[string]any{"sat": map[string]any{"earliest_hour": 12, "latest_hour": 13}}}, "windows: sat: blackout_ranges cover"},
+		{"slots", map[string]any{"sends_per_day": 2, "slots": []any{slot("morning", 7, 10), slot("evening", 18, 21)}}, ""},
+		{"slot inside it", map[string]any{"sends_per_day": 2, "slots": []any{slot("lunch", 12, 13), slot("evening", 18, 21)}}, "slots: lunch: blackout_ranges cover"},
+		{"birthday_window", map[string]any{"birthday": "02-22", "birthday_window": map[string]any{"earliest_hour": 7, "latest_hour": 9}}, ""},
+		{"recurrence window inside it", map[string]any{"recurrences": []any{map[string]any{"rule": "weekly mon", "occasion": "monday", "window": map[string]any{"earliest_hour": 12, "latest_hour": 13}}}}, "recurrences: weekly mon: window: blackout_ranges cover"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.args["blackout_ranges"] = lunch
+			_, err := parseArgs(tt.args)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_FirstRun_EmitsTodayPlan(t *testing.T) {
+	now := at("2026-02-22T08:00")
+	input := inputWith(map[string]any{"name": "Alice"}, nil)
+
+	out, err := run(input, now, fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	plan, ok := out.Data["today_plan"].(map[string]any)
+	if !ok {
+		t.Fatalf("data.today_plan = %v, want a map", out.Data["today_plan"])
+	}
+	if plan["date"] != "2026-02-22" {
+		t.Errorf("today_plan.date = %v, want 2026-02-22", plan["date"])
+	}
+	if plan["scheduled_for"] != out.State["scheduled_for"] {
+		t.Errorf("today_plan.scheduled_for = %v, want %v", plan["scheduled_for"], out.State["scheduled_for"])
+	}
+	recipients, _ := plan["recipients"].([]string)
+	if len(recipients) != 1 || recipients[0] != "Alice" {
+		t.Errorf("today_plan.recipients = %v, want [Alice]", plan["recipients"])
+	}
+}
+
+func TestRun_ScheduledTimeNotYetReached_Skips(t *testing.T) {
+	now := at("2026-02-22T09:00")
+	input := inputWith(
+		map[string]any{"name": "Alice"},
+		map[string]any{"scheduled_for": "2026-02-22T14:30"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false when scheduled time not yet reached")
+	}
+	if out.Data["status"] != "waiting" {
+		t.Errorf("data.status = %v, want waiting", out.Data["status"])
+	}
+	if out.Data["next_send"] != "2026-02-22T14:30" {
+		t.Errorf("data.next_send = %v, want 2026-02-22T14:30", out.Data["next_send"])
+	}
+}
+
+func TestRun_WeeklyCadence_OncePerISOWeek(t *testing.T) {
+	args := map[string]any{"name": "Alice", "cadence": "weekly", "weekday": "monday"}
+	sentMonday := map[string]any{"last_sent_date": "2026-03-30"}
+
+	// Every later day of that ISO week, including those in April, is
+	// suppressed even with a due schedule.
+	for _, day := range []string{"2026-03-31", "2026-04-01", "2026-04-05"} {
+		state := map[string]any{"last_sent_date": "2026-03-30", "scheduled_for": day + "T09:00"}
+		out, err := run(inputWith(args, state), at(day+"T12:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", day, err)
+		}
+		if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipAlreadySentThisWeek) {
+			t.Errorf("%s: skip_reason = %v, want %s", day, out.Data["skip_reason"], SkipAlreadySentThisWeek)
+		}
+	}
+
+	// A non-Monday in the next week is a day off.
+	out, err := run(inputWith(args, map[string]any{"last_sent_date": "2026-03-30"}), at("2026-04-07T12:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "day_off" {
+		t.Errorf("tuesday: status = %v, want day_off", out.Data["status"])
+	}
+
+	// The next Monday sends again.
+	sentMonday["scheduled_for"] = "2026-04-06T09:00"
+	out, err = run(inputWith(args, sentMonday), at("2026-04-06T12:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Errorf("next monday: expected a send, got %v", out.Data)
+	}
+}
+
+func TestRun_Digest_SummarisesTheWeek(t *testing.T) {
+	args := map[string]any{
+		"name":          "Alice",
+		"cadence":       "weekly",
+		"weekday":       "sun",
+		"digest":        true,
+		"earliest_hour": 13,
+		"latest_hour":   14,
+		"windows":       map[string]any{"tue": map[string]any{"earliest_hour": 8, "latest_hour": 9}},
+		"skip_dates":    []any{"2026-02-18"},
+	}
+	state := map[string]any{"last_sent_date": "2026-02-15"}
+	var sent map[string]any
+	for day := 16; day <= 22; day++ {
+		for _, hour := range []int{7, 15} {
+			out, err := run(inputWith(args, state), time.Date(2026, 2, day, hour, 0, 0, 0, time.UTC), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("2026-02-%d %02d:00: unexpected error: %v", day, hour, err)
+			}
+			if out.ContinueToLLM {
+				if day != 22 {
+					t.Fatalf("2026-02-%d: unexpected send", day)
+				}
+				sent = out.Data
+			}
+			state = out.State
+		}
+	}
+	if sent == nil {
+		t.Fatal("no send on Sunday")
+	}
+	digest, _ := sent["digest"].([]digestDay)
+	want := []digestDay{
+		{"2026-02-16", "afternoon", true},
+		{"2026-02-17", "morning", true},
+		{"2026-02-18", "afternoon", false},
+		{"2026-02-19", "afternoon", true},
+		{"2026-02-20", "afternoon", true},
+		{"2026-02-21", "afternoon", true},
+		{"2026-02-22", "afternoon", true},
+	}
+	if fmt.Sprint(digest) != fmt.Sprint(want) {
+		t.Errorf("digest =\n%v\nwant\n%v", digest, want)
+	}
+	if _, ok := state["digest"]; ok {
+		t.Errorf("state.digest = %v, want it cleared by the send", state["digest"])
+	}
+}
+
+func TestRecordDigest_KeepsAWeek(t *testing.T) {
+	args, err := parseArgs(map[string]any{"digest": true})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	var days []digestDay
+	for d := 1; d <= 10; d++ {
+		day := time.Date(2026, 3, d, 9, 0, 0, 0, time.UTC)
+		if days, err = args.recordDigest(days, day, ""); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// A second run the same day leaves the entry as it was.
+		again, err := args.recordDigest(days, day.Add(time.Hour), "")
+		if err != nil || fmt.Sprint(again) != fmt.Sprint(days) {
+			t.Fatalf("second run on %s changed the digest: %v", day.Format("2006-01-02"), again)
+		}
+	}
+	if len(days) != digestDays || days[0].Date != "2026-03-04" || days[6].Date != "2026-03-10" {
+		t.Errorf("digest = %v, want 2026-03-04 to 2026-03-10", days)
+	}
+}
+
+func TestVariantIndex(t *testing.T) {
+	// 2026-02-22 is day 20506 of the Unix epoch; 20506 % 3 == 1.
+	tests := []struct {
+		date  string
+		count int
+		want  int
+	}{
+		{"2026-02-22", 3, 1},
+		{"2026-02-23", 3, 2},
+		{"2026-02-24", 3, 0}, // wraps round
+		{"2026-02-25", 3, 1},
+		{"2026-02-22", 1, 0},
+		{"1969-12-31", 3, 2}, // before the epoch still lands in range
+	}
+	for _, tt := range tests {
+		if got := variantIndex(tt.date, tt.count); got != tt.want {
+			t.Errorf("variantIndex(%q, %d) = %d, want %d", tt.date, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestRun_VariantCount_EmitsVariantIndex(t *testing.T) {
+	state := map[string]any{"scheduled_for": "2026-02-22T14:30"}
+
+	out, err := run(inputWith(map[string]any{"variant_count": 3}, state), at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["variant_index"] != 1 {
+		t.Errorf("variant_index = %v, want 1", out.Data["variant_index"])
+	}
+
+	out, err = run(inputWith(nil, state), at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["variant_index"]; ok {
+		t.Error("variant_index should be absent without variant_count")
+	}
+}
+
+func TestRun_IntervalDays_SendsEveryThirdDay(t *testing.T) {
+	args := map[string]any{"name": "Alice", "interval_days": 3}
+	state := map[string]any{}
+
+	// runDay runs at 07:00 (picking 08:00) and again at 08:00, returning
+	// whether the day sent.
+	runDay := func(date string) bool {
+		t.Helper()
+		sent := false
+		for _, hm := range []string{"T07:00", "T08:00"} {
+			out, err := run(inputWith(args, state), at(date+hm), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("%s%s: unexpected error: %v", date, hm, err)
+			}
+			state = out.State
+			sent = sent || out.ContinueToLLM
+		}
+		return sent
+	}
+
+	for _, tt := range []struct {
+		date string
+		want bool
+	}{
+		{"2026-02-27", true}, // day 0: no previous send
+		{"2026-02-28", false},
+		{"2026-03-01", false}, // across a month boundary
+		{"2026-03-02", true},  // day 3
+		{"2026-03-03", false},
+	} {
+		if got := runDay(tt.date); got != tt.want {
+			t.Errorf("%s: sent = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestSameISOWeek(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2026-03-30", "2026-04-05", true},  // Mon–Sun across a month boundary
+		{"2026-04-05", "2026-04-06", false}, // Sun → next Mon
+		{"2025-12-29", "2026-01-01", true},  // ISO week 1 of 2026 starts in 2025
+		{"", "2026-01-01", false},
+	}
+	for _, tt := range tests {
+		if got := sameISOWeek(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameISOWeek(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestScheduledInstant_SpringForwardGap(t *testing.T) {
+	tests := []struct {
+		zone, scheduledFor, want string // want is RFC 3339 in UTC
+	}{
+		// 02:00–03:00 doesn't exist in New York on 2026-03-08.
+		{"America/New_York", "2026-03-08T02:30", "2026-03-08T07:00:00Z"},
+		{"America/New_York", "2026-03-08T02:00", "2026-03-08T07:00:00Z"},
+		{"America/New_York", "2026-03-08T03:00", "2026-03-08T07:00:00Z"},
+		{"America/New_York", "2026-03-08T01:59", "2026-03-08T06:59:00Z"},
+		// 01:00–02:00 doesn't exist in London on 2026-03-29.
+		{"Europe/London", "2026-03-29T01:30", "2026-03-29T01:00:00Z"},
+	}
+	for _, tt := range tests {
+		a, err := parseArgs(map[string]any{"timezone": tt.zone})
+		if err != nil {
+			t.Fatalf("parseArgs: %v", err)
+		}
+		got, err := a.scheduledInstant(tt.scheduledFor)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tt.zone, tt.scheduledFor, err)
+		}
+		if s := got.UTC().Format(time.RFC3339); s != tt.want {
+			t.Errorf("%s %s: instant = %s, want %s", tt.zone, tt.scheduledFor, s, tt.want)
+		}
+	}
+}
+
+func TestRun_SpringForwardGap_SendsAfterTransition(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	args := map[string]any{"name": "Alice", "timezone": "America/New_York", "earliest_hour": 2, "latest_hour": 3}
+	state := map[string]any{"scheduled_for": "2026-03-08T02:30"}
+
+	// 01:45 EST is before the gap: still waiting.
+	out, err := run(inputWith(args, state), time.Date(2026, 3, 8, 1, 45, 0, 0, ny), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("01:45: expected to wait for the shifted send time")
+	}
+
+	// 03:00 EDT is the first moment after the gap: send.
+	out, err = run(inputWith(args, state), time.Date(2026, 3, 8, 3, 0, 0, 0, ny), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Errorf("03:00: expected a send, got %v", out.Data)
+	}
+}
+
+func TestRun_SendProbability_WinningRollSchedules(t *testing.T) {
+	args := map[string]any{"name": "Alice", "send_probability": 0.5}
+
+	// fixedRand(10): the roll (10) is under 50, so today is scheduled.
+	out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(10), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" || out.State["scheduled_for"] != "2026-02-22T08:10" {
+		t.Errorf("data = %v, state = %v; want waiting for 08:10", out.Data, out.State)
+	}
+	if _, ok := out.State["silent_date"]; ok {
+		t.Error("silent_date should not be set after a winning roll")
+	}
+}
+
+func TestRun_SendProbability_LosingRollSilencesTheDay(t *testing.T) {
+	args := map[string]any{"name": "Alice", "send_probability": 0.5}
+
+	// fixedRand(90): the roll (90) is over 50, so today is silent.
+	out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(90), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipSilentDay) {
+		t.Fatalf("data = %v, want a silent_day skip", out.Data)
+	}
+	if out.State["silent_date"] != "2026-02-22" {
+		t.Errorf("silent_date = %v, want 2026-02-22", out.State["silent_date"])
+	}
+
+	// Later runs the same day stay silent without rolling again, even with a
+	// random source that would now win.
+	rolled := false
+	randIntn := func(int) int { rolled = true; return 0 }
+	out, err = run(inputWith(args, out.State), at("2026-02-22T15:00"), randIntn, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["status"] != "silent" {
+		t.Errorf("data = %v, want status silent", out.Data)
+	}
+	if rolled {
+		t.Error("the day was rolled again")
+	}
+
+	// The next day rolls afresh.
+	out, err = run(inputWith(args, out.State), at("2026-02-23T07:00"), fixedRand(10), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" {
+		t.Errorf("next day: status = %v, want waiting", out.Data["status"])
+	}
+}
+
+func TestRun_ScheduleFingerprint(t *testing.T) {
+	fingerprint := func(args map[string]any) any {
+		t.Helper()
+		out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.Data["schedule_fingerprint"]
+	}
+
+	base := fingerprint(map[string]any{"name": "Alice", "days": []any{"mon", "tue"}})
+	if s, _ := base.(string); len(s) != 16 {
+		t.Fatalf("schedule_fingerprint = %v, want 16 hex digits", base)
+	}
+	same := []map[string]any{
+		{"name": "Alice", "days": []any{"mon", "tue"}},
+		{"name": "Bob", "days": []any{"tuesday", "Mon"}, "messages": []any{"hi"}},
+	}
+	for _, args := range same {
+		if got := fingerprint(args); got != base {
+			t.Errorf("%v: fingerprint = %v, want unchanged %v", args, got, base)
+		}
+	}
+	changed := []map[string]any{
+		{"name": "Alice", "days": []any{"mon", "tue"}, "earliest_hour": 9},
+		{"name": "Alice", "days": []any{"mon", "tue"}, "latest_minute": 30, "latest_hour": 19},
+		{"name": "Alice", "days": []any{"mon"}},
+		{"name": "Alice", "days": []any{"mon", "tue"}, "cadence": "weekly"},
+	}
+	for _, args := range changed {
+		if got := fingerprint(args); got == base {
+			t.Errorf("%v: fingerprint unchanged, want a new one", args)
+		}
+	}
+}
+
+func TestRun_TriggerCount_SendsOnceEventsAccumulate(t *testing.T) {
+	args := func(events int) map[string]any {
+		return map[string]any{"name": "Alice", "trigger_count": 3, "events": events}
+	}
+
+	// Two runs bring in 2 events: not enough to schedule.
+	state := map[string]any{}
+	for _, now := range []string{"2026-02-22T07:00", "2026-02-22T08:00"} {
+		out, err := run(inputWith(args(1), state), at(now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", now, err)
+		}
+		if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipAwaitingEvents) {
+			t.Fatalf("%s: data = %v, want an awaiting_events skip", now, out.Data)
+		}
+		state = out.State
+	}
+	if state["pending_events"] != float64(2) {
+		t.Fatalf("pending_events = %v, want 2", state["pending_events"])
+	}
+
+	// The third event reaches the threshold: a schedule is picked.
+	out, err := run(inputWith(args(1), state), at("2026-02-22T09:00"), fixedRand(30), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipSchedulePicked) {
+		t.Fatalf("data = %v, want schedule_just_picked", out.Data)
+	}
+
+	// At the scheduled time it sends and resets the counter.
+	out, err = run(inputWith(args(0), out.State), at("2026-02-22T09:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Fatalf("data = %v, want a send", out.Data)
+	}
+	if _, ok := out.State["pending_events"]; ok {
+		t.Errorf("pending_events = %v, want reset after sending", out.State["pending_events"])
+	}
+}
+
+func TestRun_Waiting_EmitsICSEvent(t *testing.T) {
+	args := map[string]any{"name": "Alice", "timezone": "America/New_York"}
+	state := map[string]any{"scheduled_for": "2026-02-22T14:30"}
+
+	// icsFields parses the VEVENT lines into a property map.
+	icsFields := func(out sdk.Output) map[string]string {
+		t.Helper()
+		block, ok := out.Data["ics_event"].(string)
+		if !ok {
+			t.Fatalf("data.ics_event = %v, want a string", out.Data["ics_event"])
+		}
+		lines := strings.Split(strings.TrimSuffix(block, "\r\n"), "\r\n")
+		if lines[0] != "BEGIN:VEVENT" || lines[len(lines)-1] != "END:VEVENT" {
+			t.Fatalf("ics_event = %q, want a VEVENT block", block)
+		}
+		fields := map[string]string{}
+		for _, line := range lines[1 : len(lines)-1] {
+			k, v, _ := strings.Cut(line, ":")
+			fields[k] = v
+		}
+		return fields
+	}
+
+	var uid string
+	for _, now := range []string{"2026-02-22T13:00", "2026-02-22T15:00"} { // UTC: 08:00 and 10:00 in New York
+		out, err := run(inputWith(args, state), at(now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", now, err)
+		}
+		if out.ContinueToLLM || out.State["scheduled_for"] != "2026-02-22T14:30" {
+			t.Fatalf("%s: the event altered the decision: data = %v, state = %v", now, out.Data, out.State)
+		}
+		fields := icsFields(out)
+		if fields["DTSTART"] != "20260222T193000Z" {
+			t.Errorf("%s: DTSTART = %q, want 20260222T193000Z", now, fields["DTSTART"])
+		}
+		if fields["SUMMARY"] == "" || !strings.Contains(fields["SUMMARY"], "Alice") {
+			t.Errorf("%s: SUMMARY = %q, want it to name Alice", now, fields["SUMMARY"])
+		}
+		if uid != "" && fields["UID"] != uid {
+			t.Errorf("%s: UID = %q, want stable %q", now, fields["UID"], uid)
+		}
+		uid = fields["UID"]
+	}
+}
+
+func TestRun_TimeFormatRFC3339_RoundTrips(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	args := map[string]any{"name": "Alice", "timezone": "America/New_York", "time_format": "rfc3339"}
+
+	// First run: fixedRand(2) → 08:02 New York time, written as RFC 3339.
+	out, err := run(inputWith(args, nil), time.Date(2026, 2, 22, 7, 0, 0, 0, ny), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const want = "2026-02-22T08:02:00-05:00"
+	if out.State["scheduled_for"] != want || out.Data["next_send"] != want {
+		t.Fatalf("scheduled_for = %v, next_send = %v, want %s", out.State["scheduled_for"], out.Data["next_send"], want)
+	}
+	if plan := out.Data["today_plan"].(map[string]any); plan["scheduled_for"] != want {
+		t.Errorf("today_plan.scheduled_for = %v, want %s", plan["scheduled_for"], want)
+	}
+
+	// A later run reads the RFC 3339 schedule back and keeps waiting.
+	out, err = run(inputWith(args, out.State), time.Date(2026, 2, 22, 8, 1, 0, 0, ny), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipBeforeScheduledTime) || out.State["scheduled_for"] != want {
+		t.Fatalf("data = %v, state = %v, want to keep waiting for %s", out.Data, out.State, want)
+	}
+
+	// And sends once it arrives.
+	out, err = run(inputWith(args, out.State), time.Date(2026, 2, 22, 8, 2, 0, 0, ny), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Errorf("data = %v, want a send at 08:02", out.Data)
+	}
+}
+
+func TestRun_TimeFormatSwitch_KeepsPendingSchedule(t *testing.T) {
+	// Stored as RFC 3339, now configured compact: the pending schedule is
+	// honoured and rewritten in the compact form.
+	args := map[string]any{"name": "Alice", "timezone": "America/New_York"}
+	state := map[string]any{"version": float64(stateVersion), "scheduled_for": "2026-02-22T19:02:00Z"} // 14:02 in New York
+
+	out, err := run(inputWith(args, state), at("2026-02-22T18:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipBeforeScheduledTime) || out.State["scheduled_for"] != "2026-02-22T14:02" {
+		t.Errorf("data = %v, state = %v, want waiting for 2026-02-22T14:02", out.Data, out.State)
+	}
+}
+
+func TestParseArgs_TimeFormat(t *testing.T) {
+	if _, err := parseArgs(map[string]any{"time_format": "rfc3339"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := parseArgs(map[string]any{"time_format": "unix"}); err == nil {
+		t.Error("expected error for unknown time_format, got nil")
+	}
+}
+
+func TestRun_History_AccumulatesAndTrims(t *testing.T) {
+	args := map[string]any{"name": "Alice", "history_limit": 2}
+	state := map[string]any{}
+	for _, send := range []string{"2026-02-22T09:00", "2026-02-23T14:00", "2026-02-24T18:00"} {
+		out, err := run(inputWith(args, state), at(send[:10]+"T07:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", send, err)
+		}
+		state = out.State
+		state["scheduled_for"] = send
+		out, err = run(inputWith(args, state), at(send), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", send, err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("%s: expected a send, got %v", send, out.Data)
+		}
+		state = out.State
+	}
+
+	// Three sends with a limit of two: the first has dropped off, and the
+	// repicks in between left the rest in order.
+	got := fmt.Sprint(state["history"])
+	want := "[map[date:2026-02-23 time_of_day:afternoon] map[date:2026-02-24 time_of_day:evening]]"
+	if got != want {
+		t.Errorf("state.history = %s, want %s", got, want)
+	}
+}
+
+func TestRun_History_SurfacedOnSend(t *testing.T) {
+	input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"scheduled_for": "2026-02-22T09:00"})
+
+	out, err := run(input, at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	history, ok := out.Data["history"].([]historyEntry)
+	if !ok || len(history) != 1 || history[0] != (historyEntry{Date: "2026-02-22", TimeOfDay: "morning"}) {
+		t.Errorf("data.history = %v, want today's morning send", out.Data["history"])
+	}
+}
+
+func TestRun_Birthday_OverridesRotation(t *testing.T) {
+	args := map[string]any{
+		"name":     "Alice",
+		"birthday": "02-22",
+		"messages": []any{"Hi {name}", "Hey {name}"},
+	}
+
+	out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T09:00", "message_index": 1}), at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["occasion"] != "birthday" || out.Data["message"] != "Happy birthday, Alice!" {
+		t.Errorf("occasion = %v, message = %v, want the birthday greeting", out.Data["occasion"], out.Data["message"])
+	}
+	if out.State["message_index"] != float64(1) {
+		t.Errorf("message_index = %v, want the rotation left at 1", out.State["message_index"])
+	}
+
+	// The next day is ordinary and picks up the rotation.
+	out, err = run(inputWith(args, map[string]any{"scheduled_for": "2026-02-23T09:00", "message_index": 1}), at("2026-02-23T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["occasion"]; ok || out.Data["message"] != "Hey Alice" {
+		t.Errorf("occasion = %v, message = %v, want the rotation's Hey Alice", out.Data["occasion"], out.Data["message"])
+	}
+}
+
+func TestRun_Birthday_InTodayPlan(t *testing.T) {
+	out, err := run(inputWith(map[string]any{"birthday": "02-22"}, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if plan := out.Data["today_plan"].(map[string]any); plan["occasion"] != "birthday" {
+		t.Errorf("today_plan.occasion = %v, want birthday", plan["occasion"])
+	}
+}
+
+func TestOccasion_LeapDayBirthday(t *testing.T) {
+	tests := []struct {
+		fallback, date string
+		want           string
+	}{
+		{"feb28", "2028-02-29", "birthday"}, // leap year: the real day
+		{"feb28", "2028-02-28", ""},
+		{"feb28", "2027-02-28", "birthday"},
+		{"feb28", "2027-03-01", ""},
+		{"mar1", "2027-03-01", "birthday"},
+		{"mar1", "2027-02-28", ""},
+	}
+	for _, tt := range tests {
+		a, err := parseArgs(map[string]any{"birthday": "02-29", "leap_day_fallback": tt.fallback})
+		if err != nil {
+			t.Fatalf("parseArgs: %v", err)
+		}
+		if got := a.occasion(tt.date); got != tt.want {
+			t.Errorf("%s, %s: occasion = %q, want %q", tt.fallback, tt.date, got, tt.want)
+		}
+
+		// A yearly 02-29 recurrence moves the same way.
+		rule := map[string]any{"rule": "yearly 02-29", "occasion": "birthday"}
+		a, err = parseArgs(map[string]any{"recurrences": []any{rule}, "leap_day_fallback": tt.fallback})
+		if err != nil {
+			t.Fatalf("parseArgs: %v", err)
+		}
+		if got := a.occasion(tt.date); got != tt.want {
+			t.Errorf("recurrence %s, %s: occasion = %q, want %q", tt.fallback, tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestParseArgs_Birthday_RejectsMalformed(t *testing.T) {
+	for _, b := range []string{"2-22", "02/22", "13-01", "02-30", "02-22-2000"} {
+		if _, err := parseArgs(map[string]any{"birthday": b}); err == nil {
+			t.Errorf("birthday=%q: expected error, got nil", b)
+		}
+	}
+}
+
+func TestRun_Recurrences(t *testing.T) {
+	args := map[string]any{
+		"name":     "Alice",
+		"messages": []any{"Hi {name}"},
+		"recurrences": []any{
+			map[string]any{"rule": "yearly 03-15", "occasion": "founding_day", "message": "Happy founding day, {name}!"},
+			map[string]any{"rule": "monthly 15", "occasion": "payday", "message": "Payday, {name}!"},
+			map[string]any{"rule": "weekly fri", "occasion": "friday", "message": "Happy Friday, {name}!"},
+		},
+	}
+	tests := []struct {
+		date              string
+		occasion, message any
+	}{
+		{"2026-03-15", "founding_day", "Happy founding day, Alice!"}, // also the 15th: the earlier rule wins
+		{"2026-04-15", "payday", "Payday, Alice!"},
+		{"2026-04-17", "friday", "Happy Friday, Alice!"},
+		{"2026-04-16", nil, "Hi Alice"},
+	}
+	for _, tt := range tests {
+		out, err := run(inputWith(args, map[string]any{"scheduled_for": tt.date + "T09:00"}), at(tt.date+"T09:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.date, err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("%s: data = %v, want a send", tt.date, out.Data)
+		}
+		if out.Data["occasion"] != tt.occasion || out.Data["message"] != tt.message {
+			t.Errorf("%s: occasion = %v, message = %v, want %v, %v", tt.date, out.Data["occasion"], out.Data["message"], tt.occasion, tt.message)
+		}
+	}
+
+	// A birthday on the same day takes precedence.
+	args["birthday"] = "04-17"
+	out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-04-17T09:00"}), at("2026-04-17T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["occasion"] != "birthday" {
+		t.Errorf("occasion = %v, want birthday", out.Data["occasion"])
+	}
+}
+
+func TestRun_OccasionWindows(t *testing.T) {
+	args := map[string]any{
+		"birthday":        "02-22",
+		"birthday_window": map[string]any{"earliest_hour": 7, "latest_hour": 9},
+		"recurrences": []any{
+			map[string]any{"rule": "weekly mon", "occasion": "monday", "window": map[string]any{"earliest_hour": 12}},
+			map[string]any{"rule": "weekly tue", "occasion": "tuesday"},
+		},
+	}
+	tests := []struct {
+		date        string
+		first, last string // earliest and latest pickable times
+	}{
+		{"2026-02-22", "07:00", "08:59"}, // the birthday
+		{"2026-02-23", "12:00", "19:59"}, // monday's window moves only its start
+		{"2026-02-24", "08:00", "19:59"}, // an occasion without a window
+		{"2026-02-25", "08:00", "19:59"}, // an ordinary day
+	}
+	for _, tt := range tests {
+		t.Run(tt.date, func(t *testing.T) {
+			var picks []string
+			for _, roll := range []int{0, 1 << 30} {
+				// A first run at midnight picks; the roll is clamped into the window.
+				out, err := run(inputWith(args, nil), at(tt.date+"T00:00"), fixedRand(roll), nil)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				picked, _ := out.State["scheduled_for"].(string)
+				if len(picked) < 16 {
+					t.Fatalf("scheduled_for = %v, want a pick", out.State["scheduled_for"])
+				}
+				picks = append(picks, picked[11:])
+			}
+			if picks[0] != tt.first || picks[1] > tt.last || picks[1] < tt.first {
+				t.Errorf("picks = %v, want from %s up to %s", picks, tt.first, tt.last)
+			}
+		})
+	}
+
+	// The birthday's time, picked before the window moved, is picked again.
+	out, err := run(inputWith(args, map[string]any{"version": float64(stateVersion), "scheduled_for": "2026-02-22T15:00"}), at("2026-02-22T06:00"), fixedRand(30), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != string(SkipOutOfWindowRepicked) || out.State["scheduled_for"] != "2026-02-22T07:30" {
+		t.Errorf("data = %v, state = %v; want a repick at 07:30", out.Data, out.State)
+	}
+}
+
+func TestRun_Inactivity_Reengages(t *testing.T) {
+	tests := []struct {
+		name              string
+		lastActivity      string
+		occasion, message any
+	}{
+		{"inactive", "2026-02-01", "reengagement", "We miss you, Alice!"},
+		{"exactly the threshold", "2026-02-08", nil, "Hi Alice"},
+		{"active", "2026-02-21", nil, "Hi Alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{
+				"name":               "Alice",
+				"messages":           []any{"Hi {name}"},
+				"inactivity_days":    14,
+				"last_activity_date": tt.lastActivity,
+			}
+			out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T09:00"}), at("2026-02-22T09:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM {
+				t.Fatalf("data = %v, want a send", out.Data)
+			}
+			if out.Data["occasion"] != tt.occasion || out.Data["message"] != tt.message {
+				t.Errorf("occasion = %v, message = %v, want %v, %v", out.Data["occasion"], out.Data["message"], tt.occasion, tt.message)
+			}
+		})
+	}
+
+	// The daily gate still holds: an inactive user isn't greeted twice a day.
+	args := map[string]any{"name": "Alice", "inactivity_days": 14, "last_activity_date": "2026-02-01"}
+	out, err := run(inputWith(args, map[string]any{"last_sent_date": "2026-02-22"}), at("2026-02-22T15:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipAlreadySentToday) {
+		t.Errorf("data = %v, want already_sent_today", out.Data)
+	}
+
+	if _, err := parseArgs(map[string]any{"last_activity_date": "last week"}); err == nil {
+		t.Error("malformed last_activity_date: expected error, got nil")
+	}
+}
+
+func TestParseArgs_Recurrences_Validated(t *testing.T) {
+	for _, rule := range []string{"yearly 02-30", "monthly 32", "monthly first", "weekly funday", "daily", "fortnightly mon"} {
+		_, err := parseArgs(map[string]any{"recurrences": []any{map[string]any{"rule": rule, "occasion": "x"}}})
+		if err == nil {
+			t.Errorf("rule %q: expected error, got nil", rule)
+		}
+	}
+	if _, err := parseArgs(map[string]any{"recurrences": []any{map[string]any{"rule": "weekly mon"}}}); err == nil {
+		t.Error("missing occasion: expected error, got nil")
+	}
+	if _, err := parseArgs(map[string]any{"recurrences": []any{map[string]any{"rule": "Weekly Monday", "occasion": "x"}}}); err != nil {
+		t.Errorf("Weekly Monday: unexpected error: %v", err)
+	}
+
+	for _, raw := range []map[string]any{
+		{"birthday_window": map[string]any{"earliest_hour": 25}},
+		{"birthday_window": map[string]any{"earliest_hour": 21}},
+		{"recurrences": []any{map[string]any{"rule": "weekly mon", "occasion": "x", "window": map[string]any{"earliest_hour": 10, "latest_hour": 9}}}},
+	} {
+		if _, err := parseArgs(raw); err == nil || !strings.Contains(err.Error(), "window") {
+			t.Errorf("%v: error = %v, want one naming the window", raw, err)
+		}
+	}
+}
+
+func TestRun_Force_SendsWhateverTheSchedule(t *testing.T) {
+	tests := []struct {
+		name  string
+		state map[string]any
+		now   string
+	}{
+		{"already sent today", map[string]any{"last_sent_date": "2026-02-22"}, "2026-02-22T15:00"},
+		{"outside the window", nil, "2026-02-22T23:30"},
+		{"before the schedule", map[string]any{"scheduled_for": "2026-02-22T18:00"}, "2026-02-22T09:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(inputWith(map[string]any{"name": "Alice", "force": true}, tt.state), at(tt.now), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM || out.Data["forced"] != true {
+				t.Fatalf("data = %v, want a forced send", out.Data)
+			}
+			if out.State["last_sent_date"] != "2026-02-22" {
+				t.Errorf("last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+			}
+			if _, ok := out.State["scheduled_for"]; ok {
+				t.Errorf("scheduled_for = %v, want cleared", out.State["scheduled_for"])
+			}
+
+			// Without force the normal gate resumes: nothing more today,
+			// and tomorrow schedules as usual.
+			args := map[string]any{"name": "Alice"}
+			later, err := run(inputWith(args, out.State), at("2026-02-22T23:45"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if later.ContinueToLLM {
+				t.Error("sent again the same day after the forced send")
+			}
+			tomorrow, err := run(inputWith(args, out.State), at("2026-02-23T07:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tomorrow.Data["skip_reason"] != string(SkipSchedulePicked) {
+				t.Errorf("next day: skip_reason = %v, want %s", tomorrow.Data["skip_reason"], SkipSchedulePicked)
+			}
+		})
+	}
+}
+
+func TestParseArgs_Force_StillValidates(t *testing.T) {
+	if _, err := parseArgs(map[string]any{"force": true, "earliest_hour": 30}); err == nil {
+		t.Error("expected a validation error with force set, got nil")
+	}
+}
+
+func TestRun_ResendOnNameChange(t *testing.T) {
+	state := map[string]any{"scheduled_for": "2026-02-22T09:00", "last_sent_date": "2026-02-21", "streak": float64(4)}
+	first, err := run(inputWith(map[string]any{"name": "Alcie", "resend_on_name_change": true}, state), at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.State["last_sent_name"] != "Alcie" {
+		t.Fatalf("last_sent_name = %v, want Alcie", first.State["last_sent_name"])
+	}
+
+	tests := []struct {
+		name   string
+		args   map[string]any
+		resent bool
+	}{
+		{"corrected name resends", map[string]any{"name": "Alice", "resend_on_name_change": true}, true},
+		{"same name stays suppressed", map[string]any{"name": "Alcie", "resend_on_name_change": true}, false},
+		{"off by default", map[string]any{"name": "Alice"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(inputWith(tt.args, first.State), at("2026-02-22T11:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM != tt.resent {
+				t.Fatalf("ContinueToLLM = %v, want %v (data = %v)", out.ContinueToLLM, tt.resent, out.Data)
+			}
+			if !tt.resent {
+				return
+			}
+			if out.Data["resent"] != true || out.Data["name"] != "Alice" || out.State["last_sent_name"] != "Alice" {
+				t.Errorf("data = %v, state = %v; want a resend recorded for Alice", out.Data, out.State)
+			}
+			if out.Data["streak"] != 5 {
+				t.Errorf("streak = %v, want 5 kept for the same-day resend", out.Data["streak"])
+			}
+		})
+	}
+}
+
+func TestRun_ConfirmDelivery_ReemitsUntilConfirmed(t *testing.T) {
+	args := map[string]any{"name": "Alice", "confirm_delivery": true}
+	state := map[string]any{"scheduled_for": "2026-02-22T10:00", "streak": float64(3), "last_sent_date": "2026-02-21"}
+
+	// The first send and every unconfirmed run after it emit the same
+	// greeting, without recording the day as sent.
+	var first sdk.Output
+	for i, now := range []string{"2026-02-22T10:05", "2026-02-22T10:20", "2026-02-22T14:00"} {
+		out, err := run(inputWith(args, state), at(now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", now, err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("%s: data = %v, want a send", now, out.Data)
+		}
+		if out.Data["delivery_attempt"] != i+1 {
+			t.Errorf("%s: delivery_attempt = %v, want %d", now, out.Data["delivery_attempt"], i+1)
+		}
+		if out.State["last_sent_date"] != "2026-02-21" {
+			t.Errorf("%s: last_sent_date = %v, want it unchanged until confirmed", now, out.State["last_sent_date"])
+		}
+		if i == 0 {
+			first = out
+		} else {
+			for _, k := range []string{"message", "time_of_day", "streak"} {
+				if out.Data[k] != first.Data[k] {
+					t.Errorf("%s: %s = %v, want %v as first sent", now, k, out.Data[k], first.Data[k])
+				}
+			}
+		}
+		state = out.State
+	}
+
+	// The delivery step acknowledges the send; the next run records it.
+	state["delivery_confirmed"] = true
+	out, err := run(inputWith(args, state), at("2026-02-22T14:15"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipDeliveryConfirmed) {
+		t.Fatalf("data = %v, want %s without a send", out.Data, SkipDeliveryConfirmed)
+	}
+	if out.State["last_sent_date"] != "2026-02-22" || out.State["streak"] != float64(4) {
+		t.Errorf("state = %v, want the send recorded with streak 4", out.State)
+	}
+	for _, k := range []string{"pending_send_at", "delivery_attempts", "delivery_confirmed"} {
+		if _, ok := out.State[k]; ok {
+			t.Errorf("%s = %v, want cleared", k, out.State[k])
+		}
+	}
+	// Three emits and the confirming run make one send, and no skips.
+	if got := fmt.Sprint(out.State["metrics"]); got != "map[sends:1]" {
+		t.Errorf("metrics = %s, want map[sends:1]", got)
+	}
+}
+
+func TestRun_ConfirmDelivery_GivesUpAfterMaxRetries(t *testing.T) {
+	args := map[string]any{"name": "Alice", "confirm_delivery": true, "max_retries": 2}
+	state := map[string]any{"scheduled_for": "2026-02-22T10:00"}
+
+	// One send and two retries...
+	for i := 0; i < 3; i++ {
+		out, err := run(inputWith(args, state), at("2026-02-22T11:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("attempt %d: unexpected error: %v", i+1, err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("attempt %d: data = %v, want a send", i+1, out.Data)
+		}
+		state = out.State
+	}
+
+	// ...then nothing more today.
+	out, err := run(inputWith(args, state), at("2026-02-22T11:15"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipDeliveryFailed) {
+		t.Fatalf("data = %v, want %s", out.Data, SkipDeliveryFailed)
+	}
+	later, err := run(inputWith(args, out.State), at("2026-02-22T16:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if later.ContinueToLLM {
+		t.Error("sent again the same day after giving up")
+	}
+	if _, ok := later.State["streak"]; ok {
+		t.Errorf("streak = %v, want no send recorded", later.State["streak"])
+	}
+}
+
+func TestRun_ConfirmDelivery_UnconfirmedSendExpiresWithTheDay(t *testing.T) {
+	args := map[string]any{"name": "Alice", "confirm_delivery": true}
+	state := map[string]any{
+		"scheduled_for":     "2026-02-21T10:00",
+		"pending_send_at":   "2026-02-21T10:00:00Z",
+		"delivery_attempts": float64(1),
+	}
+	out, err := run(inputWith(args, state), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipStaleScheduleRepicked) {
+		t.Errorf("data = %v, want yesterday's send dropped and today scheduled", out.Data)
+	}
+	if _, ok := out.State["pending_send_at"]; ok {
+		t.Errorf("pending_send_at = %v, want cleared", out.State["pending_send_at"])
+	}
+}
+
+func TestRun_Send_EchoesResolvedConfig(t *testing.T) {
+	args := map[string]any{
+		"name":           "Alice",
+		"timezone":       "Europe/Paris",
+		"earliest_hour":  "9",
+		"days":           []any{"Monday", "FRI"},
+		"language":       "fr",
+		"include_config": true,
+	}
+	state := map[string]any{"scheduled_for": "2026-02-23T10:00"}
+
+	out, err := run(inputWith(args, state), at("2026-02-23T09:00"), fixedRand(0), nil) // 10:00 in Paris
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config, ok := out.Data["config"].(map[string]any)
+	if !ok {
+		t.Fatalf("data.config = %v, want a map", out.Data["config"])
+	}
+	checks := map[string]string{
+		"name":          "Alice",
+		"timezone":      "Europe/Paris",
+		"earliest_hour": "9",         // given as a string, resolved to a number
+		"latest_hour":   "20",        // defaulted
+		"days":          "[mon fri]", // normalised
+		"cadence":       "daily",
+		"locale":        "fr", // follows language
+		"window":        "map[end:20:00 start:09:00]",
+	}
+	for key, want := range checks {
+		if got := fmt.Sprint(config[key]); got != want {
+			t.Errorf("config.%s = %s, want %s", key, got, want)
+		}
+	}
+	if _, ok := config["seed"]; ok {
+		t.Errorf("config.seed = %v, want an unset seed left out", config["seed"])
+	}
+	if _, ok := out.State["config"]; ok {
+		t.Error("config leaked into state")
+	}
+
+	// A seed of 0 is a seed, and echoed as one.
+	args["seed"] = 0
+	out, err = run(inputWith(args, state), at("2026-02-23T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config, _ := out.Data["config"].(map[string]any); fmt.Sprint(config["seed"]) != "0" {
+		t.Errorf("config.seed = %v, want 0", config["seed"])
+	}
+
+	// Without include_config the prompt doesn't carry it.
+	delete(args, "include_config")
+	out, err = run(inputWith(args, state), at("2026-02-23T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["config"]; ok {
+		t.Error("data.config should be absent unless include_config is set")
+	}
+}
+
+func TestRun_ExpiresOn(t *testing.T) {
+	// Expiry follows the configured zone: Tokyo is 9 hours ahead of UTC.
+	args := map[string]any{"name": "Alice", "timezone": "Asia/Tokyo", "expires_on": "2026-02-22"}
+	state := map[string]any{"scheduled_for": "2026-02-21T10:00"}
+	tests := []struct {
+		now     string
+		expired bool
+	}{
+		{"2026-02-21T00:00", false}, // 09:00 on the 21st in Tokyo
+		{"2026-02-21T15:30", true},  // 00:30 on the 22nd
+		{"2026-03-01T03:00", true},
+	}
+	for _, tt := range tests {
+		out, err := run(inputWith(args, state), at(tt.now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.now, err)
+		}
+		if got := out.Data["skip_reason"] == string(SkipExpired); got != tt.expired {
+			t.Errorf("%s: expired = %v, want %v (data = %v)", tt.now, got, tt.expired, out.Data)
+		}
+		if _, ok := out.State["scheduled_for"]; ok == tt.expired {
+			t.Errorf("%s: scheduled_for = %v, want cleared only once expired", tt.now, out.State["scheduled_for"])
+		}
+	}
+
+	// Force doesn't revive an expired campaign.
+	args["force"] = true
+	out, err := run(inputWith(args, nil), at("2026-02-23T03:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("forced run sent after expiry")
+	}
+}
+
+func TestParseArgs_ExpiresOn_RejectsMalformed(t *testing.T) {
+	for _, d := range []string{"2026-2-22", "22/02/2026", "2026-02-30"} {
+		if _, err := parseArgs(map[string]any{"expires_on": d}); err == nil {
+			t.Errorf("expires_on=%q: expected error, got nil", d)
+		}
+	}
+}
+
+func TestRun_SchedulingDecisions_EmitEpochMillis(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	args := map[string]any{"name": "Alice", "timezone": "America/New_York"}
+	now := time.Date(2026, 2, 22, 8, 0, 0, 0, ny)
+
+	// Picking: fixedRand(2) → 08:02 New York time.
+	out, err := run(inputWith(args, nil), now, fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := time.Date(2026, 2, 22, 8, 2, 0, 0, ny).UnixMilli()
+	if out.Data["scheduled_for_epoch_ms"] != want {
+		t.Errorf("picked: scheduled_for_epoch_ms = %v, want %d", out.Data["scheduled_for_epoch_ms"], want)
+	}
+
+	// Waiting on an existing schedule.
+	out, err = run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T14:30"}), now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = time.Date(2026, 2, 22, 14, 30, 0, 0, ny).UnixMilli()
+	if out.Data["scheduled_for_epoch_ms"] != want {
+		t.Errorf("waiting: scheduled_for_epoch_ms = %v, want %d", out.Data["scheduled_for_epoch_ms"], want)
+	}
+}
+
+func TestRun_Waiting_ReportsMinutesUntilSend(t *testing.T) {
+	input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"scheduled_for": "2026-02-22T14:30"})
+	tests := []struct {
+		now  time.Time
+		want int
+	}{
+		{time.Date(2026, 2, 22, 9, 0, 0, 0, time.UTC), 330},
+		{time.Date(2026, 2, 22, 14, 28, 30, 0, time.UTC), 2}, // 1m30s rounds up
+		{time.Date(2026, 2, 22, 14, 29, 59, 0, time.UTC), 1},
+	}
+	for _, tt := range tests {
+		out, err := run(input, tt.now, fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.now, err)
+		}
+		if out.Data["minutes_until_send"] != tt.want {
+			t.Errorf("%v: minutes_until_send = %v, want %d", tt.now, out.Data["minutes_until_send"], tt.want)
+		}
+		if out.ContinueToLLM || out.State["scheduled_for"] != "2026-02-22T14:30" {
+			t.Errorf("%v: the countdown changed the decision or state", tt.now)
+		}
+	}
+
+	// Once sent there is nothing to count down to.
+	sent := inputWith(map[string]any{"name": "Alice"}, map[string]any{"last_sent_date": "2026-02-22"})
+	out, err := run(sent, at("2026-02-22T15:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["minutes_until_send"]; ok {
+		t.Error("minutes_until_send should be absent once sent")
+	}
+}
+
+func TestRun_ScheduledTimeReached_Sends(t *testing.T) {
+	now := at("2026-02-22T14:30")
+	input := inputWith(
+		map[string]any{"name": "Alice"},
+		map[string]any{"scheduled_for": "2026-02-22T14:30"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=true when scheduled time reached")
+	}
+	if out.Data["status"] != "sent" {
+		t.Errorf("data.status = %v, want sent", out.Data["status"])
+	}
+	if out.Data["name"] != "Alice" {
+		t.Errorf("data.name = %v, want Alice", out.Data["name"])
+	}
+	if out.Data["time_of_day"] != "afternoon" {
+		t.Errorf("data.time_of_day = %v, want afternoon", out.Data["time_of_day"])
+	}
+	if v, ok := out.Data["next_send"]; !ok || v != nil {
+		t.Errorf("data.next_send = %v (present %v), want null with nothing left scheduled", v, ok)
+	}
+	if out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("state.last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+	}
+	// scheduled_for should be cleared after sending.
+	if _, hasSchedule := out.State["scheduled_for"]; hasSchedule {
+		t.Error("scheduled_for should be absent from state after sending")
+	}
+}
+
+func TestRun_Send_EmitsNonceFromRandomSource(t *testing.T) {
+	now := at("2026-02-22T14:30")
+	input := inputWith(nil, map[string]any{"scheduled_for": "2026-02-22T14:30"})
+
+	a, err := run(input, now, fixedRand(1), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := run(input, now, fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	nonceA, _ := a.Data["nonce"].(string)
+	nonceB, _ := b.Data["nonce"].(string)
+	if nonceA != "0001000100010001" {
+		t.Errorf("nonce = %q, want 0001000100010001", nonceA)
+	}
+	if nonceA == nonceB {
+		t.Errorf("nonce %q did not vary with the random source", nonceA)
+	}
+	if _, ok := a.State["nonce"]; ok {
+		t.Error("nonce must not be recorded in state")
+	}
+}
+
+func TestRun_MarkdownFormat_RendersMessage(t *testing.T) {
+	now := at("2026-02-22T09:00")
+	input := inputWith(
+		map[string]any{"name": "Alice_B", "format": "markdown"},
+		map[string]any{"scheduled_for": "2026-02-22T09:00"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["message"] != "Good morning, Alice_B!" {
+		t.Errorf("data.message = %v, want plain greeting", out.Data["message"])
+	}
+	if out.Data["markdown"] != `Good morning, **Alice\_B**!` {
+		t.Errorf("data.markdown = %v, want bolded, escaped name", out.Data["markdown"])
+	}
+	// format is formats' older form: the same rendering lands in
+	// data.rendered, with a nudge towards formats.
+	if got := fmt.Sprint(out.Data["rendered"]); got != `map[markdown:Good morning, **Alice\_B**!]` {
+		t.Errorf("data.rendered = %s, want just the markdown rendering", got)
+	}
+	warnings, _ := out.Data["warnings"].([]string)
+	if len(warnings) != 1 || warnings[0] != "format is deprecated; use formats" {
+		t.Errorf("warnings = %q, want the deprecation", warnings)
+	}
+}
+
+func TestRun_PlainFormat_OmitsRenderedMessage(t *testing.T) {
+	now := at("2026-02-22T09:00")
+	input := inputWith(nil, map[string]any{"scheduled_for": "2026-02-22T09:00"})
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["markdown"]; ok {
+		t.Error("data.markdown should be absent in plain format")
+	}
+}
+
+func TestRun_Messages_RotateAcrossDaysAndWrap(t *testing.T) {
+	args := map[string]any{
+		"name":     "Alice",
+		"messages": []any{"Hi {name}!", "Lovely {time_of_day}, {name}.", "Hey {name}"},
+	}
+	want := []string{"Hi Alice!", "Lovely morning, Alice.", "Hey Alice", "Hi Alice!"}
+	wantIndex := []any{float64(1), float64(2), nil, float64(1)}
+
+	state := map[string]any{}
+	for day, msg := range want {
+		date := fmt.Sprintf("2026-03-%02d", day+1)
+		state["scheduled_for"] = date + "T09:00"
+
+		out, err := run(inputWith(args, state), at(date+"T09:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("day %d: unexpected error: %v", day, err)
+		}
+		if out.Data["message"] != msg {
+			t.Errorf("day %d: data.message = %v, want %q", day, out.Data["message"], msg)
+		}
+		// message_index 0 is omitted from state once the list wraps.
+		if out.State["message_index"] != wantIndex[day] {
+			t.Errorf("day %d: state.message_index = %v, want %v", day, out.State["message_index"], wantIndex[day])
+		}
+		state = out.State
+	}
+}
+
+func TestRun_Messages_EmptyListKeepsPlainFields(t *testing.T) {
+	now := at("2026-02-22T09:00")
+	input := inputWith(
+		map[string]any{"name": "Alice", "messages": []any{}},
+		map[string]any{"scheduled_for": "2026-02-22T09:00"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["message"]; ok {
+		t.Errorf("data.message = %v, want absent without messages", out.Data["message"])
+	}
+	if out.Data["name"] != "Alice" || out.Data["time_of_day"] != "morning" {
+		t.Errorf("data = %v, want the plain name and time_of_day fields", out.Data)
+	}
+}
+
+func TestRun_MaxDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      string
+		wantSend bool
+	}{
+		{"just inside", "2026-02-22T09:29", true},
+		{"exactly at boundary", "2026-02-22T09:30", true},
+		{"just past", "2026-02-22T09:31", false},
+		{"well past", "2026-02-22T14:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := inputWith(
+				map[string]any{"max_delay_minutes": float64(30)},
+				map[string]any{"scheduled_for": "2026-02-22T09:00"},
+			)
+			out, err := run(input, at(tt.now), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM != tt.wantSend {
+				t.Errorf("ContinueToLLM = %v, want %v", out.ContinueToLLM, tt.wantSend)
+			}
+			// Sent or abandoned, today is done and must not be retried.
+			if out.State["last_sent_date"] != "2026-02-22" {
+				t.Errorf("last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+			}
+			if _, ok := out.State["scheduled_for"]; ok {
+				t.Error("scheduled_for should be cleared")
+			}
+		})
+	}
+}
+
+func TestRun_MaxDelay_UnlimitedByDefault(t *testing.T) {
+	input := inputWith(nil, map[string]any{"scheduled_for": "2026-02-22T09:00"})
+
+	out, err := run(input, at("2026-02-22T19:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected a late send to go out when max_delay_minutes is unset")
+	}
+}
+
+func TestRun_Streak(t *testing.T) {
+	tests := []struct {
+		name  string
+		state map[string]any
+		want  float64
+	}{
+		{"fresh start", map[string]any{}, 1},
+		{"consecutive day", map[string]any{"last_sent_date": "2026-02-21", "streak": float64(4)}, 5},
+		{"multi-day gap", map[string]any{"last_sent_date": "2026-02-19", "streak": float64(4)}, 1},
+		{"sent yesterday", map[string]any{"last_sent_date": "2026-02-21", "last_sent_at": "2026-02-21T14:00:00Z", "streak": float64(4)}, 5},
+		// Yesterday was given up on (too_late), so the last send was the 20th.
+		{"given-up day in between", map[string]any{"last_sent_date": "2026-02-21", "last_sent_at": "2026-02-20T14:00:00Z", "streak": float64(5)}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.state["scheduled_for"] = "2026-02-22T14:00"
+			out, err := run(inputWith(nil, tt.state), at("2026-02-22T14:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.State["streak"] != tt.want {
+				t.Errorf("state.streak = %v, want %v", out.State["streak"], tt.want)
+			}
+			if out.Data["streak"] != int(tt.want) {
+				t.Errorf("data.streak = %v, want %v", out.Data["streak"], tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Streak_CountsCalendarDaysNotHours(t *testing.T) {
+	// Sent at 23:00 on the 21st; the next send at 00:30 on the 22nd is only
+	// 90 minutes later but still the next calendar day.
+	args := map[string]any{"earliest_hour": float64(0), "latest_hour": float64(24)}
+	state := map[string]any{"last_sent_date": "2026-02-21", "streak": float64(1), "scheduled_for": "2026-02-22T00:30"}
+
+	out, err := run(inputWith(args, state), at("2026-02-22T00:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["streak"] != float64(2) {
+		t.Errorf("state.streak = %v, want 2", out.State["streak"])
+	}
+}
+
+func TestRun_IncludeMood_HighStreakMorning(t *testing.T) {
+	state := map[string]any{"last_sent_date": "2026-02-21", "streak": float64(9), "scheduled_for": "2026-02-22T09:00"}
+
+	out, err := run(inputWith(map[string]any{"include_mood": true}, state), at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["mood"] != "radiant" {
+		t.Errorf("data.mood = %v, want radiant", out.Data["mood"])
+	}
+
+	out, err = run(inputWith(nil, state), at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["mood"]; ok {
+		t.Error("data.mood should be absent unless include_mood is set")
+	}
+}
+
+func TestRun_Send_EmitsLocalisedWeekdayName(t *testing.T) {
+	// 2026-02-24 is a Tuesday.
+	input := inputWith(
+		map[string]any{"language": "es"},
+		map[string]any{"scheduled_for": "2026-02-24T09:00"},
+	)
+
+	out, err := run(input, at("2026-02-24T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["weekday_name"] != "martes" {
+		t.Errorf("data.weekday_name = %v, want martes", out.Data["weekday_name"])
+	}
+}
+
+func TestRun_Send_SpreadsGreetingAndHour(t *testing.T) {
+	input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"scheduled_for": "2026-02-22T14:00"})
+	out, err := run(input, at("2026-02-22T14:10"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["time_of_day"] != "afternoon" || out.Data["greeting"] != "Good afternoon" || out.Data["hour"] != 14 {
+		t.Errorf("data = %v, want afternoon / Good afternoon / 14", out.Data)
+	}
+}
+
+func TestRun_LabelSource_LateSend(t *testing.T) {
+	// Scheduled for 11:50 in the morning, but the run comes at 12:05.
+	state := map[string]any{"scheduled_for": "2026-02-22T11:50"}
+	tests := []struct {
+		source   string
+		want     string
+		greeting string
+		hour     int
+	}{
+		{"", "morning", "Good morning", 11},
+		{"scheduled", "morning", "Good morning", 11},
+		{"actual", "afternoon", "Good afternoon", 12},
+	}
+	for _, tt := range tests {
+		args := map[string]any{"name": "Alice"}
+		if tt.source != "" {
+			args["label_source"] = tt.source
+		}
+		out, err := run(inputWith(args, state), at("2026-02-22T12:05"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.source, err)
+		}
+		if out.Data["time_of_day"] != tt.want || out.Data["greeting"] != tt.greeting || out.Data["hour"] != tt.hour {
+			t.Errorf("%q: data = %v, want %s / %s / %d", tt.source, out.Data, tt.want, tt.greeting, tt.hour)
+		}
+	}
+
+	// A forced send has no schedule to go by.
+	out, err := run(inputWith(map[string]any{"name": "Alice", "force": true}, nil), at("2026-02-22T18:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["time_of_day"] != "evening" {
+		t.Errorf("forced: time_of_day = %v, want evening", out.Data["time_of_day"])
+	}
+}
+
+func TestRun_Template(t *testing.T) {
+	// 2026-02-22 is a Sunday; the prior send on the 21st makes this a streak of 2.
+	state := map[string]any{"scheduled_for": "2026-02-22T09:00", "last_sent_date": "2026-02-21", "streak": float64(1)}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"{{.Name}}", "Alice"},
+		{"{{.TimeOfDay}}", "morning"},
+		{"{{.Date}}", "2026-02-22"},
+		{"{{.Weekday}}", "Sunday"},
+		{"{{.Streak}}", "2"},
+		{"[{{.Occasion}}]", "[]"},
+		{"Good {{.TimeOfDay}}, {{.Name}}{{if gt .Streak 1}} ({{.Streak}} days running){{end}}!", "Good morning, Alice (2 days running)!"},
+	}
+	for _, tt := range tests {
+		args := map[string]any{"name": "Alice", "template": tt.tmpl}
+		out, err := run(inputWith(args, state), at("2026-02-22T09:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.tmpl, err)
+		}
+		if out.Data["message"] != tt.want {
+			t.Errorf("%q: message = %v, want %q", tt.tmpl, out.Data["message"], tt.want)
+		}
+	}
+}
+
+func TestRun_Template_Errors(t *testing.T) {
+	state := map[string]any{"scheduled_for": "2026-02-22T09:00"}
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"unclosed action", "Hi {{.Name", "template:"},
+		{"unknown function", `{{upper .Name}}`, `function "upper" not defined`},
+		{"unknown field", "{{.Nickname}}", "can't evaluate field Nickname"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{"name": "Alice", "template": tt.tmpl}
+			_, err := run(inputWith(args, state), at("2026-02-22T09:00"), fixedRand(0), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+			if KindOf(err) != ConfigError {
+				t.Errorf("kind = %v, want ConfigError", KindOf(err))
+			}
+		})
+	}
+}
+
+func TestRun_OnEmptyMessage(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantSend bool
+	}{
+		{"send", true},
+		{"skip", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			input := inputWith(
+				map[string]any{"messages": []any{"", "Hi {name}"}, "on_empty_message": tt.policy},
+				map[string]any{"scheduled_for": "2026-02-22T09:00"},
+			)
+			out, err := run(input, at("2026-02-22T09:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM != tt.wantSend {
+				t.Errorf("ContinueToLLM = %v, want %v", out.ContinueToLLM, tt.wantSend)
+			}
+			if !tt.wantSend && out.Data["skip_reason"] != "empty_message" {
+				t.Errorf("skip_reason = %v, want empty_message", out.Data["skip_reason"])
+			}
+			// Either way the day is done and the rotation has moved on.
+			if out.State["last_sent_date"] != "2026-02-22" || out.State["message_index"] != float64(1) {
+				t.Errorf("state = %v, want today done and message_index 1", out.State)
+			}
+		})
+	}
+}
+
+func TestRun_MultipleRecipients_EmitsMessagesInOrder(t *testing.T) {
+	input := inputWith(
+		map[string]any{"name": []any{"Alice", "Bob"}},
+		map[string]any{"scheduled_for": "2026-02-22T14:30"},
+	)
+
+	out, err := run(input, at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages, ok := out.Data["messages"].([]map[string]any)
+	if !ok || len(messages) != 2 {
+		t.Fatalf("data.messages = %v, want two entries", out.Data["messages"])
+	}
+	for i, want := range []string{"Alice", "Bob"} {
+		if messages[i]["name"] != want || messages[i]["time_of_day"] != "afternoon" {
+			t.Errorf("messages[%d] = %v, want %s in the afternoon", i, messages[i], want)
+		}
+	}
+	if _, ok := out.Data["name"]; ok {
+		t.Error("scalar data.name should be absent for a list of names")
+	}
+	// One shared schedule for the batch.
+	if out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+	}
+}
+
+func TestRun_MultipleRecipients_OutputIsByteIdentical(t *testing.T) {
+	args := map[string]any{
+		"name":        []any{"Zoe", "alice", "Bob", "alice"},
+		"formats":     []any{"plain", "markdown", "html"},
+		"postprocess": []any{"uppercase_name"},
+		"windows": map[string]any{
+			"sun":    map[string]any{"earliest_hour": 13, "latest_hour": 16},
+			"Sunday": map[string]any{"earliest_hour": 14, "latest_hour": 15},
+		},
+	}
+	state := map[string]any{"scheduled_for": "2026-02-22T14:30"}
+
+	var first []byte
+	for i := 0; i < 20; i++ {
+		out, err := run(inputWith(args, state), at("2026-02-22T14:30"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := goldenJSON(out)
+		if err != nil {
+			t.Fatalf("serialize output: %v", err)
+		}
+		if i == 0 {
+			first = got
+			messages, _ := out.Data["messages"].([]map[string]any)
+			var names []any
+			for _, m := range messages {
+				names = append(names, m["name"])
+			}
+			if fmt.Sprint(names) != "[ZOE ALICE BOB ALICE]" {
+				t.Fatalf("names = %v, want the input order", names)
+			}
+			continue
+		}
+		if !bytes.Equal(got, first) {
+			t.Fatalf("run %d differs from the first:\n%s\nvs\n%s", i, got, first)
+		}
+	}
+}
+
+func TestRun_SingleName_KeepsScalarShape(t *testing.T) {
+	input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"scheduled_for": "2026-02-22T14:30"})
+
+	out, err := run(input, at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["name"] != "Alice" || out.Data["time_of_day"] != "afternoon" {
+		t.Errorf("data = %v, want scalar name and time_of_day", out.Data)
+	}
+	if _, ok := out.Data["messages"]; ok {
+		t.Error("data.messages should be absent for a single name")
+	}
+}
+
+func TestRun_MalformedSchedule_RepicksInsteadOfFailing(t *testing.T) {
+	for _, bad := range []string{"2026-02-22T", "2026-02-22T25:00", "tomorrow", "2026-02-22 10:00", "2026-13-01T09:00"} {
+		input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"version": float64(stateVersion), "scheduled_for": bad})
+
+		out, err := run(input, at("2026-02-22T07:00"), fixedRand(2), nil)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", bad, err)
+		}
+		if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipInvalidScheduleRepicked) {
+			t.Errorf("%q: data = %v, want an invalid_schedule_repicked skip", bad, out.Data)
+		}
+		if out.State["scheduled_for"] != "2026-02-22T08:02" {
+			t.Errorf("%q: scheduled_for = %v, want a fresh 2026-02-22T08:02", bad, out.State["scheduled_for"])
+		}
+	}
+}
+
+func TestRun_RepickMidWindow_PicksFromNowOn(t *testing.T) {
+	// Repicks at 15:00 in the 08:00–20:00 window draw from what's left of
+	// it rather than counting the day as missed.
+	tests := []struct {
+		name       string
+		args       map[string]any
+		scheduled  string
+		wantReason SkipReason
+	}{
+		{"corrupt schedule", map[string]any{}, "tomorrow", SkipInvalidScheduleRepicked},
+		{"just narrowed window", map[string]any{"earliest_hour": 12}, "2026-02-22T09:00", SkipOutOfWindowRepicked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.args["name"] = "Alice"
+			state := map[string]any{"version": float64(stateVersion), "scheduled_for": tt.scheduled}
+			out, err := run(inputWith(tt.args, state), at("2026-02-22T15:00"), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["status"] != "waiting" || out.Data["skip_reason"] != string(tt.wantReason) {
+				t.Errorf("data = %v, want waiting with %s", out.Data, tt.wantReason)
+			}
+			if out.State["scheduled_for"] != "2026-02-22T15:02" {
+				t.Errorf("scheduled_for = %v, want 2026-02-22T15:02", out.State["scheduled_for"])
+			}
+			if _, ok := out.State["last_sent_date"]; ok {
+				t.Errorf("last_sent_date = %v, want today still open", out.State["last_sent_date"])
+			}
+		})
+	}
+}
+
+func TestRun_ScheduleOutsideCurrentWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       map[string]any
+		scheduled  string
+		now        string
+		wantReason SkipReason
+		wantSched  string
+	}{
+		{"narrowed below the pick", map[string]any{"latest_hour": 11}, "2026-02-22T15:00", "2026-02-22T07:00", SkipOutOfWindowRepicked, "2026-02-22T08:02"},
+		{"moved later than the pick", map[string]any{"earliest_hour": 12}, "2026-02-22T09:00", "2026-02-22T07:00", SkipOutOfWindowRepicked, "2026-02-22T12:02"},
+		{"blackout over the pick", map[string]any{"blackout_ranges": []any{map[string]any{"start": 10, "end": 11}}}, "2026-02-22T10:30", "2026-02-22T07:00", SkipOutOfWindowRepicked, "2026-02-22T08:02"},
+		{"weekday override", map[string]any{"windows": map[string]any{"sun": map[string]any{"latest_hour": 10}}}, "2026-02-22T15:00", "2026-02-22T07:00", SkipOutOfWindowRepicked, "2026-02-22T08:02"},
+		{"widened around the pick", map[string]any{"latest_hour": 20}, "2026-02-22T10:00", "2026-02-22T09:00", SkipBeforeScheduledTime, "2026-02-22T10:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.args["name"] = "Alice"
+			out, err := run(inputWith(tt.args, map[string]any{"scheduled_for": tt.scheduled}), at(tt.now), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM || out.Data["skip_reason"] != string(tt.wantReason) {
+				t.Errorf("data = %v, want a %s skip", out.Data, tt.wantReason)
+			}
+			if out.State["scheduled_for"] != tt.wantSched {
+				t.Errorf("scheduled_for = %v, want %s", out.State["scheduled_for"], tt.wantSched)
+			}
+		})
+	}
+
+	// A widened window keeps the pick, and it sends when the time comes.
+	args := map[string]any{"name": "Alice", "latest_hour": 20}
+	out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T10:00"}), at("2026-02-22T19:00"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Errorf("data = %v, want the kept schedule to send", out.Data)
+	}
+}
+
+func TestRun_AfterSending_NewDayPicksNewSchedule(t *testing.T) {
+	// Simulate a new day after having sent yesterday.
+	now := at("2026-02-23T08:05")
+	input := inputWith(
+		map[string]any{"name": "Alice"},
+		map[string]any{"last_sent_date": "2026-02-22"},
+	)
+
+	out, err := run(input, now, fixedRand(10), nil) // 08:10, still ahead
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false — new day, schedule just picked")
+	}
+	sched, _ := out.State["scheduled_for"].(string)
+	if len(sched) < 10 || sched[:10] != "2026-02-23" {
+		t.Errorf("scheduled_for = %q, expected date prefix 2026-02-23", sched)
+	}
+}
+
+func TestRun_ScheduleStaleFromYesterday_RepicksForToday(t *testing.T) {
+	// scheduled_for is from yesterday — must be repicked for today.
+	now := at("2026-02-23T09:00")
+	input := inputWith(
+		map[string]any{"name": "Alice"},
+		map[string]any{"scheduled_for": "2026-02-22T14:00"},
+	)
+
+	out, err := run(input, now, fixedRand(120), nil) // 10:00, still ahead
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false — must repick schedule for new day")
+	}
+	sched, _ := out.State["scheduled_for"].(string)
+	if len(sched) < 10 || sched[:10] != "2026-02-23" {
+		t.Errorf("scheduled_for = %q, expected today's date prefix", sched)
+	}
+}
+
+func TestRun_Timezone_UsesLocalCalendarDay(t *testing.T) {
+	// 23:30 UTC on the 21st is already 08:30 on the 22nd in Tokyo, so the
+	// schedule must be picked for the 22nd, not the 21st.
+	args := map[string]any{"timezone": "Asia/Tokyo", "earliest_hour": float64(9), "latest_hour": float64(10)}
+
+	out, err := run(inputWith(args, nil), at("2026-02-21T23:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["scheduled_for"] != "2026-02-22T09:00" {
+		t.Fatalf("scheduled_for = %v, want 2026-02-22T09:00", out.State["scheduled_for"])
+	}
+
+	// 23:59 UTC is 08:59 in Tokyo — still a minute to wait.
+	out, err = run(inputWith(args, out.State), at("2026-02-21T23:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false before 09:00 local")
+	}
+
+	// 00:00 UTC on the 22nd is 09:00 local — send, on the local calendar day.
+	out, err = run(inputWith(args, out.State), at("2026-02-22T00:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Fatal("expected ContinueToLLM=true at 09:00 local")
+	}
+	if out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+	}
+	if out.Data["time_of_day"] != "morning" {
+		t.Errorf("time_of_day = %v, want morning (local)", out.Data["time_of_day"])
+	}
+}
+
+func TestRun_Timezone_WestOfUTCKeepsPreviousDay(t *testing.T) {
+	// 02:00 UTC on the 23rd is still 21:00 on the 22nd in New York, so a
+	// salutation already sent on the 22nd (local) must not be repeated.
+	args := map[string]any{"timezone": "America/New_York"}
+	state := map[string]any{"last_sent_date": "2026-02-22"}
+
+	out, err := run(inputWith(args, state), at("2026-02-23T02:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false, already sent on the local day")
+	}
+	if _, ok := out.State["scheduled_for"]; ok {
+		t.Error("no schedule should be picked for the next local day yet")
+	}
+}
+
+func TestRun_DisallowedDay_SkipsWithoutSchedule(t *testing.T) {
+	// 2026-02-21 is a Saturday. A schedule left over from Friday must not
+	// survive, and no new one may be picked.
+	now := at("2026-02-21T10:00")
+	input := inputWith(
+		map[string]any{"days": []any{"mon", "tue", "wed", "thu", "fri"}},
+		map[string]any{"last_sent_date": "2026-02-20", "scheduled_for": "2026-02-20T09:00"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false on a disallowed day")
+	}
+	if _, ok := out.State["scheduled_for"]; ok {
+		t.Errorf("scheduled_for = %v, want absent on a disallowed day", out.State["scheduled_for"])
+	}
+	if out.State["last_sent_date"] != "2026-02-20" {
+		t.Errorf("last_sent_date = %v, want it preserved", out.State["last_sent_date"])
+	}
+}
+
+func TestRun_AllowedDay_BehavesAsBefore(t *testing.T) {
+	// 2026-02-23 is a Monday.
+	days := []any{"mon", "tue", "wed", "thu", "fri"}
+
+	out, err := run(inputWith(map[string]any{"days": days}, nil), at("2026-02-23T07:00"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["scheduled_for"] != "2026-02-23T08:02" {
+		t.Fatalf("scheduled_for = %v, want 2026-02-23T08:02", out.State["scheduled_for"])
+	}
+
+	out, err = run(inputWith(map[string]any{"days": days}, out.State), at("2026-02-23T08:02"), fixedRand(2), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=true at the scheduled time on an allowed day")
+	}
+}
+
+func TestRun_Lock_AcquiredWhenFree(t *testing.T) {
+	now := at("2026-02-22T08:00")
+	input := inputWith(map[string]any{"lock_token": "worker-a"}, nil)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lock, _ := out.State["lock"].(map[string]any)
+	if lock["token"] != "worker-a" || lock["acquired_at"] != "2026-02-22T08:00:00Z" {
+		t.Errorf("lock = %v, want worker-a acquired at 2026-02-22T08:00:00Z", out.State["lock"])
+	}
+	if _, ok := out.State["scheduled_for"]; !ok {
+		t.Error("expected the run to proceed and pick a schedule")
+	}
+}
+
+func TestRun_Lock_HeldByOtherWorker_Skips(t *testing.T) {
+	now := at("2026-02-22T14:30")
+	state := map[string]any{
+		"scheduled_for": "2026-02-22T14:30",
+		"lock":          map[string]any{"token": "worker-b", "acquired_at": "2026-02-22T14:25:00Z"},
+	}
+	input := inputWith(map[string]any{"lock_token": "worker-a"}, state)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false while another worker holds the lock")
+	}
+	if out.Data["skip_reason"] != "locked" {
+		t.Errorf("skip_reason = %v, want locked", out.Data["skip_reason"])
+	}
+	lock, _ := out.State["lock"].(map[string]any)
+	if lock["token"] != "worker-b" {
+		t.Errorf("lock.token = %v, want worker-b untouched", lock["token"])
+	}
+	if _, ok := out.State["metrics"]; ok {
+		t.Errorf("metrics = %v, want no count for a locked-out run", out.State["metrics"])
+	}
+}
+
+func TestRun_Lock_StaleLockIsTakenOver(t *testing.T) {
+	now := at("2026-02-22T14:30")
+	state := map[string]any{
+		"scheduled_for": "2026-02-22T14:30",
+		"lock":          map[string]any{"token": "worker-b", "acquired_at": "2026-02-22T14:00:00Z"},
+	}
+	input := inputWith(map[string]any{"lock_token": "worker-a", "lock_ttl_minutes": float64(15)}, state)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=true after taking over a stale lock")
+	}
+	lock, _ := out.State["lock"].(map[string]any)
+	if lock["token"] != "worker-a" {
+		t.Errorf("lock.token = %v, want worker-a", lock["token"])
+	}
+}
+
+func TestRun_Seed_ReproducibleSchedule(t *testing.T) {
+	args := map[string]any{"seed": float64(42)}
+	schedule := func(now time.Time, randIntn func(int) int) string {
+		t.Helper()
+		out, err := run(inputWith(args, nil), now, randIntn, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sched, _ := out.State["scheduled_for"].(string)
+		return sched
+	}
+
+	// Same seed and date → same time, whatever the injected source says.
+	a := schedule(at("2026-02-22T07:00"), fixedRand(0))
+	b := schedule(at("2026-02-22T07:30"), fixedRand(9))
+	if a != b {
+		t.Errorf("same date, same seed: %q != %q", a, b)
+	}
+
+	// Whatever time the day's first run comes: a seeded pick is drawn over
+	// the whole window, not what's left of it.
+	if noon := schedule(at("2026-02-22T12:00"), fixedRand(0)); noon != a {
+		t.Errorf("first run at 12:00 picked %q, want %q as at 07:00", noon, a)
+	}
+	// A first run after the seeded time counts the day as missed.
+	out, err := run(inputWith(args, nil), at("2026-02-22T19:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a >= "2026-02-22T19:00" || out.Data["skip_reason"] != string(SkipPickedInPast) {
+		t.Errorf("pick %s, data = %v, want a picked_in_past miss at 19:00", a, out.Data)
+	}
+
+	// A different date draws a different time.
+	c := schedule(at("2026-02-23T07:00"), fixedRand(0))
+	if a[11:] == c[11:] {
+		t.Errorf("different dates picked the same time %q", a[11:])
+	}
+}
+
+func TestRun_RepickNextEligible_SchedulesLaterValidDay(t *testing.T) {
+	// Last scheduled on Wednesday the 18th, then offline until Saturday the
+	// 21st. Weekdays only, so the repick must land on Monday the 23rd.
+	args := map[string]any{
+		"days":          []any{"mon", "tue", "wed", "thu", "fri"},
+		"repick_target": "next_eligible",
+	}
+	state := map[string]any{"last_sent_date": "2026-02-17", "scheduled_for": "2026-02-18T09:00"}
+
+	out, err := run(inputWith(args, state), at("2026-02-21T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false on Saturday")
+	}
+	if out.State["scheduled_for"] != "2026-02-23T08:00" {
+		t.Fatalf("scheduled_for = %v, want 2026-02-23T08:00", out.State["scheduled_for"])
+	}
+
+	// Sunday keeps Monday's schedule rather than repicking or clearing it.
+	out, err = run(inputWith(args, out.State), at("2026-02-22T10:00"), fixedRand(5), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["scheduled_for"] != "2026-02-23T08:00" {
+		t.Fatalf("Sunday: scheduled_for = %v, want 2026-02-23T08:00 kept", out.State["scheduled_for"])
+	}
+
+	// Monday sends at the kept time.
+	out, err = run(inputWith(args, out.State), at("2026-02-23T08:00"), fixedRand(5), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=true on Monday at the scheduled time")
+	}
+}
+
+func TestRun_RepickToday_StaleScheduleRepicksForToday(t *testing.T) {
+	// Same gap with the default target: a valid day repicks for today.
+	args := map[string]any{"days": []any{"mon", "tue", "wed", "thu", "fri"}}
+	state := map[string]any{"scheduled_for": "2026-02-18T09:00"}
+
+	out, err := run(inputWith(args, state), at("2026-02-20T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["scheduled_for"] != "2026-02-20T08:00" {
+		t.Errorf("scheduled_for = %v, want 2026-02-20T08:00", out.State["scheduled_for"])
+	}
+}
+
+func TestRun_SkipDates_HolidaySkipsCleanly(t *testing.T) {
+	// A schedule picked this morning, before today was added to skip_dates,
+	// must be dropped rather than fired.
+	args := map[string]any{"skip_dates": []any{"2026-12-25"}}
+	state := map[string]any{"last_sent_date": "2026-12-24", "scheduled_for": "2026-12-25T10:00"}
+
+	out, err := run(inputWith(args, state), at("2026-12-25T11:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false on a holiday")
+	}
+	if _, ok := out.State["scheduled_for"]; ok {
+		t.Errorf("scheduled_for = %v, want cleared on a holiday", out.State["scheduled_for"])
+	}
+	if out.State["last_sent_date"] != "2026-12-24" {
+		t.Errorf("last_sent_date = %v, want it untouched", out.State["last_sent_date"])
+	}
+}
+
+func TestParseArgs_BusinessDaysOnly(t *testing.T) {
+	a, err := parseArgs(map[string]any{"business_days_only": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(a.Days) != "[mon tue wed thu fri]" {
+		t.Errorf("days = %v, want Monday to Friday", a.Days)
+	}
+	a, err = parseArgs(map[string]any{"business_days_only": true, "days": []any{"sat", "Monday", "fri"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(a.Days) != "[mon fri]" {
+		t.Errorf("days = %v, want the weekend dropped", a.Days)
+	}
+	if _, err := parseArgs(map[string]any{"business_days_only": true, "days": []any{"sat", "sun"}}); err == nil {
+		t.Error("weekend-only days: expected error, got nil")
+	}
+}
+
+func TestRun_BusinessDaysOnly(t *testing.T) {
+	args := map[string]any{"business_days_only": true, "skip_dates": []any{"2026-02-23"}}
+	tests := []struct {
+		name   string
+		date   string
+		status string
+	}{
+		{"weekend", "2026-02-21", "day_off"},
+		{"holiday", "2026-02-23", "holiday"},
+		{"business day", "2026-02-24", "sent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A schedule left over for today only fires on a business day.
+			state := map[string]any{"scheduled_for": tt.date + "T09:00"}
+			out, err := run(inputWith(args, state), at(tt.date+"T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["status"] != tt.status {
+				t.Fatalf("status = %v, want %s (data = %v)", out.Data["status"], tt.status, out.Data)
+			}
+			if _, ok := out.State["scheduled_for"]; ok {
+				t.Errorf("scheduled_for = %v, want none left", out.State["scheduled_for"])
+			}
+		})
+	}
+}
+
+func TestRun_SkipDates_OtherDaysUnaffected(t *testing.T) {
+	args := map[string]any{"skip_dates": []any{"2026-12-25"}}
+	state := map[string]any{"scheduled_for": "2026-12-24T10:00"}
+
+	out, err := run(inputWith(args, state), at("2026-12-24T11:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=true on a non-holiday")
+	}
+}
+
+func TestRun_StatePatch_AppliedBeforeLogic(t *testing.T) {
+	// Patching last_sent_date to today suppresses an otherwise due send.
+	input := inputWith(
+		map[string]any{"state_patch": map[string]any{"last_sent_date": "2026-02-22"}},
+		map[string]any{"scheduled_for": "2026-02-22T09:00"},
+	)
+
+	out, err := run(input, at("2026-02-22T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM {
+		t.Error("expected ContinueToLLM=false after patching last_sent_date to today")
+	}
+
+	input.Arguments["state_patch"] = map[string]any{"streak": float64(-2)}
+	if _, err := run(input, at("2026-02-22T10:00"), fixedRand(0), nil); err == nil {
+		t.Error("expected error for an invalid state_patch, got nil")
+	}
+}
+
+func TestDecide(t *testing.T) {
+	v := float64(stateVersion)
+	tests := []struct {
+		name  string
+		args  map[string]any
+		state map[string]any
+		now   string
+		want  Decision
+	}{
+		{"first run picks", nil, nil, "2026-02-22T08:00", DecisionScheduled},
+		{"stale schedule repicked", nil, map[string]any{"version": v, "scheduled_for": "2026-02-21T10:00"}, "2026-02-22T08:00", DecisionScheduled},
+		{"before the scheduled time", nil, map[string]any{"version": v, "scheduled_for": "2026-02-22T10:00"}, "2026-02-22T09:00", DecisionWaiting},
+		{"awaiting events", map[string]any{"trigger_count": 3}, nil, "2026-02-22T09:00", DecisionWaiting},
+		{"send", nil, map[string]any{"version": v, "scheduled_for": "2026-02-22T10:00"}, "2026-02-22T10:00", DecisionSent},
+		{"already sent", nil, map[string]any{"version": v, "last_sent_date": "2026-02-22"}, "2026-02-22T10:00", DecisionAlreadySent},
+		{"picked in the past", nil, nil, "2026-02-22T21:00", DecisionMissed},
+		{"day off", map[string]any{"days": []any{"mon"}}, nil, "2026-02-22T10:00", DecisionSkipped},
+		{"holiday", map[string]any{"skip_dates": []any{"2026-02-22"}}, nil, "2026-02-22T10:00", DecisionSkipped},
+		{"snoozed", nil, map[string]any{"snooze_until": "2026-03-01"}, "2026-02-22T10:00", DecisionSnoozed},
+		{"capped", map[string]any{"monthly_cap": 1}, map[string]any{"version": v, "cap_month": "2026-02", "month_sends": float64(1)}, "2026-02-22T10:00", DecisionCapped},
+		{"expired", map[string]any{"expires_on": "2026-02-01"}, nil, "2026-02-22T10:00", DecisionExpired},
+		{"completed", nil, map[string]any{"version": v, "completed": true}, "2026-02-22T10:00", DecisionCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, out, err := Decide(inputWith(tt.args, tt.state), at(tt.now), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Decide = %s, want %s (data = %v)", got, tt.want, out.Data)
+			}
+			want, err := run(inputWith(tt.args, tt.state), at(tt.now), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotJSON, _ := goldenJSON(out)
+			wantJSON, _ := goldenJSON(want)
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("output = %s, want run's %s", gotJSON, wantJSON)
+			}
+		})
+	}
+
+	if _, _, err := Decide(inputWith(map[string]any{"earliest_hour": 20, "latest_hour": 8}, nil), at("2026-02-22T10:00"), fixedRand(0), nil); KindOf(err) != ConfigError {
+		t.Errorf("err = %v, want run's config error", err)
+	}
+}
+
+func TestDecisionOf_CoversEveryStatus(t *testing.T) {
+	for status := range statusDecisions {
+		if _, err := decisionOf(sdk.Output{Data: map[string]any{"status": status}}); err != nil {
+			t.Errorf("%s: %v", status, err)
+		}
+	}
+	if _, err := decisionOf(sdk.Output{Data: map[string]any{}}); err == nil {
+		t.Error("expected an error for output without a status")
+	}
+}
+
+func TestRun_SuppressIntermediate(t *testing.T) {
+	v := float64(stateVersion)
+	tests := []struct {
+		name      string
+		args      map[string]any
+		state     map[string]any
+		now       string
+		status    string
+		silent    bool
+		scheduled any
+	}{
+		{"schedule picked", nil, nil, "2026-02-22T08:00", "waiting", true, "2026-02-22T08:02"},
+		{"before the scheduled time", nil, map[string]any{"version": v, "scheduled_for": "2026-02-22T10:00"}, "2026-02-22T09:00", "waiting", true, "2026-02-22T10:00"},
+		{"awaiting events", map[string]any{"trigger_count": 3}, nil, "2026-02-22T09:00", "waiting", true, nil},
+		{"send", nil, map[string]any{"version": v, "scheduled_for": "2026-02-22T10:00"}, "2026-02-22T10:00", "sent", false, nil},
+		{"already sent", nil, map[string]any{"version": v, "last_sent_date": "2026-02-22"}, "2026-02-22T10:00", "already_sent", false, nil},
+		{"day off", map[string]any{"days": []any{"mon"}}, nil, "2026-02-22T10:00", "day_off", false, nil},
+		{"missed", nil, nil, "2026-02-22T21:00", "missed", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{"suppress_intermediate": true}
+			for k, v := range tt.args {
+				args[k] = v
+			}
+			out, err := run(inputWith(args, tt.state), at(tt.now), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["status"] != tt.status {
+				t.Fatalf("status = %v, want %s", out.Data["status"], tt.status)
+			}
+			if _, got := out.Data["silent"]; got != tt.silent {
+				t.Errorf("data.silent present = %v, want %v", got, tt.silent)
+			}
+			if out.State["scheduled_for"] != tt.scheduled {
+				t.Errorf("scheduled_for = %v, want %v", out.State["scheduled_for"], tt.scheduled)
+			}
+
+			// The flag changes nothing but the data it adds.
+			plain, err := run(inputWith(tt.args, tt.state), at(tt.now), fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, ok := plain.Data["silent"]; ok {
+				t.Error("data.silent set without suppress_intermediate")
+			}
+			if fmt.Sprint(plain.State) != fmt.Sprint(out.State) {
+				t.Errorf("state = %v, want %v as without the flag", out.State, plain.State)
+			}
+		})
+	}
+}
+
+func TestRun_DryRun_LeavesStateUntouched(t *testing.T) {
+	tests := []struct {
+		name      string
+		now       string
+		state     map[string]any
+		wantSend  bool
+		wantSched string
+		status    string
+	}{
+		{"first run", "2026-02-22T07:00", map[string]any{"streak": float64(2)}, false, "2026-02-22T08:00", "waiting"},
+		{"send", "2026-02-22T14:30", map[string]any{"scheduled_for": "2026-02-22T14:30"}, true, "2026-02-22T14:30", "sent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := fmt.Sprint(tt.state)
+			out, err := run(inputWith(map[string]any{"dry_run": true}, tt.state), at(tt.now), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := fmt.Sprint(out.State); got != before {
+				t.Errorf("state = %s, want unchanged %s", got, before)
+			}
+			if out.ContinueToLLM != tt.wantSend {
+				t.Errorf("ContinueToLLM = %v, want %v", out.ContinueToLLM, tt.wantSend)
+			}
+			if out.Data["dry_run"] != true {
+				t.Error("data.dry_run should be true")
+			}
+			if out.Data["scheduled_for"] != tt.wantSched {
+				t.Errorf("data.scheduled_for = %v, want %s", out.Data["scheduled_for"], tt.wantSched)
+			}
+			if out.Data["status"] != tt.status {
+				t.Errorf("data.status = %v, want %s", out.Data["status"], tt.status)
+			}
+		})
+	}
+}
+
+func TestRun_SkipReason_EveryBranch(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  map[string]any
+		state map[string]any
+		now   string
+		want  SkipReason
+	}{
+		{"locked", map[string]any{"lock_token": "a"},
+			map[string]any{"lock": map[string]any{"token": "b", "acquired_at": "2026-02-23T09:59:00Z"}},
+			"2026-02-23T10:00", SkipLocked},
+		{"already sent", nil, map[string]any{"last_sent_date": "2026-02-23"}, "2026-02-23T10:00", SkipAlreadySentToday},
+		{"holiday", map[string]any{"skip_dates": []any{"2026-02-23"}}, nil, "2026-02-23T10:00", SkipHoliday},
+		{"day off", map[string]any{"days": []any{"tue"}}, nil, "2026-02-23T10:00", SkipDayOff},
+		{"first pick", nil, nil, "2026-02-23T07:00", SkipSchedulePicked},
+		{"stale repick", nil, map[string]any{"scheduled_for": "2026-02-20T09:00"}, "2026-02-23T07:00", SkipStaleScheduleRepicked},
+		{"before time", nil, map[string]any{"scheduled_for": "2026-02-23T11:00"}, "2026-02-23T10:00", SkipBeforeScheduledTime},
+		{"too late", map[string]any{"max_delay_minutes": float64(5)},
+			map[string]any{"scheduled_for": "2026-02-23T09:00"}, "2026-02-23T10:00", SkipTooLate},
+		{"empty message", map[string]any{"messages": []any{" "}, "on_empty_message": "skip"},
+			map[string]any{"scheduled_for": "2026-02-23T09:00"}, "2026-02-23T10:00", SkipEmptyMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := run(inputWith(tt.args, tt.state), at(tt.now), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM {
+				t.Fatal("expected a skip")
+			}
+			if out.Data["skip_reason"] != string(tt.want) {
+				t.Errorf("skip_reason = %v, want %s", out.Data["skip_reason"], tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Send_HasNoSkipReason(t *testing.T) {
+	out, err := run(inputWith(nil, map[string]any{"scheduled_for": "2026-02-23T09:00"}), at("2026-02-23T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["skip_reason"]; ok {
+		t.Errorf("skip_reason = %v, want absent on send", out.Data["skip_reason"])
+	}
+}
+
+func TestRun_NowInUnexpectedLocation_IsNormalised(t *testing.T) {
+	// The host hands over 23:30 UTC on the 22nd expressed in UTC+14, where
+	// the wall clock already reads 13:30 on the 23rd. With the default UTC
+	// timezone the goblin must still treat it as the 22nd, at 23:30.
+	kiritimati := time.FixedZone("UTC+14", 14*60*60)
+	now := at("2026-02-22T23:30").In(kiritimati)
+	args := map[string]any{"latest_hour": float64(24)}
+
+	out, err := run(inputWith(args, map[string]any{"last_sent_date": "2026-02-23"}), now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// last_sent_date of the 23rd is in the future from UTC's point of view,
+	// so this is not "already sent today".
+	if out.Data["skip_reason"] == string(SkipAlreadySentToday) {
+		t.Error("date taken from now's own location instead of the configured zone")
+	}
+
+	out, err = run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T23:00"}), now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Fatal("expected the 23:00 UTC schedule on the 22nd to send")
+	}
+	if out.State["last_sent_date"] != "2026-02-22" {
+		t.Errorf("last_sent_date = %v, want 2026-02-22", out.State["last_sent_date"])
+	}
+	if out.Data["time_of_day"] != "evening" {
+		t.Errorf("time_of_day = %v, want evening (23:30 UTC)", out.Data["time_of_day"])
+	}
+}
+
+func TestRun_DefaultName_UsedWhenArgMissing(t *testing.T) {
+	now := at("2026-02-22T15:00")
+	input := inputWith(
+		nil, // no arguments
+		map[string]any{"scheduled_for": "2026-02-22T14:00"},
+	)
+
+	out, err := run(input, now, fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["name"] != "friend" {
+		t.Errorf("data.name = %v, want friend (default)", out.Data["name"])
+	}
+}
+
+func TestRun_InvalidArgs_ReturnsError(t *testing.T) {
+	now := at("2026-02-22T10:00")
+	input := inputWith(
+		map[string]any{"earliest_hour": float64(20), "latest_hour": float64(8)},
+		nil,
+	)
+
+	_, err := run(input, now, fixedRand(0), nil)
+	if err == nil {
+		t.Error("expected error for invalid hour window, got nil")
+	}
+}
+
+func TestRun_ScheduleRespectsWindow(t *testing.T) {
+	// With earliest=9, latest=17 and fixedRand returning a small offset (7),
+	// the scheduled hour should be within [9, 17).
+	now := at("2026-02-22T08:00")
+	input := inputWith(
+		map[string]any{"earliest_hour": float64(9), "latest_hour": float64(17)},
+		nil,
+	)
+
+	out, err := run(input, now, fixedRand(7), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sched, _ := out.State["scheduled_for"].(string)
+	var schedTime time.Time
+	schedTime, err = time.Parse("2006-01-02T15:04", sched)
+	if err != nil {
+		t.Fatalf("parse scheduled_for %q: %v", sched, err)
+	}
+	if h := schedTime.Hour(); h < 9 || h >= 17 {
+		t.Errorf("scheduled hour %d outside window [9, 17)", h)
+	}
+}
+
+func TestRun_PreviewDays(t *testing.T) {
+	args := map[string]any{
+		"name":          "Alice",
+		"timezone":      "America/New_York",
+		"earliest_hour": float64(9),
+		"latest_hour":   float64(11),
+		"days":          []any{"mon", "tue", "wed", "thu", "fri"},
+		"preview_days":  float64(7),
+	}
+	// Sunday 2026-02-22, 08:00 in New York.
+	now := at("2026-02-22T13:00")
+	out, err := run(inputWith(args, nil), now, rand.New(rand.NewSource(1)).Intn, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	preview, ok := out.Data["preview"].([]map[string]any)
+	if !ok || len(preview) != 7 {
+		t.Fatalf("preview = %v, want 7 entries", out.Data["preview"])
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	for i, entry := range preview {
+		date := time.Date(2026, 2, 23+i, 0, 0, 0, 0, loc).Format("2006-01-02")
+		if entry["date"] != date {
+			t.Errorf("entry %d: date = %v, want %s", i, entry["date"], date)
+		}
+		scheduledFor, _ := entry["scheduled_for"].(string)
+		weekend := i >= 5
+		if weekend {
+			if scheduledFor != "" || entry["skip_reason"] != string(SkipDayOff) {
+				t.Errorf("%s: entry = %v, want a day off", date, entry)
+			}
+			continue
+		}
+		st, err := time.ParseInLocation("2006-01-02T15:04", scheduledFor, loc)
+		if err != nil {
+			t.Errorf("%s: scheduled_for %q: %v", date, scheduledFor, err)
+			continue
+		}
+		if st.Format("2006-01-02") != date || st.Hour() < 9 || st.Hour() >= 11 {
+			t.Errorf("%s: scheduled_for = %s, want within 09:00–11:00 that day", date, scheduledFor)
+		}
+	}
+
+	// The preview leaves the state exactly as a run without it would.
+	delete(args, "preview_days")
+	plain, err := run(inputWith(args, nil), now, rand.New(rand.NewSource(1)).Intn, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(plain.State) != fmt.Sprint(out.State) {
+		t.Errorf("state = %v, want %v as without preview_days", out.State, plain.State)
+	}
+}
+
+func TestRun_PreviewDays_MatchesLaterRuns(t *testing.T) {
+	// With a seed the pick depends only on the date, so tomorrow's run must
+	// choose what today's preview promised.
+	args := map[string]any{"name": "Alice", "seed": "42", "preview_days": float64(1)}
+	out, err := run(inputWith(args, nil), at("2026-02-22T21:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	preview := out.Data["preview"].([]map[string]any)
+	tomorrow, err := run(inputWith(args, out.State), at("2026-02-23T00:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if preview[0]["scheduled_for"] != tomorrow.Data["next_send"] {
+		t.Errorf("preview = %v, but tomorrow's run scheduled %v", preview[0], tomorrow.Data["next_send"])
+	}
+}
+
+func TestRun_Windows_OverrideByWeekday(t *testing.T) {
+	args := map[string]any{
+		"name":          "Alice",
+		"earliest_hour": float64(8),
+		"latest_hour":   float64(9),
+		"windows":       map[string]any{"sat": map[string]any{"earliest_hour": float64(10), "latest_hour": float64(12)}},
+	}
+	tests := []struct {
+		name     string
+		now      string
+		from, to int
+	}{
+		{"Saturday uses its override", "2026-02-21T00:00", 10, 12},
+		{"Tuesday uses the default", "2026-02-24T00:00", 8, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 50; i++ {
+				out, err := run(inputWith(args, nil), at(tt.now), r.Intn, nil)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				picked, err := time.Parse("2006-01-02T15:04", out.Data["next_send"].(string))
+				if err != nil {
+					t.Fatalf("next_send = %v: %v", out.Data["next_send"], err)
+				}
+				if picked.Hour() < tt.from || picked.Hour() >= tt.to {
+					t.Fatalf("picked %s, want within %02d:00–%02d:00", picked.Format("15:04"), tt.from, tt.to)
+				}
+			}
+		})
+	}
+}
+
+func TestRun_Metrics_CountEveryBranch(t *testing.T) {
+	args := map[string]any{"name": "Alice", "max_delay_minutes": float64(30)}
+	steps := []struct {
+		now    string
+		rand   int
+		status string
+		want   runMetrics
+	}{
+		{"2026-02-22T08:00", 60, "waiting", runMetrics{Skips: 1}},       // picks 09:00
+		{"2026-02-22T08:30", 0, "waiting", runMetrics{Skips: 2}},        // before 09:00
+		{"2026-02-22T09:10", 0, "sent", runMetrics{Sends: 1, Skips: 2}}, // sends
+		{"2026-02-22T12:00", 0, "already_sent", runMetrics{Sends: 1, Skips: 3}},
+		{"2026-02-23T07:00", 60, "waiting", runMetrics{Sends: 1, Skips: 4}}, // picks 09:00
+		{"2026-02-23T10:00", 0, "missed", runMetrics{Sends: 1, Skips: 5, Missed: 1}},
+		{"2026-02-23T19:00", 0, "already_sent", runMetrics{Sends: 1, Skips: 6, Missed: 1}},
+	}
+	var state map[string]any
+	for _, st := range steps {
+		out, err := run(inputWith(args, state), at(st.now), fixedRand(st.rand), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", st.now, err)
+		}
+		if out.Data["status"] != st.status {
+			t.Fatalf("%s: status = %v, want %s", st.now, out.Data["status"], st.status)
+		}
+		if got, _ := out.Data["metrics"].(*runMetrics); got == nil || *got != st.want {
+			t.Errorf("%s: data.metrics = %+v, want %+v", st.now, out.Data["metrics"], st.want)
+		}
+		state = out.State
+	}
+
+	// The counters ride along in state, so a fresh parse sees them.
+	parsed, err := parseState(state)
+	if err != nil {
+		t.Fatalf("parseState: %v", err)
+	}
+	if want := steps[len(steps)-1].want; parsed.Metrics == nil || *parsed.Metrics != want {
+		t.Errorf("state.metrics = %+v, want %+v", parsed.Metrics, want)
+	}
+}
+
+func TestRun_SendToleranceMinutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduled string
+		now       string
+		sends     bool
+	}{
+		{"just inside the tolerance", "2026-02-22T10:00", "2026-02-22T09:55", true},
+		{"just outside the tolerance", "2026-02-22T10:00", "2026-02-22T09:54", false},
+		{"not before the window opens", "2026-02-22T09:02", "2026-02-22T08:58", false},
+		{"from the moment it opens", "2026-02-22T09:02", "2026-02-22T09:00", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{"name": "Alice", "earliest_hour": float64(9), "send_tolerance_minutes": float64(5)}
+			out, err := run(inputWith(args, map[string]any{"scheduled_for": tt.scheduled}), at(tt.now), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM != tt.sends {
+				t.Errorf("ContinueToLLM = %v, want %v (data = %v)", out.ContinueToLLM, tt.sends, out.Data)
+			}
+		})
+	}
+}
+
+func TestRun_Warnings(t *testing.T) {
+	tests := []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{"unknown locale", map[string]any{"locale": "tlh"}, `locale "tlh" is not supported`},
+		{"unknown language", map[string]any{"language": "eo"}, `locale "eo" is not supported`},
+		{
+			"window almost all blacked out",
+			map[string]any{
+				"earliest_hour": float64(9), "latest_hour": float64(20),
+				"blackout_ranges": []any{map[string]any{"start": 9, "end": 19}},
+			},
+			"leave only 60 of the window's 660 minutes open",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 600 minutes in lands at 19:00, clear of the blackout.
+			out, err := run(inputWith(tt.args, nil), at("2026-02-22T07:00"), fixedRand(600), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			warnings, _ := out.Data["warnings"].([]string)
+			if len(warnings) != 1 || !strings.Contains(warnings[0], tt.want) {
+				t.Errorf("warnings = %q, want one containing %q", warnings, tt.want)
+			}
+		})
+	}
+
+	out, err := run(inputWith(map[string]any{"locale": "es"}, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["warnings"]; ok {
+		t.Errorf("warnings = %v, want none for a sound configuration", out.Data["warnings"])
+	}
+}
+
+func TestRun_SendsPerDay_FiresEachSlotOnce(t *testing.T) {
+	args := map[string]any{"name": "Alice", "sends_per_day": float64(2)}
+	steps := []struct {
+		now    string
+		status string
+		slot   string
+		tod    string
+	}{
+		{"2026-02-22T06:00", "waiting", "morning", ""}, // picks 07:30
+		{"2026-02-22T07:45", "sent", "morning", "morning"},
+		{"2026-02-22T08:00", "waiting", "evening", ""}, // picks 20:30
+		{"2026-02-22T20:45", "sent", "evening", "evening"},
+		{"2026-02-22T21:00", "already_sent", "", ""},
+		{"2026-02-22T23:30", "already_sent", "", ""},
+		{"2026-02-23T06:00", "waiting", "morning", ""}, // a new day starts afresh
+		{"2026-02-23T07:40", "sent", "morning", "morning"},
+	}
+	var state map[string]any
+	for _, st := range steps {
+		out, err := run(inputWith(args, state), at(st.now), fixedRand(30), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", st.now, err)
+		}
+		if out.Data["status"] != st.status || (st.slot != "" && out.Data["slot"] != st.slot) {
+			t.Fatalf("%s: data = %v, want %s for slot %q", st.now, out.Data, st.status, st.slot)
+		}
+		if out.ContinueToLLM != (st.status == "sent") {
+			t.Errorf("%s: ContinueToLLM = %v", st.now, out.ContinueToLLM)
+		}
+		if st.tod != "" && out.Data["time_of_day"] != st.tod {
+			t.Errorf("%s: time_of_day = %v, want %s", st.now, out.Data["time_of_day"], st.tod)
+		}
+		state = out.State
+	}
+	if fmt.Sprint(state["sent_slots"]) != "[morning]" {
+		t.Errorf("sent_slots = %v, want [morning] on the new day", state["sent_slots"])
+	}
+}
+
+func TestRun_SendsPerDay_ClosedSlotIsMissed(t *testing.T) {
+	// A first run at noon is past the morning window, so only the evening
+	// remains.
+	args := map[string]any{"name": "Alice", "sends_per_day": float64(2)}
+	out, err := run(inputWith(args, nil), at("2026-02-22T12:00"), fixedRand(30), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["slot"] != "evening" || out.Data["next_send"] != "2026-02-22T20:30" {
+		t.Errorf("data = %v, want the evening slot scheduled for 20:30", out.Data)
+	}
+}
+
+func TestRun_SendsPerDay_MidSlotFirstRunPicksAhead(t *testing.T) {
+	// A first run at 09:30 inside the 07:00–10:00 morning slot: fixedRand(5)
+	// draws from what's left of the slot, not a past 07:05 that would send
+	// at once.
+	args := map[string]any{"name": "Alice", "sends_per_day": float64(2)}
+	out, err := run(inputWith(args, nil), at("2026-02-22T09:30"), fixedRand(5), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["slot"] != "morning" || out.Data["next_send"] != "2026-02-22T09:35" {
+		t.Errorf("data = %v, want the morning slot waiting for 09:35", out.Data)
+	}
+
+	// A seeded pick is drawn over the whole slot; once it has passed, the
+	// slot is missed and the evening one is picked instead.
+	args["seed"] = float64(42)
+	out, err = run(inputWith(args, nil), at("2026-02-22T09:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["slot"] != "evening" {
+		t.Errorf("data = %v, want the morning slot missed and the evening one waiting", out.Data)
+	}
+}
+
+func TestParseArgs_Slots_Validated(t *testing.T) {
+	slot := func(name string, from, to int) map[string]any {
+		return map[string]any{"name": name, "earliest_hour": from, "latest_hour": to}
+	}
+	tests := []struct {
+		name  string
+		slots []any
+		want  string
+	}{
+		{"wrong count", []any{slot("morning", 7, 10)}, "slots must list 2"},
+		{"overlapping", []any{slot("morning", 7, 12), slot("lunch", 11, 14)}, "lunch must start after morning ends"},
+		{"backwards", []any{slot("evening", 22, 20), slot("late", 23, 24)}, "window end"},
+		{"unnamed", []any{slot("", 7, 10), slot("evening", 20, 23)}, "no name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseArgs(map[string]any{"sends_per_day": 2, "slots": tt.slots})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Precision_ReadsEitherForm(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision string
+		scheduled string
+		waitAt    time.Time
+		sendAt    time.Time
+	}{
+		{
+			"seconds read under minute precision", "minute", "2026-02-22T09:00:30",
+			time.Date(2026, 2, 22, 9, 0, 10, 0, time.UTC), time.Date(2026, 2, 22, 9, 0, 30, 0, time.UTC),
+		},
+		{
+			"minutes read under second precision", "second", "2026-02-22T09:00",
+			time.Date(2026, 2, 22, 8, 59, 59, 0, time.UTC), time.Date(2026, 2, 22, 9, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{"name": "Alice", "precision": tt.precision}
+			state := map[string]any{"version": stateVersion, "scheduled_for": tt.scheduled}
+			out, err := run(inputWith(args, state), tt.waitAt, fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["skip_reason"] != string(SkipBeforeScheduledTime) {
+				t.Errorf("before it: data = %v, want %s", out.Data, SkipBeforeScheduledTime)
+			}
+			out, err = run(inputWith(args, state), tt.sendAt, fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM {
+				t.Errorf("at it: data = %v, want a send", out.Data)
+			}
+		})
+	}
+}
+
+func TestRun_MinGapHours(t *testing.T) {
+	args := map[string]any{"name": "Alice", "min_gap_hours": float64(20)}
+	state := map[string]any{
+		"last_sent_date": "2026-02-21",
+		"last_sent_at":   "2026-02-21T19:45:00Z",
+		"scheduled_for":  "2026-02-22T15:00",
+	}
+
+	// 19h15m after the last send: held back.
+	out, err := run(inputWith(args, state), at("2026-02-22T15:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipMinGap) {
+		t.Fatalf("data = %v, want %s", out.Data, SkipMinGap)
+	}
+	if out.Data["minutes_until_send"] != 45 || out.State["scheduled_for"] != "2026-02-22T15:00" {
+		t.Errorf("data = %v, state = %v; want 45 minutes to go with the schedule kept", out.Data, out.State)
+	}
+
+	// Just past 20 hours: sent, and the instant recorded for next time.
+	out, err = run(inputWith(args, out.State), at("2026-02-22T15:45"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Fatalf("data = %v, want a send once the gap has passed", out.Data)
+	}
+	if out.State["last_sent_at"] != "2026-02-22T15:45:00Z" {
+		t.Errorf("last_sent_at = %v, want 2026-02-22T15:45:00Z", out.State["last_sent_at"])
+	}
+}
+
+func TestRun_Inclusive_AtExactlyTheScheduledInstant(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      map[string]any
+		state     map[string]any
+		now       time.Time
+		inclusive bool
+		wantSend  bool
+	}{
+		{"scheduled", map[string]any{}, map[string]any{"scheduled_for": "2026-02-22T09:00"}, at("2026-02-22T09:00"), true, true},
+		{"scheduled", map[string]any{}, map[string]any{"scheduled_for": "2026-02-22T09:00"}, at("2026-02-22T09:00"), false, false},
+		{"second precision", map[string]any{"precision": "second"}, map[string]any{"version": float64(stateVersion), "scheduled_for": "2026-02-22T09:00:30"}, at("2026-02-22T09:00").Add(30 * time.Second), true, true},
+		{"second precision", map[string]any{"precision": "second"}, map[string]any{"version": float64(stateVersion), "scheduled_for": "2026-02-22T09:00:30"}, at("2026-02-22T09:00").Add(30 * time.Second), false, false},
+		{"tolerance edge", map[string]any{"send_tolerance_minutes": 5}, map[string]any{"scheduled_for": "2026-02-22T09:05"}, at("2026-02-22T09:00"), true, true},
+		{"tolerance edge", map[string]any{"send_tolerance_minutes": 5}, map[string]any{"scheduled_for": "2026-02-22T09:05"}, at("2026-02-22T09:00"), false, false},
+		{"min gap edge", map[string]any{"min_gap_hours": 20}, map[string]any{"scheduled_for": "2026-02-22T09:00", "last_sent_date": "2026-02-21", "last_sent_at": "2026-02-21T13:00:00Z"}, at("2026-02-22T09:00"), true, true},
+		{"min gap edge", map[string]any{"min_gap_hours": 20}, map[string]any{"scheduled_for": "2026-02-22T09:00", "last_sent_date": "2026-02-21", "last_sent_at": "2026-02-21T13:00:00Z"}, at("2026-02-22T09:00"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/inclusive=%v", tt.name, tt.inclusive), func(t *testing.T) {
+			args := map[string]any{"name": "Alice", "inclusive": tt.inclusive}
+			for k, v := range tt.args {
+				args[k] = v
+			}
+			out, err := run(inputWith(args, tt.state), tt.now, fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.ContinueToLLM != tt.wantSend {
+				t.Errorf("sent = %v, want %v (data %v)", out.ContinueToLLM, tt.wantSend, out.Data)
+			}
+		})
+	}
+
+	// Exclusive still sends on the next run after the instant.
+	args := map[string]any{"name": "Alice", "inclusive": false}
+	out, err := run(inputWith(args, map[string]any{"scheduled_for": "2026-02-22T09:00"}), at("2026-02-22T09:01"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM {
+		t.Errorf("data = %v, want a send after the instant", out.Data)
+	}
+}
+
+func TestRun_MonthlyCap(t *testing.T) {
+	args := map[string]any{"name": "Alice", "monthly_cap": 3, "timezone": "America/New_York"}
+	ny, _ := time.LoadLocation("America/New_York")
+	var state map[string]any
+	sendOn := func(day time.Time) sdk.Output {
+		t.Helper()
+		out, err := run(inputWith(args, state), day, fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", day, err)
+		}
+		state = out.State
+		if out.ContinueToLLM {
+			return out
+		}
+		if out.Data["status"] != "waiting" {
+			return out
+		}
+		// A schedule was picked at 08:00; run again once it's due.
+		out, err = run(inputWith(args, state), day.Add(2*time.Hour), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", day, err)
+		}
+		state = out.State
+		return out
+	}
+
+	// Three sends in March go out...
+	for day := 28; day <= 30; day++ {
+		if out := sendOn(time.Date(2026, 3, day, 7, 0, 0, 0, ny)); !out.ContinueToLLM {
+			t.Fatalf("2026-03-%d: data = %v, want a send", day, out.Data)
+		}
+	}
+	if state["month_sends"] != float64(3) || state["cap_month"] != "2026-03" {
+		t.Errorf("state = %v, want 3 sends counted for 2026-03", state)
+	}
+
+	// ...then the fourth is suppressed, forced or not.
+	out := sendOn(time.Date(2026, 3, 31, 7, 0, 0, 0, ny))
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipMonthlyCapReached) {
+		t.Errorf("2026-03-31: data = %v, want monthly_cap_reached", out.Data)
+	}
+	args["force"] = true
+	out = sendOn(time.Date(2026, 3, 31, 12, 0, 0, 0, ny))
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipMonthlyCapReached) {
+		t.Errorf("forced: data = %v, want monthly_cap_reached", out.Data)
+	}
+	delete(args, "force")
+
+	// 23:30 in New York on the 31st is already April in UTC, but still March
+	// locally.
+	out = sendOn(time.Date(2026, 3, 31, 23, 30, 0, 0, ny))
+	if out.ContinueToLLM {
+		t.Errorf("late on the 31st: data = %v, want no send", out.Data)
+	}
+
+	// April starts the count again.
+	if out := sendOn(time.Date(2026, 4, 1, 7, 0, 0, 0, ny)); !out.ContinueToLLM {
+		t.Fatalf("2026-04-01: data = %v, want a send", out.Data)
+	}
+	if state["month_sends"] != float64(1) || state["cap_month"] != "2026-04" {
+		t.Errorf("state = %v, want 1 send counted for 2026-04", state)
+	}
+}
+
+func TestRun_IdempotencyKey(t *testing.T) {
+	// Every run draws different random numbers; the key mustn't follow them.
+	r := rand.New(rand.NewSource(1))
+	key := func(args map[string]any, now string) any {
+		t.Helper()
+		args["force"] = true
+		out, err := run(inputWith(args, nil), at(now), r.Intn, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.Data["idempotency_key"]
+	}
+	alice := key(map[string]any{"name": "Alice"}, "2026-02-22T09:00")
+	if again := key(map[string]any{"name": "Alice"}, "2026-02-22T18:30"); again != alice {
+		t.Errorf("key = %v later the same day, want %v", again, alice)
+	}
+	if tomorrow := key(map[string]any{"name": "Alice"}, "2026-02-23T09:00"); tomorrow == alice {
+		t.Error("key unchanged on the next day")
+	}
+	if bob := key(map[string]any{"name": "Bob"}, "2026-02-22T09:00"); bob == alice {
+		t.Error("key shared between recipients")
+	}
+
+	// Each slot of a two-send day is its own logical send.
+	args := map[string]any{"name": "Alice", "sends_per_day": float64(2)}
+	morning, err := run(inputWith(args, nil), at("2026-02-22T09:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	evening, err := run(inputWith(args, morning.State), at("2026-02-22T22:59"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !morning.ContinueToLLM || !evening.ContinueToLLM || morning.Data["idempotency_key"] == evening.Data["idempotency_key"] {
+		t.Errorf("morning key %v, evening key %v; want two sends with distinct keys", morning.Data["idempotency_key"], evening.Data["idempotency_key"])
+	}
+}
+
+func TestRun_LogsDecisionPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		state map[string]any
+		now   string
+		want  []string
+	}{
+		{
+			name:  "send",
+			state: map[string]any{"scheduled_for": "2026-02-22T09:00"},
+			now:   "2026-02-22T10:00",
+			want: []string{
+				`debug: state: last_sent_date "", scheduled_for "2026-02-22T09:00"`,
+				"info: send: to Alice",
+			},
+		},
+		{
+			name: "skip",
+			now:  "2026-02-22T12:00",
+			want: []string{
+				`debug: state: last_sent_date "", scheduled_for ""`,
+				"info: skip: waiting (schedule_just_picked)",
+				"info: schedule: 2026-02-22T18:22",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &captureLogger{}
+			if _, err := run(inputWith(map[string]any{"name": "Alice"}, tt.state), at(tt.now), fixedRand(382), log); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(log.events, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("events = %q, want %q", log.events, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_FutureLastSentDate_Reset(t *testing.T) {
+	for _, future := range []string{"2026-02-23", "2027-02-22"} {
+		t.Run(future, func(t *testing.T) {
+			input := inputWith(map[string]any{"name": "Alice"}, map[string]any{"last_sent_date": future, "streak": 5})
+			out, err := run(input, at("2026-02-22T12:00"), fixedRand(382), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["skip_reason"] != string(SkipSchedulePicked) || out.State["scheduled_for"] != "2026-02-22T18:22" {
+				t.Fatalf("data = %v, state = %v, want today scheduled", out.Data, out.State)
+			}
+			if _, ok := out.State["last_sent_date"]; ok {
+				t.Errorf("last_sent_date = %v, want it reset", out.State["last_sent_date"])
+			}
+			warnings, _ := out.Data["warnings"].([]string)
+			if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "state.last_sent_date "+future) {
+				t.Errorf("warnings = %q, want one for last_sent_date", warnings)
+			}
+
+			// The schedule then sends as usual.
+			out, err = run(inputWith(map[string]any{"name": "Alice"}, out.State), at("2026-02-22T18:30"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM || out.State["last_sent_date"] != "2026-02-22" {
+				t.Errorf("data = %v, state = %v, want today sent", out.Data, out.State)
+			}
+		})
+	}
+}
+
+func TestRun_Channel_PassedThroughOnSend(t *testing.T) {
+	for _, channel := range []string{"email", "push", "sms"} {
+		t.Run(channel, func(t *testing.T) {
+			input := inputWith(map[string]any{"channel": channel}, map[string]any{"scheduled_for": "2026-02-22T09:00"})
+			out, err := run(input, at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM || out.Data["channel"] != channel {
+				t.Errorf("data = %v, want a send on channel %s", out.Data, channel)
+			}
+		})
+	}
+
+	// Without channel, data carries none.
+	out, err := run(inputWith(nil, map[string]any{"scheduled_for": "2026-02-22T09:00"}), at("2026-02-22T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["channel"]; ok {
+		t.Errorf("channel = %v, want none", out.Data["channel"])
+	}
+}
+
+func TestRun_CatchUp_ReportsMissedDays(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     map[string]any
+		lastSent string
+		lastAt   string
+		want     string // fmt.Sprint of missed_days, or "" for none
+	}{
+		{"three-day gap", nil, "2026-02-19", "", "map[count:2 dates:[2026-02-20 2026-02-21]]"},
+		{"one-day gap", nil, "2026-02-21", "", ""},
+		{"days filter honoured", map[string]any{"days": []any{"mon", "fri", "sun"}}, "2026-02-16", "", "map[count:1 dates:[2026-02-20]]"},
+		{"skip_dates honoured", map[string]any{"skip_dates": []any{"2026-02-20"}}, "2026-02-19", "", "map[count:1 dates:[2026-02-21]]"},
+		// The 21st was given up on (too_late): the gap runs from the last send.
+		{"given-up day in between", nil, "2026-02-21", "2026-02-18T09:00:00Z", "map[count:3 dates:[2026-02-19 2026-02-20 2026-02-21]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := map[string]any{"catch_up": true}
+			for k, v := range tt.args {
+				args[k] = v
+			}
+			state := map[string]any{"last_sent_date": tt.lastSent, "scheduled_for": "2026-02-22T09:00"}
+			if tt.lastAt != "" {
+				state["last_sent_at"] = tt.lastAt
+			}
+			out, err := run(inputWith(args, state), at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !out.ContinueToLLM {
+				t.Fatalf("data = %v, want the normal send", out.Data)
+			}
+			got, ok := out.Data["missed_days"]
+			if tt.want == "" {
+				if ok {
+					t.Errorf("missed_days = %v, want none", got)
+				}
+				return
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("missed_days = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_Formats(t *testing.T) {
+	due := map[string]any{"scheduled_for": "2026-02-22T09:00"}
+	rendered := func(args map[string]any) map[string]any {
+		t.Helper()
+		out, err := run(inputWith(args, due), at("2026-02-22T10:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		r, ok := out.Data["rendered"].(map[string]any)
+		if !out.ContinueToLLM || !ok {
+			t.Fatalf("data = %v, want a send with rendered", out.Data)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		args map[string]any
+		want map[string]any
+	}{
+		{"default is plain", map[string]any{"name": "Alice"}, map[string]any{
+			"plain": "Good morning, Alice!",
+		}},
+		{"every format", map[string]any{"name": "Alice", "formats": []any{"plain", "markdown", "html"}}, map[string]any{
+			"plain":    "Good morning, Alice!",
+			"markdown": "Good morning, **Alice**!",
+			"html":     "Good morning, <strong>Alice</strong>!",
+		}},
+		{"html escapes the name", map[string]any{"name": "<script>Bob", "formats": []any{"html"}}, map[string]any{
+			"html": "Good morning, <strong>&lt;script&gt;Bob</strong>!",
+		}},
+		{"html escapes the message", map[string]any{"name": "Bob", "formats": []any{"html"}, "messages": []any{"Hi {name} & co <3"}}, map[string]any{
+			"html": "Hi <strong>Bob</strong> &amp; co &lt;3",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rendered(tt.args); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rendered = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("name list", func(t *testing.T) {
+		args := map[string]any{"name": []any{"Alice", "Bob"}, "formats": []any{"markdown"}}
+		out, err := run(inputWith(args, due), at("2026-02-22T10:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		messages, _ := out.Data["messages"].([]map[string]any)
+		if len(messages) != 2 || fmt.Sprint(messages[1]["rendered"]) != fmt.Sprint(map[string]any{"markdown": "Good morning, **Bob**!"}) {
+			t.Errorf("messages = %v, want each rendered in markdown", out.Data["messages"])
+		}
+	})
+}
+
+func TestRun_Postprocess(t *testing.T) {
+	due := map[string]any{"scheduled_for": "2026-02-22T09:00"}
+	send := func(args map[string]any) map[string]any {
+		t.Helper()
+		out, err := run(inputWith(args, due), at("2026-02-22T10:00"), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("data = %v, want a send", out.Data)
+		}
+		return out.Data
+	}
+
+	t.Run("uppercase_name", func(t *testing.T) {
+		data := send(map[string]any{"name": "Alice", "postprocess": []any{"uppercase_name"}})
+		if data["name"] != "ALICE" {
+			t.Errorf("name = %v, want ALICE", data["name"])
+		}
+		data = send(map[string]any{"name": []any{"Alice", "Bob"}, "postprocess": []any{"uppercase_name"}})
+		messages, _ := data["messages"].([]map[string]any)
+		if len(messages) != 2 || messages[0]["name"] != "ALICE" || messages[1]["name"] != "BOB" {
+			t.Errorf("messages = %v, want both names uppercased", data["messages"])
+		}
+	})
+}
+
+func TestRun_SnoozeUntil(t *testing.T) {
+	tests := []struct {
+		name    string
+		snooze  string
+		status  string
+		warning string
+	}{
+		{"future snooze suppresses", "2026-03-01", "snoozed", ""},
+		{"ends on its date", "2026-02-22", "sent", ""},
+		{"past snooze has no effect", "2026-02-01", "sent", ""},
+		{"malformed is ignored", "next week", "sent", `state.snooze_until "next week"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := map[string]any{"scheduled_for": "2026-02-22T09:00", "snooze_until": tt.snooze}
+			out, err := run(inputWith(nil, state), at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["status"] != tt.status {
+				t.Fatalf("status = %v, want %s (data = %v)", out.Data["status"], tt.status, out.Data)
+			}
+			if tt.status == "snoozed" {
+				if out.Data["skip_reason"] != string(SkipSnoozed) || out.Data["snooze_until"] != tt.snooze {
+					t.Errorf("data = %v, want a snoozed skip until %s", out.Data, tt.snooze)
+				}
+				if _, ok := out.State["scheduled_for"]; ok || out.State["snooze_until"] != tt.snooze {
+					t.Errorf("state = %v, want no schedule and the snooze kept", out.State)
+				}
+			} else if _, ok := out.State["snooze_until"]; ok {
+				t.Errorf("snooze_until = %v, want it cleared", out.State["snooze_until"])
+			}
+			warnings, _ := out.Data["warnings"].([]string)
+			if tt.warning == "" && len(warnings) > 0 || tt.warning != "" && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], tt.warning)) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestRun_ResumeGreeting_OnceAfterSnooze(t *testing.T) {
+	args := map[string]any{"resume_greeting": true}
+	state := map[string]any{"snooze_until": "2026-02-22"}
+
+	// Snoozed, then the first runs on the day it lapses: before the window,
+	// inside it, and again the next day.
+	steps := []struct {
+		now      string
+		status   string
+		occasion any
+	}{
+		{"2026-02-21T10:00", "snoozed", nil},
+		{"2026-02-22T06:00", "waiting", nil},
+		{"2026-02-22T08:30", "sent", "resumed"},
+		{"2026-02-22T12:00", "already_sent", nil},
+		{"2026-02-23T08:30", "waiting", nil},
+	}
+	for _, step := range steps {
+		out, err := run(inputWith(args, state), at(step.now), fixedRand(120), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.now, err)
+		}
+		if out.Data["status"] != step.status || out.Data["occasion"] != step.occasion {
+			t.Fatalf("%s: status = %v, occasion = %v, want %s, %v", step.now, out.Data["status"], out.Data["occasion"], step.status, step.occasion)
+		}
+		state = out.State
+	}
+	if _, ok := state["resume_pending"]; ok {
+		t.Errorf("state = %v, want resume_pending cleared", state)
+	}
+}
+
+func TestRun_ResumeGreeting_AfterExpiryMoves(t *testing.T) {
+	out, err := run(inputWith(map[string]any{"resume_greeting": true, "expires_on": "2026-02-20"}, nil), at("2026-02-21T10:00"), fixedRand(0), nil)
+	if err != nil || out.Data["status"] != "expired" || out.State["resume_pending"] != true {
+		t.Fatalf("expired run = %v, %v (err %v), want resume_pending recorded", out.Data, out.State, err)
+	}
 
-	sched, _ := out.State["scheduled_for"].(string)
-	var schedTime time.Time
-	schedTime, err = time.Parse("2006-01-02T15:04", sched)
+	// The campaign is extended: the next run greets straight away.
+	out, err = run(inputWith(map[string]any{"resume_greeting": true, "expires_on": "2026-03-31"}, out.State), at("2026-02-22T10:00"), fixedRand(0), nil)
 	if err != nil {
-		t.Fatalf("parse scheduled_for %q: %v", sched, err)
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if h := schedTime.Hour(); h < 9 || h >= 17 {
-		t.Errorf("scheduled hour %d outside window [9, 17)", h)
+	if !out.ContinueToLLM || out.Data["occasion"] != "resumed" {
+		t.Errorf("data = %v, want a resumed send", out.Data)
+	}
+}
+
+func TestRun_ResumeGreeting_Off(t *testing.T) {
+	// Without resume_greeting a lapsed snooze just picks as usual.
+	out, err := run(inputWith(nil, map[string]any{"snooze_until": "2026-02-22"}), at("2026-02-22T10:00"), fixedRand(600), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" {
+		t.Errorf("status = %v, want waiting", out.Data["status"])
+	}
+	if _, ok := out.State["resume_pending"]; ok {
+		t.Errorf("state = %v, want no resume_pending", out.State)
+	}
+}
+
+func TestRun_CreatedDate_DaysActive(t *testing.T) {
+	args := map[string]any{"timezone": "America/New_York"}
+
+	// First run: 01:00 UTC is still the previous evening in New York.
+	out, err := run(inputWith(args, nil), at("2026-02-22T01:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["created_date"] != "2026-02-21" || out.Data["days_active"] != 0 {
+		t.Fatalf("created_date = %v, days_active = %v; want 2026-02-21 and 0", out.State["created_date"], out.Data["days_active"])
+	}
+
+	// Later runs count calendar days from it and never move it, whatever
+	// else happens to the state.
+	state := out.State
+	for _, tt := range []struct {
+		now  string
+		want int
+	}{
+		{"2026-02-22T15:00", 1},
+		{"2026-03-01T15:00", 8},
+		{"2026-03-02T04:00", 8},
+	} {
+		out, err := run(inputWith(args, state), at(tt.now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.now, err)
+		}
+		if out.State["created_date"] != "2026-02-21" || out.Data["days_active"] != tt.want {
+			t.Errorf("%s: created_date = %v, days_active = %v; want 2026-02-21 and %d", tt.now, out.State["created_date"], out.Data["days_active"], tt.want)
+		}
+		state = out.State
+	}
+}
+
+func TestRun_CreatedDate_OnlyStampedWhenStateIsSaved(t *testing.T) {
+	// A run locked out by another worker hands the state back as found.
+	state := map[string]any{"lock": map[string]any{"token": "worker-b", "acquired_at": "2026-02-22T14:25:00Z"}}
+	out, err := run(inputWith(map[string]any{"lock_token": "worker-a"}, state), at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["skip_reason"] != "locked" {
+		t.Fatalf("skip_reason = %v, want locked", out.Data["skip_reason"])
+	}
+	if _, ok := out.State["created_date"]; ok {
+		t.Errorf("created_date = %v, want none from a locked run", out.State["created_date"])
+	}
+	if out.Data["days_active"] != 0 {
+		t.Errorf("days_active = %v, want 0", out.Data["days_active"])
+	}
+
+	// Nor does a dry run start the count.
+	out, err = run(inputWith(map[string]any{"dry_run": true}, nil), at("2026-02-22T14:30"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.State["created_date"]; ok {
+		t.Errorf("created_date = %v, want none from a dry run", out.State["created_date"])
+	}
+}
+
+func TestRun_CreatedDate_Malformed(t *testing.T) {
+	out, err := run(inputWith(nil, map[string]any{"created_date": "last spring"}), at("2026-02-22T10:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := out.Data["days_active"]; ok || out.State["created_date"] != "last spring" {
+		t.Errorf("days_active = %v, created_date = %v; want none and the value kept", out.Data["days_active"], out.State["created_date"])
+	}
+	if warnings, _ := out.Data["warnings"].([]string); len(warnings) != 1 || !strings.HasPrefix(warnings[0], `state.created_date "last spring"`) {
+		t.Errorf("warnings = %q, want one about created_date", warnings)
+	}
+}
+
+func TestRun_ErrorKinds(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  map[string]any
+		state map[string]any
+		want  ErrorKind
+	}{
+		{"inverted window", map[string]any{"earliest_hour": 20, "latest_hour": 8}, nil, ConfigError},
+		{"bad state_patch", map[string]any{"state_patch": map[string]any{"streak": -1}}, nil, ConfigError},
+		{"state from a newer release", nil, map[string]any{"version": stateVersion + 1}, StateError},
+		{"corrupt compact state", nil, map[string]any{"_c": "not base64!"}, StateError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(inputWith(tt.args, tt.state), at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if got := KindOf(err); got != tt.want {
+				t.Errorf("KindOf(%v) = %s, want %s", err, got, tt.want)
+			}
+		})
+	}
+
+	if got := KindOf(errors.New("not from run")); got != InternalError {
+		t.Errorf("KindOf(plain error) = %s, want %s", got, InternalError)
+	}
+}
+
+func TestRun_ShiftToNextAllowed_WeeklySendMovesToMonday(t *testing.T) {
+	args := map[string]any{
+		"cadence":               "weekly",
+		"weekday":               "sat",
+		"business_days_only":    true,
+		"shift_to_next_allowed": true,
+	}
+	// Wake every 15 minutes from Friday 2026-02-20 to Wednesday 2026-03-04.
+	state := map[string]any{}
+	var sent []string
+	for now := at("2026-02-20T00:00"); now.Before(at("2026-03-05T00:00")); now = now.Add(15 * time.Minute) {
+		out, err := run(inputWith(args, state), now, fixedRand(7), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", now, err)
+		}
+		if out.ContinueToLLM {
+			sent = append(sent, now.Format("2006-01-02"))
+		}
+		state = out.State
+	}
+	// The excluded Saturdays' sends land on the following Mondays, once each.
+	if fmt.Sprint(sent) != "[2026-02-23 2026-03-02]" {
+		t.Errorf("sent on %v, want [2026-02-23 2026-03-02]", sent)
+	}
+
+	parsed, err := parseArgs(args)
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if err := AssertOneSendPerDay(parsed, 28, fixedRand(7)); err != nil {
+		t.Error(err)
+	}
+
+	// Without the shift, the same configuration never sends.
+	parsed.ShiftToNextAllowed = false
+	for d := at("2026-02-20T00:00"); d.Before(at("2026-03-05T00:00")); d = d.AddDate(0, 0, 1) {
+		if parsed.dayAllowed(d) {
+			t.Errorf("%s allowed without shift_to_next_allowed", d.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestRun_BatchSize_SpreadsRecipientsAcrossRuns(t *testing.T) {
+	args := map[string]any{"name": []any{"Ann", "Ben", "Cal", "Dee", "Eve"}, "batch_size": 2}
+	state := map[string]any{"scheduled_for": "2026-02-22T09:00"}
+	runs := []struct {
+		now       string
+		names     string
+		tod       string
+		remaining any
+	}{
+		{"2026-02-22T09:00", "[Ann Ben]", "morning", 3},
+		{"2026-02-22T13:00", "[Cal Dee]", "afternoon", 1},
+		{"2026-02-22T18:00", "[Eve]", "evening", nil},
+	}
+	for _, r := range runs {
+		out, err := run(inputWith(args, state), at(r.now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", r.now, err)
+		}
+		if !out.ContinueToLLM {
+			t.Fatalf("%s: data = %v, want a send", r.now, out.Data)
+		}
+		messages, _ := out.Data["messages"].([]map[string]any)
+		var names []any
+		for _, m := range messages {
+			names = append(names, m["name"])
+			if m["time_of_day"] != r.tod {
+				t.Errorf("%s: %v time_of_day = %v, want %s", r.now, m["name"], m["time_of_day"], r.tod)
+			}
+		}
+		if fmt.Sprint(names) != r.names {
+			t.Errorf("%s: greeted %v, want %s", r.now, names, r.names)
+		}
+		if out.Data["batch_remaining"] != r.remaining {
+			t.Errorf("%s: batch_remaining = %v, want %v", r.now, out.Data["batch_remaining"], r.remaining)
+		}
+		state = out.State
+	}
+	if state["last_sent_date"] != "2026-02-22" || state["batch_sent"] != nil {
+		t.Errorf("state = %v, want the day sent and the batch cleared", state)
+	}
+
+	// Everyone has been greeted: later runs don't send again.
+	out, err := run(inputWith(args, state), at("2026-02-22T19:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipAlreadySentToday) {
+		t.Errorf("data = %v, want already sent today", out.Data)
+	}
+}
+
+func TestParseArgs_BatchSize_RejectsConfirmDelivery(t *testing.T) {
+	_, err := parseArgs(map[string]any{"name": []any{"a", "b", "c"}, "batch_size": 1, "confirm_delivery": true})
+	if err == nil || !strings.Contains(err.Error(), "batch_size") || !strings.Contains(err.Error(), "confirm_delivery") {
+		t.Errorf("error = %v, want one naming batch_size and confirm_delivery", err)
+	}
+}
+
+func TestRun_RecipientPool_OneWeighted(t *testing.T) {
+	args := map[string]any{
+		"selection": "one_weighted",
+		"recipient_pool": []any{
+			map[string]any{"name": "Alice", "weight": 1},
+			map[string]any{"name": "Bob", "weight": 3},
+			map[string]any{"name": "Cal", "weight": 1},
+		},
+	}
+	// Cumulative weights: Alice 0, Bob 1–3, Cal 4.
+	for draw, want := range map[int]string{0: "Alice", 1: "Bob", 3: "Bob", 4: "Cal"} {
+		out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(draw), nil)
+		if err != nil {
+			t.Fatalf("draw %d: unexpected error: %v", draw, err)
+		}
+		if out.State["pool_choice"] != want || out.State["pool_date"] != "2026-02-22" {
+			t.Errorf("draw %d: state = %v, want %s chosen for 2026-02-22", draw, out.State, want)
+		}
+	}
+
+	// The day's choice holds on later runs, whatever they draw.
+	out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(4), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	due := out.State
+	due["scheduled_for"] = "2026-02-22T09:00"
+	out, err = run(inputWith(args, due), at("2026-02-22T09:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || out.Data["name"] != "Cal" {
+		t.Errorf("data = %v, want the send to greet Cal", out.Data)
+	}
+
+	// The next day draws again.
+	out, err = run(inputWith(args, out.State), at("2026-02-23T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.State["pool_choice"] != "Alice" {
+		t.Errorf("pool_choice = %v, want a fresh draw of Alice", out.State["pool_choice"])
+	}
+}
+
+func TestParseArgs_RecipientPool_Validated(t *testing.T) {
+	tests := []map[string]any{
+		{"selection": "one_weighted"},
+		{"selection": "one_weighted", "recipient_pool": []any{map[string]any{"name": "Alice", "weight": 0}}},
+		{"selection": "one_weighted", "recipient_pool": []any{map[string]any{"name": "Alice", "weight": -2}}},
+		{"selection": "one_weighted", "recipient_pool": []any{map[string]any{"name": " ", "weight": 1}}},
+		{"selection": "some"},
+	}
+	for _, raw := range tests {
+		if _, err := parseArgs(raw); err == nil {
+			t.Errorf("%v: expected error, got nil", raw)
+		}
+	}
+}
+
+func TestRun_NameFromState(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  map[string]any
+		state string
+		want  string
+	}{
+		{"argument wins", map[string]any{"name": "Alice"}, "Sam", "Alice"},
+		{"state when the argument is absent", nil, "  Sam ", "Sam"},
+		{"state when the argument is blank", map[string]any{"name": " "}, "Sam", "Sam"},
+		{"default when neither", nil, "", "friend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := map[string]any{"scheduled_for": "2026-02-22T09:00", "name": tt.state}
+			out, err := run(inputWith(tt.args, state), at("2026-02-22T10:00"), fixedRand(0), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Data["name"] != tt.want {
+				t.Errorf("name = %v, want %s", out.Data["name"], tt.want)
+			}
+		})
+	}
+
+	// A state-sourced name is sanitised like an argument.
+	for _, bad := range []string{"Sam\nBot", strings.Repeat("s", 101)} {
+		_, err := run(inputWith(nil, map[string]any{"name": bad}), at("2026-02-22T10:00"), fixedRand(0), nil)
+		if KindOf(err) != StateError {
+			t.Errorf("state name %q: err = %v, want a state error", bad, err)
+		}
+	}
+}
+
+func TestRun_Once_SendsASingleTime(t *testing.T) {
+	args := map[string]any{"name": "Alice", "once": true}
+	out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Data["status"] != "waiting" {
+		t.Fatalf("data = %v, want the first send scheduled", out.Data)
+	}
+	out, err = run(inputWith(args, out.State), at("2026-02-22T08:00"), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || out.State["completed"] != true {
+		t.Fatalf("data = %v, state = %v, want a send marked completed", out.Data, out.State)
+	}
+
+	// Every later run skips, through days, argument changes and even force.
+	state := out.State
+	later := []struct {
+		args map[string]any
+		now  string
+	}{
+		{args, "2026-02-22T12:00"},
+		{args, "2026-02-23T08:00"},
+		{map[string]any{"name": "Bob"}, "2026-03-01T09:00"},
+		{map[string]any{"force": true}, "2026-06-01T10:00"},
+	}
+	for _, l := range later {
+		out, err := run(inputWith(l.args, state), at(l.now), fixedRand(0), nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", l.now, err)
+		}
+		if out.ContinueToLLM || out.Data["skip_reason"] != string(SkipCompleted) {
+			t.Errorf("%s: data = %v, want a completed skip", l.now, out.Data)
+		}
+		if _, ok := out.State["scheduled_for"]; ok {
+			t.Errorf("%s: scheduled_for = %v, want none", l.now, out.State["scheduled_for"])
+		}
+		state = out.State
+	}
+}
+
+// ── EffectiveWindow ───────────────────────────────────────────────────────────
+
+func TestEffectiveWindow(t *testing.T) {
+	sat := time.Date(2026, 2, 21, 6, 0, 0, 0, time.UTC)
+	mon := time.Date(2026, 2, 23, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name             string
+		args             map[string]any
+		day              time.Time
+		earliest, latest string
+	}{
+		{"defaults", map[string]any{}, mon, "2026-02-23T08:00:00Z", "2026-02-23T20:00:00Z"},
+		{"preset", map[string]any{"window_preset": "business_hours"}, mon, "2026-02-23T09:00:00Z", "2026-02-23T17:00:00Z"},
+		{"weekday override applies", map[string]any{"windows": map[string]any{"sat": map[string]any{"earliest_hour": 10, "latest_hour": 12}}}, sat, "2026-02-21T10:00:00Z", "2026-02-21T12:00:00Z"},
+		{"weekday override elsewhere", map[string]any{"windows": map[string]any{"sat": map[string]any{"earliest_hour": 10, "latest_hour": 12}}}, mon, "2026-02-23T08:00:00Z", "2026-02-23T20:00:00Z"},
+		{"inclusive latest_minute", map[string]any{"latest_hour": 11, "latest_minute": 30}, mon, "2026-02-23T08:00:00Z", "2026-02-23T11:31:00Z"},
+		{"blackouts trim both edges", map[string]any{"blackout_ranges": []any{
+			map[string]any{"start": 8, "end": 9},
+			map[string]any{"start": 19, "end": 20},
+		}}, mon, "2026-02-23T09:00:00Z", "2026-02-23T19:00:00Z"},
+		// 03:00 UTC on Monday is still Sunday evening in New York.
+		{"timezone", map[string]any{"timezone": "America/New_York"}, time.Date(2026, 2, 23, 3, 0, 0, 0, time.UTC), "2026-02-22T08:00:00-05:00", "2026-02-22T20:00:00-05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := parseArgs(tt.args)
+			if err != nil {
+				t.Fatalf("parseArgs: %v", err)
+			}
+			earliest, latest, err := EffectiveWindow(args, tt.day)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := earliest.Format(time.RFC3339); got != tt.earliest {
+				t.Errorf("earliest = %s, want %s", got, tt.earliest)
+			}
+			if got := latest.Format(time.RFC3339); got != tt.latest {
+				t.Errorf("latest = %s, want %s", got, tt.latest)
+			}
+		})
+	}
+}
+
+func TestEffectiveWindow_MatchesPicks(t *testing.T) {
+	args, err := parseArgs(map[string]any{
+		"timezone": "Asia/Tokyo",
+		"windows":  map[string]any{"sun": map[string]any{"earliest_hour": 14, "latest_hour": 16}},
+	})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	day := time.Date(2026, 2, 22, 0, 0, 0, 0, args.location())
+	earliest, latest, err := EffectiveWindow(args, day)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := int(latest.Sub(earliest) / time.Minute)
+	for _, offset := range []int{0, n - 1} {
+		picked, err := pickSchedule(args, "2026-02-22", fixedRand(offset))
+		if err != nil {
+			t.Fatalf("pickSchedule: %v", err)
+		}
+		at, err := args.scheduledInstant(picked)
+		if err != nil {
+			t.Fatalf("scheduledInstant: %v", err)
+		}
+		if at.Before(earliest) || !at.Before(latest) {
+			t.Errorf("offset %d picked %s, outside [%s, %s)", offset, at, earliest, latest)
+		}
+	}
+}
+
+// ── WouldSend ─────────────────────────────────────────────────────────────────
+
+func TestWouldSend(t *testing.T) {
+	args, err := parseArgs(map[string]any{})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	tests := []struct {
+		name  string
+		state goblinState
+		at    string
+		want  bool
+	}{
+		{"no schedule yet", goblinState{}, "2026-02-22T15:00", false},
+		{"stale schedule", goblinState{ScheduledFor: "2026-02-21T10:00"}, "2026-02-22T15:00", false},
+		{"before schedule", goblinState{ScheduledFor: "2026-02-22T14:30"}, "2026-02-22T14:29", false},
+		{"at schedule", goblinState{ScheduledFor: "2026-02-22T14:30"}, "2026-02-22T14:30", true},
+		{"after schedule", goblinState{ScheduledFor: "2026-02-22T14:30"}, "2026-02-22T19:00", true},
+		{"already sent", goblinState{LastSentDate: "2026-02-22", ScheduledFor: "2026-02-22T14:30"}, "2026-02-22T19:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WouldSend(args, tt.state, at(tt.at)); got != tt.want {
+				t.Errorf("WouldSend(%+v, %s) = %v, want %v", tt.state, tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWouldSend_ImmediateFirstRunIsConservative(t *testing.T) {
+	// An immediate first run sends only if its send_probability roll wins,
+	// which WouldSend can't know, so it answers no; without a roll, yes.
+	for p, want := range map[float64]bool{0.5: false, 1: true} {
+		args, err := parseArgs(map[string]any{"immediate_first_run": true, "send_probability": p})
+		if err != nil {
+			t.Fatalf("parseArgs: %v", err)
+		}
+		if got := WouldSend(args, goblinState{}, at("2026-02-22T12:00")); got != want {
+			t.Errorf("send_probability %v: WouldSend = %v, want %v", p, got, want)
+		}
+	}
+
+	// A day already rolled and scheduled isn't rolled again.
+	args, _ := parseArgs(map[string]any{"send_probability": 0.5})
+	if !WouldSend(args, goblinState{ScheduledFor: "2026-02-22T10:00"}, at("2026-02-22T12:00")) {
+		t.Error("WouldSend = false, want the kept schedule to send")
+	}
+}
+
+// ── AssertOneSendPerDay ───────────────────────────────────────────────────────
+
+func TestAssertOneSendPerDay_PassesForWorkingConfigs(t *testing.T) {
+	tests := []struct {
+		args map[string]any
+		days int
+	}{
+		{map[string]any{}, 42},
+		{map[string]any{"days": []any{"mon", "wed", "fri"}, "skip_dates": []any{"2024-01-03"}}, 42},
+		{map[string]any{"cadence": "weekly", "weekday": "thu"}, 42},
+		{map[string]any{"interval_days": 3}, 42},
+		{map[string]any{"monthly_nth_weekday": map[string]any{"weekday": "mon", "n": -1}}, 60},
+		// A night-time window in New York over a full year crosses both DST
+		// transitions.
+		{map[string]any{"timezone": "America/New_York", "earliest_hour": 1, "latest_hour": 4}, 366},
+		// An all-day window, through the 23- and 25-hour days.
+		{map[string]any{"timezone": "America/New_York", "window_preset": "anytime"}, 310},
+	}
+	for _, tt := range tests {
+		args, err := parseArgs(tt.args)
+		if err != nil {
+			t.Fatalf("%v: parseArgs: %v", tt.args, err)
+		}
+		for _, v := range []int{7, 119} {
+			if err := AssertOneSendPerDay(args, tt.days, fixedRand(v)); err != nil {
+				t.Errorf("%v, rand %d: %v", tt.args, v, err)
+			}
+		}
+	}
+}
+
+func TestAssertOneSendPerDay_FailsForBrokenConfig(t *testing.T) {
+	// A one-minute max delay can't survive 15-minute ticks: 08:07 is only
+	// seen at 08:15, by which time today has been abandoned.
+	args, err := parseArgs(map[string]any{"max_delay_minutes": 1})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	err = AssertOneSendPerDay(args, 7, fixedRand(7))
+	if err == nil || !strings.Contains(err.Error(), "2024-01-01: 0 sends") {
+		t.Errorf("AssertOneSendPerDay = %v, want a zero-send error on 2024-01-01", err)
+	}
+}
+
+func TestRun_MinuteWindow_PicksStayInside(t *testing.T) {
+	// 08:30–08:45 inclusive is 16 minutes; every offset must land inside.
+	args := map[string]any{
+		"earliest_hour":   float64(8),
+		"earliest_minute": float64(30),
+		"latest_hour":     float64(8),
+		"latest_minute":   float64(45),
+	}
+	for offset := 0; offset < 16; offset++ {
+		out, err := run(inputWith(args, nil), at("2026-02-22T07:00"), fixedRand(offset), nil)
+		if err != nil {
+			t.Fatalf("offset %d: unexpected error: %v", offset, err)
+		}
+		want := fmt.Sprintf("2026-02-22T08:%02d", 30+offset)
+		if out.State["scheduled_for"] != want {
+			t.Errorf("offset %d: scheduled_for = %v, want %s", offset, out.State["scheduled_for"], want)
+		}
+	}
+}
+
+// ── Replay ────────────────────────────────────────────────────────────────────
+
+func TestReplay_FirstRunThenSend(t *testing.T) {
+	args := map[string]any{"name": "Alice"}
+	outs, err := Replay([]ReplayStep{
+		{Now: at("2026-02-22T07:00"), Arguments: args, RandIntn: fixedRand(60)},
+		{Now: at("2026-02-22T08:30")},
+		{Now: at("2026-02-22T09:00")},
+		{Now: at("2026-02-22T12:00")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []struct {
+		sent      bool
+		reason    SkipReason
+		scheduled any
+		lastSent  any
+	}{
+		{false, SkipSchedulePicked, "2026-02-22T09:00", nil},
+		{false, SkipBeforeScheduledTime, "2026-02-22T09:00", nil},
+		{true, "", nil, "2026-02-22"},
+		{false, SkipAlreadySentToday, nil, "2026-02-22"},
+	}
+	if len(outs) != len(want) {
+		t.Fatalf("got %d outputs, want %d", len(outs), len(want))
+	}
+	for i, w := range want {
+		out := outs[i]
+		if out.ContinueToLLM != w.sent {
+			t.Errorf("step %d: sent = %v, want %v (data %v)", i, out.ContinueToLLM, w.sent, out.Data)
+		}
+		if reason, _ := out.Data["skip_reason"].(string); reason != string(w.reason) {
+			t.Errorf("step %d: skip_reason = %q, want %q", i, reason, w.reason)
+		}
+		if out.State["scheduled_for"] != w.scheduled {
+			t.Errorf("step %d: scheduled_for = %v, want %v", i, out.State["scheduled_for"], w.scheduled)
+		}
+		if out.State["last_sent_date"] != w.lastSent {
+			t.Errorf("step %d: last_sent_date = %v, want %v", i, out.State["last_sent_date"], w.lastSent)
+		}
+	}
+}
+
+func TestReplay_StateOverrideAndError(t *testing.T) {
+	// A step's State replaces what the previous step left behind.
+	outs, err := Replay([]ReplayStep{
+		{Now: at("2026-02-22T07:00"), Arguments: map[string]any{"name": "Alice"}},
+		{Now: at("2026-02-22T10:00"), State: map[string]any{"scheduled_for": "2026-02-22T09:30"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !outs[1].ContinueToLLM {
+		t.Errorf("data = %v, want the injected schedule to send", outs[1].Data)
+	}
+
+	// A failing step stops the replay, keeping the outputs before it.
+	outs, err = Replay([]ReplayStep{
+		{Now: at("2026-02-22T07:00"), Arguments: map[string]any{"name": "Alice"}},
+		{Now: at("2026-02-22T08:00"), Arguments: map[string]any{"timezone": "Mars/Olympus"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "replay step 1") || KindOf(err) != ConfigError {
+		t.Errorf("err = %v, want a config error naming step 1", err)
+	}
+	if len(outs) != 1 {
+		t.Errorf("got %d outputs, want the 1 before the failure", len(outs))
+	}
+}
+
+// ── HealthCheck ───────────────────────────────────────────────────────────────
+
+func TestHealthCheck_Passes(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		if err := HealthCheck(rand.New(rand.NewSource(seed)).Intn); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestHealthCheck_NamesTheBrokenInvariant(t *testing.T) {
+	// A random source that ignores its bound breaks the in-window invariant.
+	broken := func(n int) int { return n + 60 }
+	err := HealthCheck(broken)
+	if err == nil || !strings.HasPrefix(err.Error(), "healthcheck pick_in_window:") {
+		t.Errorf("err = %v, want pick_in_window to fail", err)
+	}
+
+	// Checks stop at the first failure.
+	ran := 0
+	checks := []healthCheck{
+		{"first", func(func(int) int) error { ran++; return nil }},
+		{"second", func(func(int) int) error { ran++; return errors.New("boom") }},
+		{"third", func(func(int) int) error { ran++; return nil }},
+	}
+	if err := runHealthChecks(checks, fixedRand(0)); err == nil || err.Error() != "healthcheck second: boom" {
+		t.Errorf("err = %v, want healthcheck second: boom", err)
+	}
+	if ran != 2 {
+		t.Errorf("ran %d checks, want 2", ran)
+	}
+}
+
+// ── golden output ─────────────────────────────────────────────────────────────
+
+// update rewrites the golden files from the current output instead of
+// comparing against them: go test -run TestRun_Golden -update
+var update = flag.Bool("update", false, "rewrite testdata/golden from the current output")
+
+// goldenJSON serializes out for comparison with a golden file. Round-tripping
+// through a generic value sorts every object's keys, struct-valued fields
+// included, so the bytes depend only on the output's content.
+func goldenJSON(out sdk.Output) ([]byte, error) {
+	raw, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// checkGolden compares out against testdata/golden/<name>.json, or rewrites
+// the file when -update is set.
+func checkGolden(t *testing.T, name string, out sdk.Output) {
+	t.Helper()
+	got, err := goldenJSON(out)
+	if err != nil {
+		t.Fatalf("serialize output: %v", err)
+	}
+	path := filepath.Join("testdata", "golden", name+".json")
+	if *update {
+		if err := writeGolden(path, got); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -run TestRun_Golden -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run with -update if the change is intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// writeGolden writes a regenerated golden file, creating its directory.
+func writeGolden(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("write golden: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("write golden: %w", err)
+	}
+	return nil
+}
+
+func TestRun_Golden(t *testing.T) {
+	tests := []struct {
+		name  string
+		now   time.Time
+		state map[string]any
+	}{
+		{"first_run", at("2026-02-22T08:00"), nil},
+		{"send", at("2026-02-22T10:05"), map[string]any{
+			"version": float64(stateVersion), "scheduled_for": "2026-02-22T10:00", "last_sent_date": "2026-02-21", "streak": float64(3),
+		}},
+		{"already_sent", at("2026-02-22T14:00"), map[string]any{
+			"version": float64(stateVersion), "scheduled_for": "2026-02-22T10:00", "last_sent_date": "2026-02-22", "streak": float64(4),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := inputWith(map[string]any{"name": "Alice"}, tt.state)
+			out, err := run(input, tt.now, fixedRand(2), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkGolden(t, tt.name, out)
+		})
+	}
+}
+
+func TestGoldenJSON_SortsKeys(t *testing.T) {
+	out := sdk.Output{Data: map[string]any{"b": 1, "a": struct {
+		Z int `json:"z"`
+		Y int `json:"y"`
+	}{1, 2}}}
+	got, err := goldenJSON(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"continue_to_llm\": false,\n  \"data\": {\n    \"a\": {\n      \"y\": 2,\n      \"z\": 1\n    },\n    \"b\": 1\n  }\n}\n"
+	if string(got) != want {
+		t.Errorf("goldenJSON =\n%s\nwant:\n%s", got, want)
 	}
 }
@@ -1,23 +1,93 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
+	"time"
+	// WASI runtimes rarely expose a zoneinfo directory, so embed the tz
+	// database for the timezone argument.
+	_ "time/tzdata"
 
 	sdk "github.com/ai-goblins/goblin-sdk"
 )
 
 func main() {
+	// `goblin-starter.wasm --schema` describes the arguments instead of
+	// running, for tooling that builds configuration UIs.
+	if len(os.Args) > 1 && os.Args[1] == "--schema" {
+		os.Stdout.Write(append(ArgsSchema(), '\n'))
+		return
+	}
+
+	// `goblin-starter.wasm --validate args.json` checks a blueprint's
+	// arguments, printing the resolved configuration or exiting non-zero
+	// with the error, for gating deploys in CI.
+	if len(os.Args) > 2 && os.Args[1] == "--validate" {
+		data, err := os.ReadFile(os.Args[2])
+		if err == nil {
+			data, err = ValidateArgs(data)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	// `goblin-starter.wasm --healthcheck` runs the self-tests without
+	// reading any input, exiting non-zero with the failing check named,
+	// for deployment smoke tests.
+	if len(os.Args) > 1 && os.Args[1] == "--healthcheck" {
+		if err := HealthCheck(rand.Intn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("ok")
+		return
+	}
+
 	input, err := sdk.ReadInput()
 	if err != nil {
 		sdk.WriteError(err)
 		return
 	}
 
-	output, err := run(input, input.RunAt, rand.Intn)
+	logger := stderrLogger{debug: os.Getenv("GOBLIN_DEBUG") != ""}
+	decision, output, err := Decide(input, clock(input), rand.Intn, logger)
 	if err != nil {
-		sdk.WriteError(err)
+		// Name the kind, so the pipeline's error record says whether the
+		// blueprint or the state needs fixing, or the run is worth retrying.
+		sdk.WriteError(fmt.Errorf("%s error: %w", KindOf(err), err))
 		return
 	}
 
+	logger.Debugf("decision: %s", decision)
 	sdk.WriteOutput(output)
 }
+
+// clock returns the now to run input at: RunAt, moved by any
+// clock_offset_minutes. Arguments that don't parse leave RunAt as it is, for
+// run to report.
+func clock(input sdk.Input) time.Time {
+	args, err := parseArgs(input.Arguments)
+	if err != nil {
+		return input.RunAt
+	}
+	return input.RunAt.Add(time.Duration(args.ClockOffsetMinutes) * time.Minute)
+}
+
+// stderrLogger writes run's log events to stderr, leaving stdout to the
+// output envelope. Debug events are dropped unless debug is set.
+type stderrLogger struct{ debug bool }
+
+func (l stderrLogger) Debugf(format string, args ...any) {
+	if l.debug {
+		fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
+	}
+}
+
+func (l stderrLogger) Infof(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "info: "+format+"\n", args...)
+}
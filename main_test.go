@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	sdk "github.com/ai-goblins/goblin-sdk"
+)
+
+func TestClock_AppliesOffset(t *testing.T) {
+	runAt := time.Date(2026, 2, 22, 7, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		args map[string]any
+		want time.Time
+	}{
+		{"no offset", map[string]any{}, runAt},
+		{"fast-forward", map[string]any{"clock_offset_minutes": 150}, runAt.Add(150 * time.Minute)},
+		{"rewind", map[string]any{"clock_offset_minutes": "-60"}, runAt.Add(-time.Hour)},
+		{"unparseable args", map[string]any{"timezone": "Mars/Olympus"}, runAt},
+	}
+	for _, tt := range tests {
+		if got := clock(sdk.Input{Arguments: tt.args, RunAt: runAt}); !got.Equal(tt.want) {
+			t.Errorf("%s: clock = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClock_OffsetReachesRun(t *testing.T) {
+	// Fast-forwarded two hours, the 07:00 invocation sees the 09:00 schedule
+	// as due.
+	input := sdk.Input{
+		Arguments: map[string]any{"name": "Alice", "clock_offset_minutes": 120},
+		State:     map[string]any{"scheduled_for": "2026-02-22T09:00"},
+		RunAt:     time.Date(2026, 2, 22, 7, 0, 0, 0, time.UTC),
+	}
+	out, err := run(input, clock(input), fixedRand(0), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !out.ContinueToLLM || out.State["last_sent_at"] != "2026-02-22T09:00:00Z" {
+		t.Errorf("data = %v, state = %v; want a send at the shifted 09:00", out.Data, out.State)
+	}
+}
+
+func TestParseArgs_ClockOffset_Bounded(t *testing.T) {
+	for _, v := range []int{maxClockOffsetMinutes + 1, -maxClockOffsetMinutes - 1} {
+		if _, err := parseArgs(map[string]any{"clock_offset_minutes": v}); err == nil {
+			t.Errorf("clock_offset_minutes=%d: expected error, got nil", v)
+		}
+	}
+}